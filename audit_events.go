@@ -0,0 +1,58 @@
+package faaspromql
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	faas "github.com/poy/cf-faas"
+)
+
+// AuditEventHandler handles the events POSTed for an audit_events event.
+type AuditEventHandler interface {
+	HandleAuditEvent(AuditEvent) error
+}
+
+type AuditEventHandlerFunc func(AuditEvent) error
+
+func (f AuditEventHandlerFunc) HandleAuditEvent(e AuditEvent) error {
+	return f(e)
+}
+
+// StartAuditEvents is like Start, but for functions that have an
+// audit_events event.
+func StartAuditEvents(h AuditEventHandler) {
+	faas.Start(faas.HandlerFunc(func(req faas.Request) (faas.Response, error) {
+		var e AuditEvent
+		if err := json.Unmarshal(req.Body, &e); err != nil {
+			return faas.Response{}, err
+		}
+
+		if err := h.HandleAuditEvent(e); err != nil {
+			return faas.Response{}, err
+		}
+
+		return faas.Response{
+			StatusCode: http.StatusOK,
+		}, nil
+	}))
+}
+
+// AuditEvent is a CAPI audit event (e.g., audit.app.process.crash). It is
+// POSTed once for each event, oldest first.
+type AuditEvent struct {
+	Guid      string                 `json:"guid"`
+	Type      string                 `json:"type"`
+	CreatedAt time.Time              `json:"created_at"`
+	Actor     AuditEventActor        `json:"actor"`
+	Target    AuditEventActor        `json:"target"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Context   string                 `json:"context"`
+}
+
+// AuditEventActor is the actor or the target of an audit event.
+type AuditEventActor struct {
+	Guid string `json:"guid"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
-	"strings"
+	"regexp"
 	"time"
 
 	envstruct "code.cloudfoundry.org/go-envstruct"
+	"github.com/poy/cf-faas-log-cache/internal/access"
+	"github.com/poy/cf-faas-log-cache/internal/audit"
+	"github.com/poy/cf-faas-log-cache/internal/auth"
+	"github.com/poy/cf-faas-log-cache/internal/capi"
+	"github.com/poy/cf-faas-log-cache/internal/discovery"
+	"github.com/poy/cf-faas-log-cache/internal/logs"
 	"github.com/poy/cf-faas-log-cache/internal/promql"
+	"github.com/poy/cf-faas-log-cache/internal/sources"
 	"github.com/poy/cf-faas-log-cache/internal/state"
+	"github.com/poy/cf-faas-log-cache/internal/tlsconfig"
 	"github.com/poy/cf-faas-log-cache/internal/web"
 	pkgpromql "github.com/poy/cf-faas-log-cache/pkg/promql"
 	gocapi "github.com/poy/go-capi"
@@ -24,68 +34,416 @@ func main() {
 
 	cfg := loadConfig(log)
 
+	// Every outbound client (UAA, CAPI, Log Cache and CF-FaaS) shares the
+	// same TLS configuration.
+	httpClient, err := tlsconfig.NewClient(tlsconfig.Config{
+		SkipSSLValidation: cfg.SkipSSLValidation,
+		CACerts:           cfg.CACerts,
+		CAFile:            cfg.CAFile,
+		CertFile:          cfg.ClientCertFile,
+		KeyFile:           cfg.ClientKeyFile,
+	}, log)
+	if err != nil {
+		log.Fatalf("failed to configure TLS: %s", err)
+	}
+	go httpClient.Watch(cfg.TLSReloadInterval)
+
+	endpoints := resolveEndpoints(cfg, httpClient, log)
+
+	tokenDoer := auth.NewTokenDoer(
+		auth.NewTokenSource(
+			endpoints.UAA,
+			cfg.ClientID,
+			cfg.ClientSecret,
+			cfg.RefreshToken,
+			httpClient,
+		),
+		httpClient,
+	)
+
 	capiClient := gocapi.NewClient(
 		cfg.VcapApplication.CAPIAddr,
 		cfg.VcapApplication.ApplicationID,
 		cfg.VcapApplication.SpaceID,
-		http.DefaultClient,
+		tokenDoer,
 	)
 
-	sanitizer := pkgpromql.NewSanitizer(capiClient)
+	// The client's timeout is only a ceiling. Each reader sets the deadline
+	// for its own query.
+	maxTimeout := cfg.QueryTimeout
+	for i, q := range cfg.Queries.Queries {
+		if q.Timeout == 0 {
+			cfg.Queries.Queries[i].Timeout = cfg.QueryTimeout
+		}
+		if q.Timeout > maxTimeout {
+			maxTimeout = q.Timeout
+		}
+	}
 
-	logCacheClient := pkgpromql.NewClient(
-		cfg.VcapApplication.LogCacheAddr,
+	// source_id matchers may name apps or service instances, either in this
+	// space or qualified as org/space/name.
+	sourceResolver := capi.NewSourceResolver(
+		cfg.VcapApplication.CAPIAddr,
+		cfg.VcapApplication.SpaceID,
+		tokenDoer,
+	)
+
+	sourceNamer := capi.NewSourceNamer(cfg.VcapApplication.CAPIAddr, tokenDoer, cfg.NameTTL, cfg.NameCacheSize)
+
+	guidCache := pkgpromql.NewGuidCache(sourceResolver, cfg.GuidTTL, cfg.GuidNegativeTTL)
+	go guidCache.RefreshEvery(cfg.GuidTTL/2, cfg.CAPITimeout)
+
+	// Platform components use names as their source IDs. Only those that
+	// may be read are not resolved.
+	sanitizer := pkgpromql.NewSanitizer(guidCache, pkgpromql.WithSourceIDs(cfg.AllowedSources...))
+
+	var logCacheClient pkgpromql.PromQLClient = pkgpromql.NewClient(
+		endpoints.LogCache,
 		sanitizer,
-		http.DefaultClient,
+		tokenDoer,
+		pkgpromql.WithTimeout(maxTimeout),
 	)
 
-	stateSaver := state.NewSaver(cfg.VcapApplication.ApplicationID, capiClient, log)
-	resolver := web.NewResolver(stateSaver, log)
+	logCacheReader := pkgpromql.NewLogCacheReader(endpoints.LogCache, tokenDoer)
+
+	// The local client also serves label discovery, whether or not it
+	// evaluates the queries.
+	localClient := pkgpromql.NewLocalClient(
+		logCacheReader,
+		sanitizer,
+		pkgpromql.WithLocalTimeout(maxTimeout),
+		pkgpromql.WithEnvelopeLimit(cfg.EnvelopeLimit),
+		pkgpromql.WithMaxPages(cfg.MaxPages),
+		pkgpromql.WithLogPatterns(cfg.LogPatterns...),
+		pkgpromql.WithTimerBuckets(cfg.TimerBuckets),
+	)
+	if cfg.LocalEvaluation {
+		logCacheClient = localClient
+	} else if len(cfg.LogPatterns) > 0 {
+		log.Printf("LOG_PATTERNS only apply to label discovery: log_lines_total requires LOCAL_EVALUATION=true")
+	}
+
+	cacheTTL := cfg.QueryCacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = cfg.Interval / 2
+	}
+	cachingClient := pkgpromql.NewCachingClient(
+		logCacheClient,
+		cacheTTL,
+		pkgpromql.WithCacheTimeout(maxTimeout),
+	)
+
+	checkpointer := state.NewCheckpointer(cfg.VcapApplication.ApplicationID, capiClient, cfg.Checkpoints)
+
+	stateSaver := state.NewSaver(
+		cfg.VcapApplication.ApplicationID,
+		capiClient,
+		log,
+		state.WithTimeout(cfg.CAPITimeout),
+		state.WithEnvironment(checkpointer),
+	)
+
+	// Functions may only read the sources in the allowed spaces (by default
+	// the service's own space) and those on the allow-list.
+	allowedSpaces := cfg.AllowedSpaces
+	if len(allowedSpaces) == 0 {
+		allowedSpaces = []string{cfg.VcapApplication.SpaceID}
+	}
+	authorizer := access.NewAuthorizer(guidCache, sourceNamer, allowedSpaces, cfg.AllowedSources)
+
+	resolver := web.NewResolver(stateSaver, log, web.WithAuthorizer(authorizer))
+
+	var enricherOpts []promql.EnricherOption
+	if cfg.EnrichSpaceName {
+		enricherOpts = append(enricherOpts, promql.WithSpaceName())
+	}
+	if cfg.EnrichOrgName {
+		enricherOpts = append(enricherOpts, promql.WithOrgName())
+	}
+	if cfg.EnrichInstanceIndex {
+		enricherOpts = append(enricherOpts, promql.WithInstanceIndex())
+	}
+	enricher := promql.NewEnricher(
+		sourceNamer,
+		log,
+		enricherOpts...,
+	)
+
+	auditEventLister := capi.NewAuditEventLister(
+		cfg.VcapApplication.CAPIAddr,
+		cfg.VcapApplication.SpaceID,
+		tokenDoer,
+	)
+
+	var (
+		readers  []*promql.Reader
+		tailers  []*logs.Tailer
+		pollers  []*audit.Poller
+		watchers []*sources.Watcher
+	)
+	for _, q := range cfg.Queries.Queries {
+		q.Path = "https://" + cfg.CFFaasAddr + q.Path
+		if q.Sources != nil {
+			watchers = append(watchers, sources.NewWatcher(
+				q,
+				logCacheReader,
+				sourceNamer,
+				tokenDoer,
+				log,
+				sources.WithAuthorizer(authorizer),
+				sources.WithPostTimeout(cfg.PostTimeout),
+			))
+			continue
+		}
+
+		if q.AuditEvents != nil {
+			pollers = append(pollers, audit.NewPoller(
+				q,
+				auditEventLister,
+				tokenDoer,
+				log,
+				audit.WithCheckpointer(checkpointer),
+				audit.WithMaxBacklog(cfg.MaxBackfill),
+				audit.WithPostTimeout(cfg.PostTimeout),
+			))
+			continue
+		}
+
+		if q.Logs != nil {
+			tailers = append(tailers, logs.NewTailer(
+				q,
+				logCacheReader,
+				guidCache,
+				tokenDoer,
+				log,
+				logs.WithCheckpointer(checkpointer),
+				logs.WithAuthorizer(authorizer),
+				logs.WithBatchSize(cfg.LogBatchSize),
+				logs.WithMaxBacklog(cfg.MaxBackfill),
+				logs.WithPostTimeout(cfg.PostTimeout),
+			))
+			continue
+		}
+
+		readers = append(readers, promql.NewReader(
+			q,
+			cachingClient,
+			tokenDoer,
+			log,
+			promql.WithCheckpointer(checkpointer),
+			promql.WithEnricher(enricher),
+			promql.WithAuthorizer(authorizer),
+			promql.WithPostTimeout(cfg.PostTimeout),
+		))
+	}
+
+	// Backfilling a reader can take many evaluations, so it runs in the
+	// background (a few readers at a time) while the readers tick.
+	go func() {
+		sem := make(chan struct{}, cfg.BackfillConcurrency)
+		for _, r := range readers {
+			sem <- struct{}{}
+			go func(r *promql.Reader) {
+				defer func() { <-sem }()
+				r.Backfill(cfg.Interval, cfg.MaxBackfill)
+			}(r)
+		}
+	}()
+
+	// Each trigger ticks on its own so that a slow one (e.g., a function
+	// that takes long to respond) does not delay the others.
+	var triggers []trigger
+	for _, r := range readers {
+		triggers = append(triggers, r)
+	}
+	for _, t := range tailers {
+		triggers = append(triggers, t)
+	}
+	for _, p := range pollers {
+		triggers = append(triggers, p)
+	}
+	for _, w := range watchers {
+		triggers = append(triggers, w)
+	}
+
+	for _, t := range triggers {
+		go func(t trigger) {
+			for range time.Tick(cfg.Interval) {
+				t.Tick()
+			}
+		}(t)
+	}
 
 	go func() {
-		var readers []*promql.Reader
-		for _, q := range cfg.Queries.Queries {
-			q.Path = "http://" + cfg.CFFaasAddr + q.Path
-			readers = append(readers, promql.NewReader(q, logCacheClient, http.DefaultClient, log))
+		for range time.Tick(cfg.CheckpointInterval) {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.CAPITimeout)
+			if err := checkpointer.Flush(ctx); err != nil {
+				log.Printf("failed to flush checkpoints: %s", err)
+			}
+			cancel()
 		}
+	}()
+
+	go func() {
+		for range time.Tick(cfg.StatsInterval) {
+			s := cachingClient.Stats()
+			log.Printf("query cache: %d hits, %d misses, %d coalesced", s.Hits, s.Misses, s.Coalesced)
+
+			gs := guidCache.Stats()
+			log.Printf(
+				"GUID cache: %d entries, %d hits, %d misses, %d refreshes, %d invalidations",
+				gs.Size, gs.Hits, gs.Misses, gs.Refreshes, gs.Invalidations,
+			)
 
-		for range time.Tick(cfg.Interval) {
+			var timeouts uint64
 			for _, r := range readers {
-				r.Tick()
+				timeouts += r.Timeouts()
 			}
+			for _, t := range tailers {
+				timeouts += t.Timeouts()
+			}
+			for _, p := range pollers {
+				timeouts += p.Timeouts()
+			}
+			for _, w := range watchers {
+				timeouts += w.Timeouts()
+			}
+			log.Printf("queries: %d timeouts", timeouts)
 		}
 	}()
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), resolver); err != nil {
+	labelsHandler := web.NewLabelsHandler(
+		localClient,
+		guidCache,
+		log,
+		web.WithSourceAuthorizer(authorizer),
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/labels", labelsHandler)
+	mux.Handle("/api/v1/label/", labelsHandler)
+	mux.Handle("/", resolver)
+
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), mux); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// trigger is a reader, tailer, poller or watcher.
+type trigger interface {
+	Tick()
+}
+
 type config struct {
+	// Port does not authenticate requests. run.sh sets it to the backend
+	// port of the reverse-proxy, which does.
 	Port            int             `env:"PORT,required,report"`
 	VcapApplication vcapApplication `env:"VCAP_APPLICATION, required, report"`
 	Queries         Queries         `env:"QUERIES, report"`
 	Interval        time.Duration   `env:"INTERVAL,report"`
 	CFFaasAddr      string          `env:"CF_FAAS_ADDR,required,report"`
 
+	// QueryCacheTTL is how long a query result is shared between readers.
+	// Defaults to half the Interval.
+	QueryCacheTTL time.Duration `env:"QUERY_CACHE_TTL,report"`
+	StatsInterval time.Duration `env:"STATS_INTERVAL,report"`
+
+	// LocalEvaluation evaluates queries in the service using Log Cache's
+	// read API instead of its PromQL endpoint.
+	LocalEvaluation bool `env:"LOCAL_EVALUATION,report"`
+
+	// EnvelopeLimit is the page size for Log Cache reads and MaxPages how
+	// many pages are read per selector before the result is truncated.
+	EnvelopeLimit int `env:"ENVELOPE_LIMIT,report"`
+	MaxPages      int `env:"MAX_PAGES,report"`
+
+	// LogPatterns is a JSON list of regexes. Their named groups become
+	// labels of log_lines_total (e.g., ["\\s(?P<status>\\d{3})\\s"]).
+	// log_lines_total and events_total only exist with LocalEvaluation:
+	// Log Cache's PromQL endpoint does not count logs or events.
+	LogPatterns logPatterns `env:"LOG_PATTERNS,report"`
+
+	// TimerBuckets is a JSON list of the upper bounds (in seconds) of the
+	// histograms built from timers (e.g., [0.1, 0.5, 1]). The bounds must
+	// be positive and unique. Note that a timer's own series is its
+	// duration in nanoseconds while its _sum series is in seconds.
+	TimerBuckets timerBuckets `env:"TIMER_BUCKETS,report"`
+
+	// LogBatchSize is how many envelopes are read (and at most delivered)
+	// at a time for logs events.
+	LogBatchSize int `env:"LOG_BATCH_SIZE,report"`
+
+	// QueryTimeout is used for queries that don't set their own timeout.
+	QueryTimeout time.Duration `env:"QUERY_TIMEOUT,report"`
+
+	CAPITimeout time.Duration `env:"CAPI_TIMEOUT,report"`
+
+	// PostTimeout is how long a function has to handle a query result (or
+	// the lines, audit events or source changes of an event).
+	PostTimeout time.Duration `env:"POST_TIMEOUT,report"`
+
+	// GuidTTL is how long an app name resolves to the same GUID.
+	// GuidNegativeTTL is how long an unknown app name stays unknown.
+	GuidTTL         time.Duration `env:"GUID_TTL,report"`
+	GuidNegativeTTL time.Duration `env:"GUID_NEGATIVE_TTL,report"`
+
+	// Results are delivered with app_name (or service_instance_name)
+	// labels. The other labels are opt-in. NameTTL is how long a source ID
+	// keeps the same names and NameCacheSize is how many source IDs are
+	// remembered.
+	EnrichSpaceName     bool          `env:"ENRICH_SPACE_NAME,report"`
+	EnrichOrgName       bool          `env:"ENRICH_ORG_NAME,report"`
+	EnrichInstanceIndex bool          `env:"ENRICH_INSTANCE_INDEX,report"`
+	NameTTL             time.Duration `env:"NAME_TTL,report"`
+	NameCacheSize       int           `env:"NAME_CACHE_SIZE,report"`
+
+	// AllowedSpaces (GUIDs) defaults to the service's own space.
+	// AllowedSources are source IDs (names or GUIDs) that may be read
+	// regardless of their space (e.g., platform components). Their names
+	// are not resolved to GUIDs.
+	AllowedSpaces  []string `env:"ALLOWED_SPACES,report"`
+	AllowedSources []string `env:"ALLOWED_SOURCES,report"`
+
+	// Checkpoints are saved by the service itself so that the ticks missed
+	// during a restart can be backfilled (up to MaxBackfill).
+	Checkpoints        state.Checkpoints `env:"CHECKPOINTS"`
+	CheckpointInterval time.Duration     `env:"CHECKPOINT_INTERVAL,report"`
+	MaxBackfill        time.Duration     `env:"MAX_BACKFILL,report"`
+
+	// BackfillConcurrency is how many readers are backfilled at a time.
+	BackfillConcurrency int `env:"BACKFILL_CONCURRENCY,report"`
+
 	SkipSSLValidation bool `env:"SKIP_SSL_VALIDATION, report"`
+
+	// CACerts (a PEM bundle) and CAFile are trusted along with the system's
+	// CAs. ClientCertFile and ClientKeyFile are used for mTLS. The files are
+	// reloaded when they change.
+	CACerts           string        `env:"CA_CERTS"`
+	CAFile            string        `env:"CA_FILE,report"`
+	ClientCertFile    string        `env:"CLIENT_CERT_FILE,report"`
+	ClientKeyFile     string        `env:"CLIENT_KEY_FILE,report"`
+	TLSReloadInterval time.Duration `env:"TLS_RELOAD_INTERVAL,report"`
+
+	// LogCacheAddr and UAAAddr override the addresses discovered from the
+	// CAPI root.
+	LogCacheAddr string `env:"LOG_CACHE_ADDR,report"`
+	UAAAddr      string `env:"UAA_ADDR,report"`
+
+	// RefreshToken, ClientID and ClientSecret are used to get tokens from
+	// UAA (see UAAAddr) for CAPI, Log Cache and CF-FaaS.
+	RefreshToken string `env:"REFRESH_TOKEN,required"`
+	ClientID     string `env:"CLIENT_ID,required,report"`
+	ClientSecret string `env:"CLIENT_SECRET"`
 }
 
 type vcapApplication struct {
 	CAPIAddr      string `json:"cf_api"`
-	LogCacheAddr  string // Inferred from CAPIAddr
 	ApplicationID string `json:"application_id"`
 	SpaceID       string `json:"space_id"`
 }
 
 func (a *vcapApplication) UnmarshalEnv(data string) error {
-	if err := json.Unmarshal([]byte(data), a); err != nil {
-		return err
-	}
-
-	a.CAPIAddr = strings.Replace(a.CAPIAddr, "https", "http", 1)
-	a.LogCacheAddr = strings.Replace(a.CAPIAddr, "api", "log-cache", 1)
-	return nil
+	return json.Unmarshal([]byte(data), a)
 }
 
 type Queries struct {
@@ -99,17 +457,129 @@ func (q *Queries) UnmarshalEnv(data string) error {
 	return json.Unmarshal([]byte(data), q)
 }
 
+type logPatterns []*regexp.Regexp
+
+func (p *logPatterns) UnmarshalEnv(data string) error {
+	if data == "" {
+		return nil
+	}
+
+	var patterns []string
+	if err := json.Unmarshal([]byte(data), &patterns); err != nil {
+		return err
+	}
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("failed to compile log pattern %q: %s", pattern, err)
+		}
+		*p = append(*p, re)
+	}
+
+	return nil
+}
+
+type timerBuckets []float64
+
+func (b *timerBuckets) UnmarshalEnv(data string) error {
+	if data == "" {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(data), (*[]float64)(b)); err != nil {
+		return fmt.Errorf("failed to parse timer buckets: %s", err)
+	}
+
+	seen := make(map[float64]bool)
+	for _, bound := range *b {
+		if math.IsNaN(bound) || bound <= 0 {
+			return fmt.Errorf("invalid timer bucket %v: upper bounds must be positive", bound)
+		}
+
+		if seen[bound] {
+			return fmt.Errorf("invalid timer bucket %v: upper bounds must be unique", bound)
+		}
+		seen[bound] = true
+	}
+
+	return nil
+}
+
+// resolveEndpoints uses the configured addresses and discovers the rest
+// from CAPI. It exits if an address can't be found either way.
+func resolveEndpoints(cfg config, d discovery.Doer, log *log.Logger) discovery.Endpoints {
+	endpoints := discovery.Endpoints{
+		LogCache: cfg.LogCacheAddr,
+		UAA:      cfg.UAAAddr,
+	}
+
+	if endpoints.LogCache != "" && endpoints.UAA != "" {
+		return endpoints
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CAPITimeout)
+	defer cancel()
+
+	discovered, err := discovery.NewDiscoverer(cfg.VcapApplication.CAPIAddr, d).Endpoints(ctx)
+	if err != nil {
+		log.Printf("failed to discover endpoints from CAPI (%s): %s", cfg.VcapApplication.CAPIAddr, err)
+	}
+
+	if endpoints.LogCache == "" {
+		endpoints.LogCache = discovered.LogCache
+	}
+
+	if endpoints.UAA == "" {
+		endpoints.UAA = discovered.UAA
+	}
+
+	if endpoints.LogCache == "" {
+		log.Fatalf("unable to find Log Cache: CAPI (%s) did not advertise it and LOG_CACHE_ADDR is not set", cfg.VcapApplication.CAPIAddr)
+	}
+
+	if endpoints.UAA == "" {
+		log.Fatalf("unable to find UAA: CAPI (%s) did not advertise it and UAA_ADDR is not set", cfg.VcapApplication.CAPIAddr)
+	}
+
+	log.Printf("using Log Cache at %s and UAA at %s", endpoints.LogCache, endpoints.UAA)
+	return endpoints
+}
+
 func loadConfig(log *log.Logger) config {
 	cfg := config{
-		Interval: time.Second,
+		Interval:      time.Second,
+		StatsInterval: time.Minute,
+		QueryTimeout:  promql.DefaultTimeout,
+		PostTimeout:   promql.DefaultPostTimeout,
+		CAPITimeout:   5 * time.Second,
+
+		EnvelopeLimit: 1000,
+		MaxPages:      10,
+		LogBatchSize:  100,
+
+		GuidTTL:         5 * time.Minute,
+		GuidNegativeTTL: 30 * time.Second,
+		NameTTL:         5 * time.Minute,
+		NameCacheSize:   10000,
+
+		CheckpointInterval:  time.Minute,
+		MaxBackfill:         15 * time.Minute,
+		BackfillConcurrency: 4,
+		TLSReloadInterval:   time.Minute,
 	}
 
 	if err := envstruct.Load(&cfg); err != nil {
 		log.Fatalf("failed to load config: %s", err)
 	}
 
-	// Use HTTP so we can use HTTP_PROXY
-	cfg.VcapApplication.CAPIAddr = strings.Replace(cfg.VcapApplication.CAPIAddr, "https", "http", 1)
+	if cfg.BackfillConcurrency < 1 {
+		log.Fatalf("BACKFILL_CONCURRENCY must be at least 1")
+	}
+
+	if cfg.NameCacheSize < 1 {
+		log.Fatalf("NAME_CACHE_SIZE must be at least 1")
+	}
 
 	envstruct.WriteReport(&cfg)
 	return cfg
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+func TestTimerBuckets(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Spec("it parses a JSON list of upper bounds", func(t *testing.T) {
+		var b timerBuckets
+		err := b.UnmarshalEnv(`[0.1, 0.5, 1]`)
+		Expect(t, err).To(BeNil())
+		Expect(t, b).To(Equal(timerBuckets{0.1, 0.5, 1}))
+	})
+
+	o.Spec("it leaves the buckets empty if unset", func(t *testing.T) {
+		var b timerBuckets
+		err := b.UnmarshalEnv("")
+		Expect(t, err).To(BeNil())
+		Expect(t, b).To(HaveLen(0))
+	})
+
+	o.Spec("it rejects invalid upper bounds", func(t *testing.T) {
+		for _, data := range []string{
+			`[0.1, "NaN"]`,
+			`[0.1, 0]`,
+			`[-1, 0.1]`,
+			`[0.1, 0.5, 0.1]`,
+			`invalid`,
+		} {
+			var b timerBuckets
+			err := b.UnmarshalEnv(data)
+			Expect(t, err).To(Not(BeNil()))
+		}
+	})
+}
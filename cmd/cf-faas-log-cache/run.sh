@@ -2,6 +2,9 @@
 
 set -e
 
+# The reverse-proxy authenticates every inbound request before it reaches
+# cf-faas-log-cache. It (and only it) uses the proxy for its own calls to
+# CAPI. cf-faas-log-cache gets its own UAA tokens for outbound requests.
 PORT=9999 PROXY_HEALTH_PORT=10000 ./proxy &
 echo $! > /tmp/pids
 sleep 2
@@ -9,7 +12,7 @@ sleep 2
 HTTP_PROXY=localhost:9999 BACKEND_PORT=10001 ./reverse-proxy &
 echo $! >> /tmp/pids
 
-HTTP_PROXY=localhost:9999 TOKEN_PORT=10000 PORT=10001 ./cf-faas-log-cache &
+PORT=10001 ./cf-faas-log-cache &
 echo $! >> /tmp/pids
 
 # Close everything, otherwise the container won't be reset
@@ -0,0 +1,201 @@
+package access
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/poy/cf-faas-log-cache/internal/capi"
+	"github.com/poy/cf-faas-log-cache/pkg/promql"
+)
+
+// Authorizer decides whether a query may read the sources it names. The
+// service reads Log Cache with its own credentials, so without it any
+// function could read the metrics of any source the service can see.
+//
+// A source is allowed if it (by name or GUID) is on the allow-list or if it
+// belongs to one of the allowed spaces.
+type Authorizer struct {
+	f      promql.GuidFetcher
+	n      SourceNamer
+	spaces map[string]bool
+	allow  map[string]bool
+}
+
+// SourceNamer looks up the names (and space) for a source ID (e.g.,
+// capi.SourceNamer).
+type SourceNamer interface {
+	Names(ctx context.Context, sourceID string) (capi.SourceNames, error)
+}
+
+// Error is returned for a query that reads a source that is not allowed.
+// Any other error means that access could not be checked (e.g., CAPI
+// timing out).
+type Error struct {
+	SourceID string
+	Reason   string
+}
+
+func (e *Error) Error() string {
+	if e.SourceID == "" {
+		return fmt.Sprintf("access denied: %s", e.Reason)
+	}
+
+	return fmt.Sprintf("access to source_id %q denied: %s", e.SourceID, e.Reason)
+}
+
+// Denied distinguishes the error from those that may be transient.
+func (e *Error) Denied() bool {
+	return true
+}
+
+func NewAuthorizer(
+	f promql.GuidFetcher,
+	n SourceNamer,
+	spaceGuids []string,
+	allowList []string,
+) *Authorizer {
+	a := &Authorizer{
+		f:      f,
+		n:      n,
+		spaces: make(map[string]bool),
+		allow:  make(map[string]bool),
+	}
+
+	for _, s := range spaceGuids {
+		a.spaces[s] = true
+	}
+
+	for _, s := range allowList {
+		a.allow[s] = true
+	}
+
+	return a
+}
+
+// Authorize returns an *Error if the query reads a source that is not
+// allowed (or can not be parsed). Sources that can not be resolved are not
+// allowed. It returns any other error if a source could not be checked.
+func (a *Authorizer) Authorize(ctx context.Context, query string) error {
+	analysis, err := promql.Analyze(query)
+	if err != nil {
+		return &Error{Reason: fmt.Sprintf("failed to parse PromQL query %s: %s", query, err)}
+	}
+
+	for _, s := range analysis.Selectors {
+		sourceIDs, err := selectedSourceIDs(s)
+		if err != nil {
+			return err
+		}
+
+		for _, sourceID := range sourceIDs {
+			if err := a.AuthorizeSource(ctx, sourceID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// selectedSourceIDs returns the source IDs the selector's source_id
+// matchers name. Every source_id matcher of the selector is checked since
+// any of them could be the one that selects the series. Only matchers that
+// name every source ID (source_id="a" or source_id=~"a|b") can be
+// authorized. Any other matcher (e.g., source_id!="a") reads sources that
+// are not named in the query.
+func selectedSourceIDs(s promql.Selector) ([]string, error) {
+	var sourceIDs []string
+	for _, m := range s.Matchers {
+		if m.Name != "source_id" {
+			continue
+		}
+
+		if m.Value == "" {
+			return nil, &Error{Reason: fmt.Sprintf("Metric '%s' does not have a 'source_id' label.", s.MetricName)}
+		}
+
+		named, err := namedSourceIDs(m)
+		if err != nil {
+			return nil, err
+		}
+		sourceIDs = append(sourceIDs, named...)
+	}
+
+	if len(sourceIDs) == 0 {
+		return nil, &Error{Reason: fmt.Sprintf("Metric '%s' does not have a 'source_id' label.", s.MetricName)}
+	}
+
+	return sourceIDs, nil
+}
+
+// namedSourceIDs returns the source IDs a source_id matcher names.
+func namedSourceIDs(m promql.Matcher) ([]string, error) {
+	switch m.Type {
+	case promql.MatchEqual:
+		return []string{m.Value}, nil
+	case promql.MatchRegexp:
+		sourceIDs := strings.Split(m.Value, "|")
+		for _, sourceID := range sourceIDs {
+			if sourceID == "" || regexp.QuoteMeta(sourceID) != sourceID {
+				return nil, &Error{
+					SourceID: m.Value,
+					Reason:   "source_id=~ may only list source IDs (e.g., source_id=~\"a|b\")",
+				}
+			}
+		}
+		return sourceIDs, nil
+	default:
+		return nil, &Error{
+			SourceID: m.Value,
+			Reason:   fmt.Sprintf("source_id%s reads sources that are not named", m.Type),
+		}
+	}
+}
+
+// AuthorizeSource returns an *Error if the source (a name or GUID) is not
+// allowed or does not exist. It returns any other error if the source could
+// not be checked.
+func (a *Authorizer) AuthorizeSource(ctx context.Context, sourceID string) error {
+	if a.allow[sourceID] {
+		return nil
+	}
+
+	guid := sourceID
+	if !promql.IsGuid(sourceID) {
+		var err error
+		guid, err = a.f.GetAppGuid(ctx, sourceID)
+		if err != nil {
+			return a.lookupError(sourceID, err)
+		}
+
+		if a.allow[guid] {
+			return nil
+		}
+	}
+
+	names, err := a.n.Names(ctx, guid)
+	if err != nil {
+		return a.lookupError(sourceID, err)
+	}
+
+	if !a.spaces[names.SpaceGuid] {
+		return &Error{
+			SourceID: sourceID,
+			Reason:   fmt.Sprintf("space %s (%s) is not allowed", names.Space, names.SpaceGuid),
+		}
+	}
+
+	return nil
+}
+
+// lookupError denies a source that does not exist. Other failures are
+// returned as is so that callers can tell them apart from a denial.
+func (a *Authorizer) lookupError(sourceID string, err error) error {
+	if promql.IsNotFound(err) {
+		return &Error{SourceID: sourceID, Reason: err.Error()}
+	}
+
+	return fmt.Errorf("failed to check access to source_id %q: %s", sourceID, err)
+}
@@ -0,0 +1,196 @@
+package access_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/poy/cf-faas-log-cache/internal/access"
+	"github.com/poy/cf-faas-log-cache/internal/capi"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+const otherGuid = "8f6a4c2e-1b3d-4e5f-a6b7-c8d9e0f1a2b3"
+
+type TA struct {
+	*testing.T
+	a              *access.Authorizer
+	spyGuidFetcher *spyGuidFetcher
+	spySourceNamer *spySourceNamer
+}
+
+func TestAuthorizer(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TA {
+		spyGuidFetcher := &spyGuidFetcher{
+			guids: map[string]string{
+				"some-app":  "app-guid",
+				"other-app": otherGuid,
+			},
+		}
+		spySourceNamer := &spySourceNamer{
+			names: map[string]capi.SourceNames{
+				"app-guid": {SpaceGuid: "some-space-guid"},
+				otherGuid:  {Space: "other-space", SpaceGuid: "other-space-guid"},
+			},
+		}
+
+		return TA{
+			T:              t,
+			a:              access.NewAuthorizer(spyGuidFetcher, spySourceNamer, []string{"some-space-guid"}, []string{"gorouter"}),
+			spyGuidFetcher: spyGuidFetcher,
+			spySourceNamer: spySourceNamer,
+		}
+	})
+
+	o.Spec("it allows sources in an allowed space", func(t TA) {
+		err := t.a.Authorize(context.Background(), `metric{source_id="some-app"}`)
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spySourceNamer.sourceIDs).To(Equal([]string{"app-guid"}))
+	})
+
+	o.Spec("it denies sources in other spaces", func(t TA) {
+		err := t.a.Authorize(context.Background(), `metric{source_id="some-app"} + metric{source_id="other-app"}`)
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("other-space"))
+
+		ae, ok := err.(*access.Error)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, ae.SourceID).To(Equal("other-app"))
+	})
+
+	o.Spec("it checks GUIDs without resolving them", func(t TA) {
+		err := t.a.Authorize(context.Background(), `metric{source_id="`+otherGuid+`"}`)
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.spyGuidFetcher.names).To(HaveLen(0))
+	})
+
+	o.Spec("it allows sources on the allow-list", func(t TA) {
+		err := t.a.Authorize(context.Background(), `metric{source_id="gorouter"}`)
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyGuidFetcher.names).To(HaveLen(0))
+	})
+
+	o.Spec("it allows GUIDs on the allow-list", func(t TA) {
+		t.a = access.NewAuthorizer(t.spyGuidFetcher, t.spySourceNamer, nil, []string{otherGuid})
+		err := t.a.Authorize(context.Background(), `metric{source_id="other-app"}`)
+		Expect(t, err).To(BeNil())
+	})
+
+	o.Spec("it denies sources that can't be resolved", func(t TA) {
+		t.spyGuidFetcher.err = errors.New("some-error")
+		err := t.a.Authorize(context.Background(), `metric{source_id="some-app"}`)
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("some-error"))
+	})
+
+	o.Spec("it denies sources that can't be named", func(t TA) {
+		t.spySourceNamer.err = errors.New("some-error")
+		err := t.a.Authorize(context.Background(), `metric{source_id="some-app"}`)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it only reports sources that don't exist as denied", func(t TA) {
+		t.spyGuidFetcher.err = &capi.NotFoundError{Msg: "some-error"}
+		err := t.a.AuthorizeSource(context.Background(), "some-app")
+		_, ok := err.(*access.Error)
+		Expect(t, ok).To(BeTrue())
+
+		t.spyGuidFetcher.err = nil
+		t.spySourceNamer.err = &capi.NotFoundError{Msg: "some-error"}
+		err = t.a.AuthorizeSource(context.Background(), "some-app")
+		_, ok = err.(*access.Error)
+		Expect(t, ok).To(BeTrue())
+
+		t.spySourceNamer.err = errors.New("some-error")
+		err = t.a.AuthorizeSource(context.Background(), "some-app")
+		Expect(t, err).To(Not(BeNil()))
+		_, ok = err.(*access.Error)
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("it denies negative source_id matchers", func(t TA) {
+		for _, query := range []string{
+			`metric{source_id!="other-app"}`,
+			`metric{source_id!~"other-app"}`,
+		} {
+			err := t.a.Authorize(context.Background(), query)
+			Expect(t, err).To(Not(BeNil()))
+
+			_, ok := err.(*access.Error)
+			Expect(t, ok).To(BeTrue())
+		}
+		Expect(t, t.spySourceNamer.sourceIDs).To(HaveLen(0))
+	})
+
+	o.Spec("it checks every source_id matcher of a selector", func(t TA) {
+		err := t.a.Authorize(context.Background(), `cpu{source_id="some-app", source_id=~".+"}`)
+		Expect(t, err).To(Not(BeNil()))
+		_, ok := err.(*access.Error)
+		Expect(t, ok).To(BeTrue())
+
+		err = t.a.Authorize(context.Background(), `cpu{source_id="some-app", source_id="other-app"}`)
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("other-space"))
+	})
+
+	o.Spec("it denies source_id regexes that are not a list", func(t TA) {
+		for _, query := range []string{
+			`metric{source_id=~"some-.*"}`,
+			`metric{source_id=~"some-app|"}`,
+		} {
+			err := t.a.Authorize(context.Background(), query)
+			Expect(t, err).To(Not(BeNil()))
+		}
+	})
+
+	o.Spec("it authorizes each source of a source_id list", func(t TA) {
+		err := t.a.Authorize(context.Background(), `metric{source_id=~"some-app|gorouter"}`)
+		Expect(t, err).To(BeNil())
+
+		err = t.a.Authorize(context.Background(), `metric{source_id=~"some-app|other-app"}`)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it denies an invalid query", func(t TA) {
+		err := t.a.Authorize(context.Background(), `}{`)
+		_, ok := err.(*access.Error)
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("it denies a selector without a source_id", func(t TA) {
+		err := t.a.Authorize(context.Background(), `metric`)
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("does not have a 'source_id' label"))
+
+		_, ok := err.(*access.Error)
+		Expect(t, ok).To(BeTrue())
+	})
+}
+
+type spyGuidFetcher struct {
+	names []string
+	guids map[string]string
+	err   error
+}
+
+func (s *spyGuidFetcher) GetAppGuid(ctx context.Context, name string) (string, error) {
+	s.names = append(s.names, name)
+	return s.guids[name], s.err
+}
+
+type spySourceNamer struct {
+	sourceIDs []string
+	names     map[string]capi.SourceNames
+	err       error
+}
+
+func (s *spySourceNamer) Names(ctx context.Context, sourceID string) (capi.SourceNames, error) {
+	s.sourceIDs = append(s.sourceIDs, sourceID)
+	return s.names[sourceID], s.err
+}
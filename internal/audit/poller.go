@@ -0,0 +1,194 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/internal/delivery"
+	"github.com/poy/cf-faas-log-cache/internal/web"
+)
+
+// Poller delivers the CAPI audit events of an audit_events event. Each
+// Tick lists the events that were created since the previous one and POSTs
+// each of them that targets the event's target_name (if it has one).
+type Poller struct {
+	q   web.Query
+	l   EventLister
+	d   Doer
+	log *log.Logger
+	cp  Checkpointer
+
+	maxBacklog  time.Duration
+	postTimeout time.Duration
+
+	// cursor is when the last handled event was created and seen has the
+	// GUIDs of the handled events that were created then. An event is
+	// handled once it is delivered or filtered out. CAPI's timestamps only
+	// have seconds, so several events can share one. A nil seen means every
+	// event at the cursor was handled (e.g., after a restart).
+	cursor time.Time
+	seen   map[string]bool
+
+	timeouts uint64
+}
+
+// DefaultTimeout is used for audit_events events that don't set their own
+// timeout.
+const DefaultTimeout = 5 * time.Second
+
+// DefaultPostTimeout is how long a function has to handle an audit event.
+const DefaultPostTimeout = 30 * time.Second
+
+// EventLister lists audit events (e.g., capi.AuditEventLister).
+type EventLister interface {
+	List(ctx context.Context, types []string, since time.Time) ([]faaspromql.AuditEvent, error)
+}
+
+// Checkpointer records the cursor so polling resumes where it left off
+// after a restart.
+type Checkpointer interface {
+	Record(id string, t time.Time)
+	Last(id string) (time.Time, bool)
+}
+
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// PollerOption configures a Poller.
+type PollerOption func(*Poller)
+
+// WithCheckpointer saves the cursor after each delivered event. A Poller
+// starts from the saved cursor (see WithMaxBacklog).
+func WithCheckpointer(cp Checkpointer) PollerOption {
+	return func(p *Poller) {
+		p.cp = cp
+	}
+}
+
+// WithMaxBacklog sets how far back the cursor may be (e.g., after a restart
+// or while the function fails). Older events are skipped. Defaults to 10
+// minutes.
+func WithMaxBacklog(d time.Duration) PollerOption {
+	return func(p *Poller) {
+		p.maxBacklog = d
+	}
+}
+
+// WithPostTimeout sets how long a function has to handle an audit event.
+// The POST has its own deadline, so a slow listing does not cut it short.
+// Defaults to DefaultPostTimeout.
+func WithPostTimeout(d time.Duration) PollerOption {
+	return func(p *Poller) {
+		p.postTimeout = d
+	}
+}
+
+// NewPoller returns a Poller for the audit_events event q (q.AuditEvents
+// must be set). Without a saved cursor, it starts with the events that are
+// created after it was.
+func NewPoller(q web.Query, l EventLister, d Doer, log *log.Logger, opts ...PollerOption) *Poller {
+	p := &Poller{
+		q:           q,
+		l:           l,
+		d:           d,
+		log:         log,
+		maxBacklog:  10 * time.Minute,
+		postTimeout: DefaultPostTimeout,
+	}
+
+	for _, o := range opts {
+		o(p)
+	}
+
+	p.cursor = time.Now()
+	if p.cp != nil {
+		if last, ok := p.cp.Last(q.ID()); ok {
+			p.cursor = last
+		}
+	}
+
+	return p
+}
+
+func (p *Poller) Tick() {
+	d := p.q.Timeout
+	if d == 0 {
+		d = DefaultTimeout
+	}
+
+	if oldest := time.Now().Add(-p.maxBacklog); p.cursor.Before(oldest) {
+		p.cursor = oldest
+		p.seen = map[string]bool{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	events, err := p.l.List(ctx, p.q.AuditEvents.Types, p.cursor)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&p.timeouts, 1)
+		}
+		p.log.Printf("failed to list audit events: %s", err)
+		return
+	}
+
+	for _, e := range events {
+		if e.CreatedAt.Before(p.cursor) {
+			continue
+		}
+
+		if e.CreatedAt.Equal(p.cursor) && (p.seen == nil || p.seen[e.Guid]) {
+			continue
+		}
+
+		targetName := p.q.AuditEvents.TargetName
+		if (targetName == "" || e.Target.Name == targetName) && !p.post(e) {
+			// The rest is delivered by the next tick.
+			return
+		}
+
+		if e.CreatedAt.After(p.cursor) {
+			p.cursor = e.CreatedAt
+			p.seen = map[string]bool{}
+		}
+		p.seen[e.Guid] = true
+
+		if p.cp != nil {
+			p.cp.Record(p.q.ID(), p.cursor)
+		}
+	}
+}
+
+// post delivers the event and reports whether the function accepted it.
+func (p *Poller) post(e faaspromql.AuditEvent) bool {
+	e.Context = p.q.Context
+	data, err := json.Marshal(e)
+	if err != nil {
+		p.log.Panicf("failed to marshal audit event: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.postTimeout)
+	defer cancel()
+
+	if err := delivery.Post(ctx, p.d, p.q.Path, data); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&p.timeouts, 1)
+		}
+		p.log.Printf("failed to deliver audit event: %s", err)
+		return false
+	}
+
+	return true
+}
+
+// Timeouts returns the number of ticks that ran out of time.
+func (p *Poller) Timeouts() uint64 {
+	return atomic.LoadUint64(&p.timeouts)
+}
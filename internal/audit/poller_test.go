@@ -0,0 +1,270 @@
+package audit_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/internal/audit"
+	"github.com/poy/cf-faas-log-cache/internal/web"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TP struct {
+	*testing.T
+	q               web.Query
+	spyEventLister  *spyEventLister
+	spyDoer         *spyDoer
+	spyCheckpointer *spyCheckpointer
+	start           time.Time
+}
+
+func TestPoller(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TP {
+		return TP{
+			T: t,
+			q: web.Query{
+				Path:    "http://some.url/some-path",
+				Context: "some-context",
+				AuditEvents: &web.AuditEventFilter{
+					Types:      []string{"audit.app.process.crash"},
+					TargetName: "some-app",
+				},
+			},
+			spyEventLister:  &spyEventLister{},
+			spyDoer:         &spyDoer{status: http.StatusOK},
+			spyCheckpointer: newSpyCheckpointer(),
+			start:           time.Now(),
+		}
+	})
+
+	o.Spec("it POSTs each new event", func(t TP) {
+		p := t.newPoller(audit.WithCheckpointer(t.spyCheckpointer))
+		later := t.start.Add(time.Second).Truncate(time.Second)
+		t.spyEventLister.events = []faaspromql.AuditEvent{
+			{Guid: "old-guid", CreatedAt: t.start.Add(-time.Second), Target: faaspromql.AuditEventActor{Name: "some-app"}},
+			{Guid: "some-guid", Type: "audit.app.process.crash", CreatedAt: later, Target: faaspromql.AuditEventActor{Name: "some-app"}},
+			{Guid: "other-guid", Type: "audit.app.process.crash", CreatedAt: later, Target: faaspromql.AuditEventActor{Name: "some-app"}},
+		}
+
+		p.Tick()
+
+		Expect(t, t.spyEventLister.types).To(Equal([]string{"audit.app.process.crash"}))
+		Expect(t, t.spyEventLister.since.Before(t.start)).To(BeFalse())
+
+		Expect(t, t.spyDoer.urls).To(Equal([]string{"http://some.url/some-path", "http://some.url/some-path"}))
+		Expect(t, t.spyDoer.events).To(HaveLen(2))
+		Expect(t, t.spyDoer.events[0].Guid).To(Equal("some-guid"))
+		Expect(t, t.spyDoer.events[0].Context).To(Equal("some-context"))
+		Expect(t, t.spyDoer.events[1].Guid).To(Equal("other-guid"))
+
+		last, ok := t.spyCheckpointer.Last(t.q.ID())
+		Expect(t, ok).To(BeTrue())
+		Expect(t, last).To(Equal(later))
+	})
+
+	o.Spec("it does not POST an event twice", func(t TP) {
+		p := t.newPoller()
+		later := t.start.Add(time.Second).Truncate(time.Second)
+		t.spyEventLister.events = []faaspromql.AuditEvent{
+			{Guid: "some-guid", CreatedAt: later, Target: faaspromql.AuditEventActor{Name: "some-app"}},
+		}
+		p.Tick()
+
+		t.spyEventLister.events = []faaspromql.AuditEvent{
+			{Guid: "some-guid", CreatedAt: later, Target: faaspromql.AuditEventActor{Name: "some-app"}},
+			{Guid: "other-guid", CreatedAt: later, Target: faaspromql.AuditEventActor{Name: "some-app"}},
+		}
+		p.Tick()
+
+		Expect(t, t.spyEventLister.since).To(Equal(later))
+		Expect(t, t.spyDoer.events).To(HaveLen(2))
+		Expect(t, t.spyDoer.events[1].Guid).To(Equal("other-guid"))
+	})
+
+	o.Spec("it POSTs the event again if the POST fails", func(t TP) {
+		p := t.newPoller()
+		later := t.start.Add(time.Second)
+		t.spyEventLister.events = []faaspromql.AuditEvent{
+			{Guid: "some-guid", CreatedAt: later, Target: faaspromql.AuditEventActor{Name: "some-app"}},
+			{Guid: "other-guid", CreatedAt: later.Add(time.Second), Target: faaspromql.AuditEventActor{Name: "some-app"}},
+		}
+
+		t.spyDoer.status = http.StatusInternalServerError
+		p.Tick()
+		Expect(t, t.spyDoer.attempts).To(Equal(1))
+
+		t.spyDoer.status = http.StatusOK
+		p.Tick()
+
+		Expect(t, t.spyDoer.events).To(HaveLen(2))
+		Expect(t, t.spyDoer.events[0].Guid).To(Equal("some-guid"))
+	})
+
+	o.Spec("it gives the POST its own timeout", func(t TP) {
+		t.q.Timeout = time.Millisecond
+		p := t.newPoller(audit.WithPostTimeout(time.Hour))
+		t.spyEventLister.events = []faaspromql.AuditEvent{
+			{Guid: "some-guid", CreatedAt: t.start.Add(time.Second), Target: faaspromql.AuditEventActor{Name: "some-app"}},
+		}
+
+		p.Tick()
+
+		Expect(t, t.spyDoer.events).To(HaveLen(1))
+		deadline, ok := t.spyDoer.ctx.Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, deadline.After(time.Now().Add(time.Minute))).To(BeTrue())
+	})
+
+	o.Spec("it resumes from the saved cursor", func(t TP) {
+		saved := t.start.Add(-time.Minute)
+		t.spyCheckpointer.Record(t.q.ID(), saved)
+		t.spyEventLister.events = []faaspromql.AuditEvent{
+			{Guid: "some-guid", CreatedAt: saved, Target: faaspromql.AuditEventActor{Name: "some-app"}},
+			{Guid: "other-guid", CreatedAt: saved.Add(time.Second), Target: faaspromql.AuditEventActor{Name: "some-app"}},
+		}
+
+		t.newPoller(audit.WithCheckpointer(t.spyCheckpointer)).Tick()
+
+		Expect(t, t.spyEventLister.since).To(Equal(saved))
+		Expect(t, t.spyDoer.events).To(HaveLen(1))
+		Expect(t, t.spyDoer.events[0].Guid).To(Equal("other-guid"))
+	})
+
+	o.Spec("it does not go further back than the max backlog", func(t TP) {
+		t.spyCheckpointer.Record(t.q.ID(), t.start.Add(-time.Hour))
+
+		t.newPoller(audit.WithCheckpointer(t.spyCheckpointer), audit.WithMaxBacklog(time.Minute)).Tick()
+
+		Expect(t, t.spyEventLister.since.After(t.start.Add(-time.Minute))).To(BeTrue())
+	})
+
+	o.Spec("it applies the max backlog on each tick", func(t TP) {
+		p := t.newPoller(audit.WithMaxBacklog(50 * time.Millisecond))
+		p.Tick()
+		first := t.spyEventLister.since
+
+		time.Sleep(100 * time.Millisecond)
+		p.Tick()
+
+		Expect(t, t.spyEventLister.since.After(first)).To(BeTrue())
+	})
+
+	o.Spec("it only POSTs the events of the target", func(t TP) {
+		p := t.newPoller()
+		later := t.start.Add(time.Second)
+		t.spyEventLister.events = []faaspromql.AuditEvent{
+			{Guid: "some-guid", CreatedAt: later, Target: faaspromql.AuditEventActor{Name: "some-app"}},
+			{Guid: "other-guid", CreatedAt: later, Target: faaspromql.AuditEventActor{Name: "other-app"}},
+		}
+
+		p.Tick()
+
+		Expect(t, t.spyDoer.events).To(HaveLen(1))
+		Expect(t, t.spyDoer.events[0].Guid).To(Equal("some-guid"))
+	})
+
+	o.Spec("it advances past the events of other targets", func(t TP) {
+		p := t.newPoller(audit.WithCheckpointer(t.spyCheckpointer))
+		later := t.start.Add(time.Minute)
+		t.spyEventLister.events = []faaspromql.AuditEvent{
+			{Guid: "some-guid", CreatedAt: t.start.Add(time.Second), Target: faaspromql.AuditEventActor{Name: "some-app"}},
+			{Guid: "other-guid", CreatedAt: later, Target: faaspromql.AuditEventActor{Name: "other-app"}},
+		}
+		p.Tick()
+
+		p.Tick()
+
+		Expect(t, t.spyEventLister.since).To(Equal(later))
+		Expect(t, t.spyDoer.events).To(HaveLen(1))
+
+		last, ok := t.spyCheckpointer.Last(t.q.ID())
+		Expect(t, ok).To(BeTrue())
+		Expect(t, last).To(Equal(later))
+	})
+
+	o.Spec("it does not POST if listing fails", func(t TP) {
+		t.spyEventLister.err = errors.New("some-error")
+
+		t.newPoller().Tick()
+
+		Expect(t, t.spyDoer.attempts).To(Equal(0))
+	})
+}
+
+func (t TP) newPoller(opts ...audit.PollerOption) *audit.Poller {
+	return audit.NewPoller(t.q, t.spyEventLister, t.spyDoer, log.New(ioutil.Discard, "", 0), opts...)
+}
+
+type spyEventLister struct {
+	types  []string
+	since  time.Time
+	events []faaspromql.AuditEvent
+	err    error
+}
+
+func (s *spyEventLister) List(ctx context.Context, types []string, since time.Time) ([]faaspromql.AuditEvent, error) {
+	s.types = types
+	s.since = since
+	return s.events, s.err
+}
+
+type spyDoer struct {
+	urls     []string
+	events   []faaspromql.AuditEvent
+	attempts int
+	status   int
+	ctx      context.Context
+}
+
+func (s *spyDoer) Do(req *http.Request) (*http.Response, error) {
+	s.attempts++
+	s.ctx = req.Context()
+
+	var e faaspromql.AuditEvent
+	if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+		panic(err)
+	}
+
+	if s.status == http.StatusOK {
+		s.urls = append(s.urls, req.URL.String())
+		s.events = append(s.events, e)
+	}
+
+	return &http.Response{
+		StatusCode: s.status,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}, nil
+}
+
+type spyCheckpointer struct {
+	last map[string]time.Time
+}
+
+func newSpyCheckpointer() *spyCheckpointer {
+	return &spyCheckpointer{
+		last: make(map[string]time.Time),
+	}
+}
+
+func (s *spyCheckpointer) Record(id string, t time.Time) {
+	s.last[id] = t
+}
+
+func (s *spyCheckpointer) Last(id string) (time.Time, bool) {
+	t, ok := s.last[id]
+	return t, ok
+}
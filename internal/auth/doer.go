@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// TokenDoer adds an Authorization header to each request.
+type TokenDoer struct {
+	ts Tokener
+	d  Doer
+}
+
+type Tokener interface {
+	Token(ctx context.Context) (string, error)
+}
+
+func NewTokenDoer(ts Tokener, d Doer) *TokenDoer {
+	return &TokenDoer{
+		ts: ts,
+		d:  d,
+	}
+}
+
+func (d *TokenDoer) Do(req *http.Request) (*http.Response, error) {
+	token, err := d.ts.Token(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %s", err)
+	}
+
+	// Don't modify the caller's request.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", token)
+
+	return d.d.Do(r)
+}
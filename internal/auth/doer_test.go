@@ -0,0 +1,80 @@
+package auth_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/poy/cf-faas-log-cache/internal/auth"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TD struct {
+	*testing.T
+	d          *auth.TokenDoer
+	spyDoer    *spyDoer
+	stubTokens *stubTokener
+}
+
+func TestTokenDoer(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TD {
+		spyDoer := newSpyDoer()
+		stubTokens := &stubTokener{token: "bearer some-token"}
+		return TD{
+			T:          t,
+			d:          auth.NewTokenDoer(stubTokens, spyDoer),
+			spyDoer:    spyDoer,
+			stubTokens: stubTokens,
+		}
+	})
+
+	o.Spec("it adds the token to the request", func(t TD) {
+		req, _ := http.NewRequest(http.MethodGet, "https://some.url", nil)
+		req.Header.Set("Accept", "application/json")
+
+		_, err := t.d.Do(req)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
+		Expect(t, t.spyDoer.reqs[0].Header.Get("Authorization")).To(Equal("bearer some-token"))
+		Expect(t, t.spyDoer.reqs[0].Header.Get("Accept")).To(Equal("application/json"))
+
+		// The caller's request is left alone.
+		Expect(t, req.Header.Get("Authorization")).To(Equal(""))
+	})
+
+	o.Spec("it uses the request's context to get the token", func(t TD) {
+		ctx := context.WithValue(context.Background(), "some-key", "some-value")
+		req, _ := http.NewRequest(http.MethodGet, "https://some.url", nil)
+		t.d.Do(req.WithContext(ctx))
+
+		Expect(t, t.stubTokens.ctx).To(Equal(ctx))
+	})
+
+	o.Spec("it returns an error if getting the token fails", func(t TD) {
+		t.stubTokens.err = errors.New("some-error")
+		req, _ := http.NewRequest(http.MethodGet, "https://some.url", nil)
+
+		_, err := t.d.Do(req)
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.spyDoer.reqs).To(HaveLen(0))
+	})
+}
+
+type stubTokener struct {
+	ctx   context.Context
+	token string
+	err   error
+}
+
+func (s *stubTokener) Token(ctx context.Context) (string, error) {
+	s.ctx = ctx
+	return s.token, s.err
+}
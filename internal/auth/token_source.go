@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource gets access tokens from UAA with a refresh token. The token
+// is cached and renewed shortly before it expires.
+type TokenSource struct {
+	addr         string
+	clientID     string
+	clientSecret string
+	d            Doer
+	now          func() time.Time
+
+	mu           sync.Mutex
+	refreshToken string
+	token        string
+	expires      time.Time
+}
+
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// renewBefore is how long before the token expires it is renewed.
+const renewBefore = 30 * time.Second
+
+// NewTokenSource returns a TokenSource for the UAA at addr.
+func NewTokenSource(addr, clientID, clientSecret, refreshToken string, d Doer) *TokenSource {
+	return &TokenSource{
+		addr:         addr,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		refreshToken: refreshToken,
+		d:            d,
+		now:          time.Now,
+	}
+}
+
+// Token returns a valid access token, refreshing it if necessary.
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && s.now().Add(renewBefore).Before(s.expires) {
+		return s.token, nil
+	}
+
+	if err := s.refresh(ctx); err != nil {
+		return "", err
+	}
+
+	return s.token, nil
+}
+
+// refresh gets a new access token. s.mu must be held.
+func (s *TokenSource) refresh(ctx context.Context) error {
+	v := url.Values{}
+	v.Set("grant_type", "refresh_token")
+	v.Set("refresh_token", s.refreshToken)
+
+	req, err := http.NewRequest(http.MethodPost, s.addr+"/oauth/token", strings.NewReader(v.Encode()))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(s.clientID, s.clientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.d.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to refresh token: %s", err)
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d refreshing token: %s", resp.StatusCode, body)
+	}
+
+	var t struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return fmt.Errorf("failed to decode token: %s", err)
+	}
+
+	if t.AccessToken == "" {
+		return fmt.Errorf("UAA did not return an access token")
+	}
+
+	tokenType := t.TokenType
+	if tokenType == "" {
+		tokenType = "bearer"
+	}
+
+	s.token = tokenType + " " + t.AccessToken
+	s.expires = s.now().Add(time.Duration(t.ExpiresIn) * time.Second)
+
+	// UAA may rotate the refresh token.
+	if t.RefreshToken != "" {
+		s.refreshToken = t.RefreshToken
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package auth_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/poy/cf-faas-log-cache/internal/auth"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TT struct {
+	*testing.T
+	s       *auth.TokenSource
+	spyDoer *spyDoer
+}
+
+func TestTokenSource(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TT {
+		spyDoer := newSpyDoer()
+		return TT{
+			T:       t,
+			s:       auth.NewTokenSource("https://uaa.some.url", "some-client", "some-secret", "some-refresh-token", spyDoer),
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it refreshes the token with UAA", func(t TT) {
+		t.spyDoer.body = `{"access_token":"some-token","token_type":"bearer","expires_in":3600}`
+		token, err := t.s.Token(context.Background())
+		Expect(t, err).To(BeNil())
+		Expect(t, token).To(Equal("bearer some-token"))
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
+		req := t.spyDoer.reqs[0]
+		Expect(t, req.Method).To(Equal(http.MethodPost))
+		Expect(t, req.URL.String()).To(Equal("https://uaa.some.url/oauth/token"))
+
+		user, pass, ok := req.BasicAuth()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, user).To(Equal("some-client"))
+		Expect(t, pass).To(Equal("some-secret"))
+
+		Expect(t, req.ParseForm()).To(BeNil())
+		Expect(t, req.PostForm.Get("grant_type")).To(Equal("refresh_token"))
+		Expect(t, req.PostForm.Get("refresh_token")).To(Equal("some-refresh-token"))
+	})
+
+	o.Spec("it caches the token until it is about to expire", func(t TT) {
+		t.spyDoer.body = `{"access_token":"some-token","expires_in":3600}`
+		t.s.Token(context.Background())
+		t.s.Token(context.Background())
+		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
+	})
+
+	o.Spec("it renews the token before it expires", func(t TT) {
+		t.spyDoer.body = `{"access_token":"some-token","expires_in":10}`
+		t.s.Token(context.Background())
+		t.s.Token(context.Background())
+		Expect(t, t.spyDoer.reqs).To(HaveLen(2))
+	})
+
+	o.Spec("it uses the rotated refresh token", func(t TT) {
+		t.spyDoer.body = `{"access_token":"some-token","refresh_token":"new-refresh-token","expires_in":0}`
+		t.s.Token(context.Background())
+		t.s.Token(context.Background())
+
+		Expect(t, t.spyDoer.reqs[1].ParseForm()).To(BeNil())
+		Expect(t, t.spyDoer.reqs[1].PostForm.Get("refresh_token")).To(Equal("new-refresh-token"))
+	})
+
+	o.Spec("it returns an error for a non-200", func(t TT) {
+		t.spyDoer.status = http.StatusUnauthorized
+		_, err := t.s.Token(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TT) {
+		t.spyDoer.err = errors.New("some-error")
+		_, err := t.s.Token(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if there isn't a token", func(t TT) {
+		t.spyDoer.body = `{}`
+		_, err := t.s.Token(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+type spyDoer struct {
+	mu     sync.Mutex
+	reqs   []*http.Request
+	body   string
+	status int
+	err    error
+}
+
+func newSpyDoer() *spyDoer {
+	return &spyDoer{
+		status: http.StatusOK,
+	}
+}
+
+func (s *spyDoer) Do(r *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Keep a copy of the body so the test can read it after the caller is
+	// done with the request.
+	if r.Body != nil {
+		data, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	s.reqs = append(s.reqs, r)
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &http.Response{
+		StatusCode: s.status,
+		Body:       ioutil.NopCloser(strings.NewReader(s.body)),
+	}, nil
+}
@@ -0,0 +1,100 @@
+package capi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache"
+)
+
+// AuditEventLister lists the audit events of a space.
+type AuditEventLister struct {
+	addr      string
+	spaceGuid string
+	d         Doer
+}
+
+func NewAuditEventLister(addr, spaceGuid string, d Doer) *AuditEventLister {
+	return &AuditEventLister{
+		addr:      strings.TrimSuffix(addr, "/"),
+		spaceGuid: spaceGuid,
+		d:         d,
+	}
+}
+
+// List returns the space's audit events of the given types (or of any type)
+// that were created at or after since, oldest first.
+func (l *AuditEventLister) List(ctx context.Context, types []string, since time.Time) ([]faaspromql.AuditEvent, error) {
+	query := url.Values{
+		"space_guids":      {l.spaceGuid},
+		"created_ats[gte]": {since.UTC().Format(time.RFC3339)},
+		"order_by":         {"created_at"},
+		"per_page":         {"100"},
+	}
+	if len(types) > 0 {
+		query.Set("types", strings.Join(types, ","))
+	}
+
+	var events []faaspromql.AuditEvent
+	for u := l.addr + "/v3/audit_events?" + query.Encode(); u != ""; {
+		page, next, err := l.get(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, page...)
+		u = next
+	}
+
+	return events, nil
+}
+
+// get fetches a page of audit events and returns the URL of the next one.
+func (l *AuditEventLister) get(ctx context.Context, u string) ([]faaspromql.AuditEvent, string, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := l.d.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list audit events: %s", err)
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, "", fmt.Errorf("unexpected status code %d listing audit events: %s", resp.StatusCode, body)
+	}
+
+	var page struct {
+		Pagination struct {
+			Next *struct {
+				Href string `json:"href"`
+			} `json:"next"`
+		} `json:"pagination"`
+		Resources []faaspromql.AuditEvent `json:"resources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, "", fmt.Errorf("failed to decode audit events: %s", err)
+	}
+
+	var next string
+	if page.Pagination.Next != nil {
+		next = page.Pagination.Next.Href
+	}
+
+	return page.Resources, next, nil
+}
@@ -0,0 +1,112 @@
+package capi_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/internal/capi"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TA struct {
+	*testing.T
+	l       *capi.AuditEventLister
+	spyDoer *spyDoer
+}
+
+func TestAuditEventLister(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TA {
+		spyDoer := newSpyDoer()
+		return TA{
+			T:       t,
+			l:       capi.NewAuditEventLister("https://api.some.url/", "some-space-guid", spyDoer),
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it lists the space's audit events", func(t TA) {
+		t.spyDoer.bodies["/v3/audit_events"] = `{
+		  "pagination": {"next": {"href": "https://api.some.url/next-page"}},
+		  "resources": [{
+		    "guid": "some-guid",
+		    "type": "audit.app.process.crash",
+		    "created_at": "2018-10-01T12:00:00Z",
+		    "actor": {"guid": "some-app-guid", "type": "process", "name": "web"},
+		    "target": {"guid": "some-app-guid", "type": "app", "name": "some-app"},
+		    "data": {"exit_description": "some-description"}
+		  }]
+		}`
+		t.spyDoer.bodies["/next-page"] = `{
+		  "pagination": {"next": null},
+		  "resources": [{"guid": "other-guid", "target": {"name": "some-app"}}]
+		}`
+
+		since := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+		events, err := t.l.List(context.Background(), []string{"audit.app.process.crash", "audit.app.restage"}, since)
+		Expect(t, err).To(BeNil())
+		Expect(t, events).To(HaveLen(2))
+		Expect(t, events[0]).To(Equal(faaspromql.AuditEvent{
+			Guid:      "some-guid",
+			Type:      "audit.app.process.crash",
+			CreatedAt: since,
+			Actor:     faaspromql.AuditEventActor{Guid: "some-app-guid", Type: "process", Name: "web"},
+			Target:    faaspromql.AuditEventActor{Guid: "some-app-guid", Type: "app", Name: "some-app"},
+			Data:      map[string]interface{}{"exit_description": "some-description"},
+		}))
+		Expect(t, events[1].Guid).To(Equal("other-guid"))
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(2))
+		Expect(t, t.spyDoer.reqs[0].Method).To(Equal(http.MethodGet))
+		Expect(t, t.spyDoer.reqs[0].URL.Host).To(Equal("api.some.url"))
+		query := t.spyDoer.reqs[0].URL.Query()
+		Expect(t, query.Get("space_guids")).To(Equal("some-space-guid"))
+		Expect(t, query.Get("types")).To(Equal("audit.app.process.crash,audit.app.restage"))
+		Expect(t, query.Get("created_ats[gte]")).To(Equal("2018-10-01T12:00:00Z"))
+		Expect(t, query.Get("order_by")).To(Equal("created_at"))
+	})
+
+	o.Spec("it lists events of any type", func(t TA) {
+		t.spyDoer.bodies["/v3/audit_events"] = `{
+		  "resources": [
+		    {"guid": "some-guid", "target": {"name": "some-app"}},
+		    {"guid": "other-guid", "target": {"name": "other-app"}}
+		  ]
+		}`
+
+		events, err := t.l.List(context.Background(), nil, time.Now())
+		Expect(t, err).To(BeNil())
+		Expect(t, events).To(HaveLen(2))
+		Expect(t, t.spyDoer.reqs[0].URL.Query()).To(Not(HaveKey("types")))
+	})
+
+	o.Spec("it returns an error for an unexpected status code", func(t TA) {
+		t.spyDoer.status = http.StatusInternalServerError
+
+		_, err := t.l.List(context.Background(), nil, time.Now())
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for invalid JSON", func(t TA) {
+		t.spyDoer.bodies["/v3/audit_events"] = `invalid`
+
+		_, err := t.l.List(context.Background(), nil, time.Now())
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TA) {
+		t.spyDoer.err = errors.New("some-error")
+
+		_, err := t.l.List(context.Background(), nil, time.Now())
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
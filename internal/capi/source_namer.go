@@ -0,0 +1,225 @@
+package capi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SourceNames are the names of the app or service instance behind a source
+// ID.
+type SourceNames struct {
+	// App is set when the source is an app.
+	App string
+
+	// ServiceInstance is set when the source is a service instance.
+	ServiceInstance string
+
+	Space string
+	Org   string
+
+	// SpaceGuid is the GUID of the space the source belongs to.
+	SpaceGuid string
+}
+
+// SourceNamer is the reverse of SourceResolver: it looks up the names for a
+// source ID. Lookups, including those of unknown source IDs, are cached for
+// the TTL. Other failures are not cached. At most
+// maxEntries source IDs are cached. Expired entries are dropped first when
+// the cache is full.
+type SourceNamer struct {
+	addr       string
+	d          Doer
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]namesEntry
+}
+
+type namesEntry struct {
+	names   SourceNames
+	err     error
+	expires time.Time
+}
+
+func NewSourceNamer(addr string, d Doer, ttl time.Duration, maxEntries int) *SourceNamer {
+	return &SourceNamer{
+		addr:       strings.TrimSuffix(addr, "/"),
+		d:          d,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    make(map[string]namesEntry),
+	}
+}
+
+// Names returns the names for the given source ID. It returns a
+// *NotFoundError if the source ID is neither an app nor a service instance.
+func (n *SourceNamer) Names(ctx context.Context, sourceID string) (SourceNames, error) {
+	n.mu.Lock()
+	e, ok := n.entries[sourceID]
+	n.mu.Unlock()
+
+	if ok && n.now().Before(e.expires) {
+		return e.names, e.err
+	}
+
+	names, err := n.lookup(ctx, sourceID)
+	if _, ok := err.(*NotFoundError); err != nil && !ok {
+		// Don't remember a failure that may be transient (e.g., CAPI
+		// timing out or the caller giving up).
+		return SourceNames{}, err
+	}
+
+	n.mu.Lock()
+	if _, ok := n.entries[sourceID]; !ok && len(n.entries) >= n.maxEntries {
+		n.evict()
+	}
+	n.entries[sourceID] = namesEntry{
+		names:   names,
+		err:     err,
+		expires: n.now().Add(n.ttl),
+	}
+	n.mu.Unlock()
+
+	return names, err
+}
+
+// evict drops the expired entries. If none have expired, it drops the one
+// that expires first. It must be called with mu held.
+func (n *SourceNamer) evict() {
+	now := n.now()
+
+	var (
+		oldest  string
+		expires time.Time
+	)
+	for sourceID, e := range n.entries {
+		if !now.Before(e.expires) {
+			delete(n.entries, sourceID)
+			continue
+		}
+
+		if oldest == "" || e.expires.Before(expires) {
+			oldest, expires = sourceID, e.expires
+		}
+	}
+
+	if len(n.entries) >= n.maxEntries {
+		delete(n.entries, oldest)
+	}
+}
+
+func (n *SourceNamer) lookup(ctx context.Context, sourceID string) (SourceNames, error) {
+	// Apps include their space and org. Service instances only support
+	// selecting the fields of them, which CAPI returns the same way.
+	r, found, err := n.get(ctx, "/v3/apps/"+sourceID, url.Values{
+		"include": {"space.organization"},
+	})
+	if err != nil {
+		return SourceNames{}, err
+	}
+
+	if found {
+		names := r.names()
+		names.App = r.Name
+		return names, nil
+	}
+
+	r, found, err = n.get(ctx, "/v3/service_instances/"+sourceID, url.Values{
+		"fields[space]":              {"name,guid"},
+		"fields[space.organization]": {"name,guid"},
+	})
+	if err != nil {
+		return SourceNames{}, err
+	}
+
+	if found {
+		names := r.names()
+		names.ServiceInstance = r.Name
+		return names, nil
+	}
+
+	return SourceNames{}, &NotFoundError{
+		Msg: fmt.Sprintf("source ID %s is not an app or a service instance", sourceID),
+	}
+}
+
+type resource struct {
+	Name          string `json:"name"`
+	Relationships struct {
+		Space struct {
+			Data struct {
+				Guid string `json:"guid"`
+			} `json:"data"`
+		} `json:"space"`
+	} `json:"relationships"`
+	Included struct {
+		Spaces []struct {
+			Name string `json:"name"`
+		} `json:"spaces"`
+		Organizations []struct {
+			Name string `json:"name"`
+		} `json:"organizations"`
+	} `json:"included"`
+}
+
+func (r resource) names() SourceNames {
+	names := SourceNames{
+		SpaceGuid: r.Relationships.Space.Data.Guid,
+	}
+	if len(r.Included.Spaces) > 0 {
+		names.Space = r.Included.Spaces[0].Name
+	}
+
+	if len(r.Included.Organizations) > 0 {
+		names.Org = r.Included.Organizations[0].Name
+	}
+
+	return names
+}
+
+// get fetches the resource along with its space and org. It reports whether
+// the resource was found.
+func (n *SourceNamer) get(ctx context.Context, path string, query url.Values) (resource, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, n.addr+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return resource{}, false, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := n.d.Do(req)
+	if err != nil {
+		return resource{}, false, fmt.Errorf("failed to get %s: %s", path, err)
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return resource{}, false, nil
+	default:
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resource{}, false, fmt.Errorf("unexpected status code %d getting %s: %s", resp.StatusCode, path, body)
+	}
+
+	var r resource
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return resource{}, false, fmt.Errorf("failed to decode %s: %s", path, err)
+	}
+
+	return r, true, nil
+}
@@ -0,0 +1,157 @@
+package capi_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache/internal/capi"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TN struct {
+	*testing.T
+	n       *capi.SourceNamer
+	spyDoer *spyDoer
+}
+
+func TestSourceNamer(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TN {
+		spyDoer := newSpyDoer()
+		return TN{
+			T:       t,
+			n:       capi.NewSourceNamer("https://api.some.url/", spyDoer, time.Hour, 100),
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it names an app", func(t TN) {
+		t.spyDoer.bodies["/v3/apps/some-guid"] = `{
+		  "name": "some-app",
+		  "relationships": {
+		    "space": {"data": {"guid": "some-space-guid"}}
+		  },
+		  "included": {
+		    "spaces": [{"name": "some-space"}],
+		    "organizations": [{"name": "some-org"}]
+		  }
+		}`
+
+		names, err := t.n.Names(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, names).To(Equal(capi.SourceNames{
+			App:       "some-app",
+			Space:     "some-space",
+			Org:       "some-org",
+			SpaceGuid: "some-space-guid",
+		}))
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
+		Expect(t, t.spyDoer.reqs[0].Method).To(Equal(http.MethodGet))
+		Expect(t, t.spyDoer.reqs[0].URL.Host).To(Equal("api.some.url"))
+		Expect(t, t.spyDoer.reqs[0].URL.Query().Get("include")).To(Equal("space.organization"))
+	})
+
+	o.Spec("it names a service instance", func(t TN) {
+		t.spyDoer.statuses["/v3/apps/some-guid"] = http.StatusNotFound
+		t.spyDoer.bodies["/v3/service_instances/some-guid"] = `{
+		  "name": "some-service",
+		  "relationships": {
+		    "space": {"data": {"guid": "some-space-guid"}}
+		  },
+		  "included": {
+		    "spaces": [{"name": "some-space", "guid": "some-space-guid"}],
+		    "organizations": [{"name": "some-org", "guid": "some-org-guid"}]
+		  }
+		}`
+
+		names, err := t.n.Names(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, names).To(Equal(capi.SourceNames{
+			ServiceInstance: "some-service",
+			Space:           "some-space",
+			Org:             "some-org",
+			SpaceGuid:       "some-space-guid",
+		}))
+
+		query := t.spyDoer.reqs[1].URL.Query()
+		Expect(t, query).To(Not(HaveKey("include")))
+		Expect(t, query.Get("fields[space]")).To(Equal("name,guid"))
+		Expect(t, query.Get("fields[space.organization]")).To(Equal("name,guid"))
+	})
+
+	o.Spec("it returns an error for an unknown source ID", func(t TN) {
+		t.spyDoer.statuses["/v3/apps/some-guid"] = http.StatusNotFound
+		t.spyDoer.statuses["/v3/service_instances/some-guid"] = http.StatusNotFound
+
+		_, err := t.n.Names(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+
+		_, ok := err.(*capi.NotFoundError)
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("it caches lookups", func(t TN) {
+		t.spyDoer.bodies["/v3/apps/some-guid"] = `{"name": "some-app"}`
+		t.n.Names(context.Background(), "some-guid")
+		names, err := t.n.Names(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, names.App).To(Equal("some-app"))
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
+	})
+
+	o.Spec("it caches unknown source IDs", func(t TN) {
+		t.spyDoer.statuses["/v3/apps/some-guid"] = http.StatusNotFound
+		t.spyDoer.statuses["/v3/service_instances/some-guid"] = http.StatusNotFound
+		t.n.Names(context.Background(), "some-guid")
+		t.n.Names(context.Background(), "some-guid")
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(2))
+	})
+
+	o.Spec("it does not cache other failures", func(t TN) {
+		t.spyDoer.status = http.StatusInternalServerError
+		_, err := t.n.Names(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+
+		t.spyDoer.status = http.StatusOK
+		t.spyDoer.bodies["/v3/apps/some-guid"] = `{"name": "some-app"}`
+		names, err := t.n.Names(context.Background(), "some-guid")
+		Expect(t, err).To(BeNil())
+		Expect(t, names.App).To(Equal("some-app"))
+	})
+
+	o.Spec("it looks up the names again after the TTL", func(t TN) {
+		t.n = capi.NewSourceNamer("https://api.some.url", t.spyDoer, 0, 100)
+		t.spyDoer.bodies["/v3/apps/some-guid"] = `{"name": "some-app"}`
+		t.n.Names(context.Background(), "some-guid")
+		t.n.Names(context.Background(), "some-guid")
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(2))
+	})
+
+	o.Spec("it limits the number of cached source IDs", func(t TN) {
+		t.n = capi.NewSourceNamer("https://api.some.url", t.spyDoer, time.Hour, 1)
+		t.spyDoer.bodies["/v3/apps/some-guid"] = `{"name": "some-app"}`
+		t.spyDoer.bodies["/v3/apps/other-guid"] = `{"name": "other-app"}`
+		t.n.Names(context.Background(), "some-guid")
+		t.n.Names(context.Background(), "other-guid")
+		t.n.Names(context.Background(), "some-guid")
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(3))
+	})
+
+	o.Spec("it returns an error for an unexpected status code", func(t TN) {
+		t.spyDoer.status = http.StatusInternalServerError
+		_, err := t.n.Names(context.Background(), "some-guid")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
@@ -0,0 +1,168 @@
+package capi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SourceResolver resolves the names used in source_id matchers to the GUIDs
+// Log Cache uses as source IDs. A name is either an app or a service
+// instance. Unqualified names are looked up in the service's own space,
+// whereas names of the form org/space/name are looked up in the given
+// space.
+type SourceResolver struct {
+	addr      string
+	spaceGuid string
+	d         Doer
+}
+
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+func NewSourceResolver(addr, spaceGuid string, d Doer) *SourceResolver {
+	return &SourceResolver{
+		addr:      strings.TrimSuffix(addr, "/"),
+		spaceGuid: spaceGuid,
+		d:         d,
+	}
+}
+
+// NotFoundError is returned when a name does not match any app or service
+// instance (or its org or space does not exist).
+type NotFoundError struct {
+	Msg string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Msg
+}
+
+// NotFound distinguishes the error from those that may be transient (e.g.,
+// CAPI timing out).
+func (e *NotFoundError) NotFound() bool {
+	return true
+}
+
+// GetAppGuid returns the GUID for the given app or service instance name.
+// It returns a *NotFoundError if the name is unknown and an error if it
+// matches more than one source.
+func (r *SourceResolver) GetAppGuid(ctx context.Context, name string) (string, error) {
+	spaceGuid := r.spaceGuid
+
+	parts := strings.Split(name, "/")
+	switch len(parts) {
+	case 1:
+	case 3:
+		var err error
+		spaceGuid, err = r.findSpace(ctx, parts[0], parts[1])
+		if err != nil {
+			return "", err
+		}
+		name = parts[2]
+	default:
+		return "", fmt.Errorf("invalid source name %q: expected <name> or <org>/<space>/<name>", name)
+	}
+
+	q := url.Values{
+		"names":       {name},
+		"space_guids": {spaceGuid},
+	}
+
+	apps, err := r.listGuids(ctx, "/v3/apps", q)
+	if err != nil {
+		return "", err
+	}
+
+	serviceInstances, err := r.listGuids(ctx, "/v3/service_instances", q)
+	if err != nil {
+		return "", err
+	}
+
+	switch guids := append(apps, serviceInstances...); len(guids) {
+	case 0:
+		return "", &NotFoundError{
+			Msg: fmt.Sprintf("no app or service instance named %q in space %s", name, spaceGuid),
+		}
+	case 1:
+		return guids[0], nil
+	default:
+		return "", fmt.Errorf(
+			"%q is ambiguous in space %s: it matches %d apps and %d service instances",
+			name, spaceGuid, len(apps), len(serviceInstances),
+		)
+	}
+}
+
+func (r *SourceResolver) findSpace(ctx context.Context, org, space string) (string, error) {
+	orgGuids, err := r.listGuids(ctx, "/v3/organizations", url.Values{"names": {org}})
+	if err != nil {
+		return "", err
+	}
+
+	if len(orgGuids) != 1 {
+		return "", &NotFoundError{Msg: fmt.Sprintf("unknown org %q", org)}
+	}
+
+	spaceGuids, err := r.listGuids(ctx, "/v3/spaces", url.Values{
+		"names":              {space},
+		"organization_guids": {orgGuids[0]},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(spaceGuids) != 1 {
+		return "", &NotFoundError{Msg: fmt.Sprintf("unknown space %q in org %q", space, org)}
+	}
+
+	return spaceGuids[0], nil
+}
+
+// listGuids returns the GUIDs of the resources on the first page of a CAPI
+// v3 list endpoint. The queries filter by name, so there is never more than
+// one page.
+func (r *SourceResolver) listGuids(ctx context.Context, path string, q url.Values) ([]string, error) {
+	req, err := http.NewRequest(http.MethodGet, r.addr+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := r.d.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %s", path, err)
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code %d listing %s: %s", resp.StatusCode, path, body)
+	}
+
+	var results struct {
+		Resources []struct {
+			Guid string `json:"guid"`
+		} `json:"resources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %s", path, err)
+	}
+
+	var guids []string
+	for _, r := range results.Resources {
+		guids = append(guids, r.Guid)
+	}
+
+	return guids, nil
+}
@@ -0,0 +1,182 @@
+package capi_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/poy/cf-faas-log-cache/internal/capi"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TR struct {
+	*testing.T
+	r       *capi.SourceResolver
+	spyDoer *spyDoer
+}
+
+func TestSourceResolver(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TR {
+		spyDoer := newSpyDoer()
+		return TR{
+			T:       t,
+			r:       capi.NewSourceResolver("https://api.some.url/", "some-space-guid", spyDoer),
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it resolves an app in its own space", func(t TR) {
+		t.spyDoer.bodies["/v3/apps"] = resources("app-guid")
+
+		guid, err := t.r.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("app-guid"))
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(2))
+		for _, req := range t.spyDoer.reqs {
+			Expect(t, req.Method).To(Equal(http.MethodGet))
+			Expect(t, req.URL.Query().Get("names")).To(Equal("some-app"))
+			Expect(t, req.URL.Query().Get("space_guids")).To(Equal("some-space-guid"))
+		}
+		Expect(t, t.spyDoer.reqs[0].URL.Host).To(Equal("api.some.url"))
+	})
+
+	o.Spec("it resolves a service instance", func(t TR) {
+		t.spyDoer.bodies["/v3/service_instances"] = resources("service-guid")
+
+		guid, err := t.r.GetAppGuid(context.Background(), "some-service")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("service-guid"))
+	})
+
+	o.Spec("it resolves org/space qualified names", func(t TR) {
+		t.spyDoer.bodies["/v3/organizations"] = resources("org-guid")
+		t.spyDoer.bodies["/v3/spaces"] = resources("other-space-guid")
+		t.spyDoer.bodies["/v3/apps"] = resources("app-guid")
+
+		guid, err := t.r.GetAppGuid(context.Background(), "some-org/some-space/some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("app-guid"))
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(4))
+		Expect(t, t.spyDoer.reqs[0].URL.Query().Get("names")).To(Equal("some-org"))
+		Expect(t, t.spyDoer.reqs[1].URL.Query().Get("names")).To(Equal("some-space"))
+		Expect(t, t.spyDoer.reqs[1].URL.Query().Get("organization_guids")).To(Equal("org-guid"))
+		Expect(t, t.spyDoer.reqs[2].URL.Query().Get("names")).To(Equal("some-app"))
+		Expect(t, t.spyDoer.reqs[2].URL.Query().Get("space_guids")).To(Equal("other-space-guid"))
+	})
+
+	o.Spec("it returns an error for an unknown name", func(t TR) {
+		_, err := t.r.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("no app or service instance"))
+
+		_, ok := err.(*capi.NotFoundError)
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("it returns an error for an ambiguous name", func(t TR) {
+		t.spyDoer.bodies["/v3/apps"] = resources("app-guid")
+		t.spyDoer.bodies["/v3/service_instances"] = resources("service-guid")
+
+		_, err := t.r.GetAppGuid(context.Background(), "some-name")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("ambiguous"))
+
+		_, ok := err.(*capi.NotFoundError)
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("it returns an error for an unknown org", func(t TR) {
+		_, err := t.r.GetAppGuid(context.Background(), "some-org/some-space/some-app")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("unknown org"))
+	})
+
+	o.Spec("it returns an error for an unknown space", func(t TR) {
+		t.spyDoer.bodies["/v3/organizations"] = resources("org-guid")
+
+		_, err := t.r.GetAppGuid(context.Background(), "some-org/some-space/some-app")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("unknown space"))
+
+		_, ok := err.(*capi.NotFoundError)
+		Expect(t, ok).To(BeTrue())
+	})
+
+	o.Spec("it returns an error for a malformed name", func(t TR) {
+		_, err := t.r.GetAppGuid(context.Background(), "some-space/some-app")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.spyDoer.reqs).To(HaveLen(0))
+	})
+
+	o.Spec("it returns an error for a non-200", func(t TR) {
+		t.spyDoer.status = http.StatusInternalServerError
+		_, err := t.r.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for invalid JSON", func(t TR) {
+		t.spyDoer.bodies["/v3/apps"] = "invalid"
+		_, err := t.r.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TR) {
+		t.spyDoer.err = errors.New("some-error")
+		_, err := t.r.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func resources(guids ...string) string {
+	var rs []string
+	for _, g := range guids {
+		rs = append(rs, `{"guid":"`+g+`"}`)
+	}
+	return `{"resources":[` + strings.Join(rs, ",") + `]}`
+}
+
+type spyDoer struct {
+	reqs     []*http.Request
+	bodies   map[string]string
+	statuses map[string]int
+	status   int
+	err      error
+}
+
+func newSpyDoer() *spyDoer {
+	return &spyDoer{
+		bodies:   make(map[string]string),
+		statuses: make(map[string]int),
+		status:   http.StatusOK,
+	}
+}
+
+func (s *spyDoer) Do(r *http.Request) (*http.Response, error) {
+	s.reqs = append(s.reqs, r)
+
+	body, ok := s.bodies[r.URL.Path]
+	if !ok {
+		body = `{"resources":[]}`
+	}
+
+	status, ok := s.statuses[r.URL.Path]
+	if !ok {
+		status = s.status
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}, s.err
+}
@@ -0,0 +1,42 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Post delivers the JSON data to a function. It returns the error of the
+// Doer as is (so callers can check whether it timed out) and an error if
+// the function does not respond with a 200.
+func Post(ctx context.Context, d Doer, url string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to parse request: %s", err)
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := d.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST returned unexpected status code %d: %s", resp.StatusCode, body)
+	}
+
+	return nil
+}
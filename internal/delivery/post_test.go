@@ -0,0 +1,82 @@
+package delivery_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/poy/cf-faas-log-cache/internal/delivery"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TP struct {
+	*testing.T
+	spyDoer *spyDoer
+}
+
+func TestPost(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TP {
+		return TP{
+			T:       t,
+			spyDoer: &spyDoer{status: http.StatusOK},
+		}
+	})
+
+	o.Spec("it POSTs the data", func(t TP) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		err := delivery.Post(ctx, t.spyDoer, "http://some.url/some-path", []byte(`{"a":1}`))
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.Method).To(Equal(http.MethodPost))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some.url/some-path"))
+		Expect(t, t.spyDoer.req.Context()).To(Equal(ctx))
+		Expect(t, string(t.spyDoer.body)).To(Equal(`{"a":1}`))
+	})
+
+	o.Spec("it returns the error of the Doer", func(t TP) {
+		t.spyDoer.err = errors.New("some-error")
+
+		err := delivery.Post(context.Background(), t.spyDoer, "http://some.url/some-path", nil)
+		Expect(t, err).To(Equal(t.spyDoer.err))
+	})
+
+	o.Spec("it returns an error for a non-200", func(t TP) {
+		t.spyDoer.status = http.StatusInternalServerError
+
+		err := delivery.Post(context.Background(), t.spyDoer, "http://some.url/some-path", nil)
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.Error()).To(ContainSubstring("500: some-body"))
+	})
+}
+
+type spyDoer struct {
+	req    *http.Request
+	body   []byte
+	status int
+	err    error
+}
+
+func (s *spyDoer) Do(req *http.Request) (*http.Response, error) {
+	s.req = req
+	s.body, _ = ioutil.ReadAll(req.Body)
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &http.Response{
+		StatusCode: s.status,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("some-body"))),
+	}, nil
+}
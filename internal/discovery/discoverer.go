@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Endpoints are the addresses of the components the service talks to.
+type Endpoints struct {
+	LogCache string
+	UAA      string
+}
+
+// Discoverer finds the Endpoints from the links in the CAPI root document
+// (GET /). The endpoints are only discovered once, at startup, so they are
+// not cached.
+type Discoverer struct {
+	capiAddr string
+	d        Doer
+}
+
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+func NewDiscoverer(capiAddr string, d Doer) *Discoverer {
+	return &Discoverer{
+		capiAddr: strings.TrimSuffix(capiAddr, "/"),
+		d:        d,
+	}
+}
+
+// Endpoints returns the discovered endpoints. Links that CAPI does not
+// advertise are left empty.
+func (d *Discoverer) Endpoints(ctx context.Context) (Endpoints, error) {
+	req, err := http.NewRequest(http.MethodGet, d.capiAddr+"/", nil)
+	if err != nil {
+		return Endpoints{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.d.Do(req)
+	if err != nil {
+		return Endpoints{}, fmt.Errorf("failed to get CAPI root: %s", err)
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return Endpoints{}, fmt.Errorf("unexpected status code %d getting CAPI root: %s", resp.StatusCode, body)
+	}
+
+	var root struct {
+		Links map[string]struct {
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return Endpoints{}, fmt.Errorf("failed to decode CAPI root: %s", err)
+	}
+
+	return Endpoints{
+		LogCache: root.Links["log_cache"].Href,
+		UAA:      root.Links["uaa"].Href,
+	}, nil
+}
@@ -0,0 +1,108 @@
+package discovery_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/poy/cf-faas-log-cache/internal/discovery"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TD struct {
+	*testing.T
+	d       *discovery.Discoverer
+	spyDoer *spyDoer
+}
+
+func TestDiscoverer(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TD {
+		spyDoer := newSpyDoer()
+		return TD{
+			T:       t,
+			d:       discovery.NewDiscoverer("https://api.some.url/", spyDoer),
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it discovers the endpoints from the CAPI root", func(t TD) {
+		t.spyDoer.body = `{
+		  "links": {
+		    "self": {"href": "https://api.some.url"},
+		    "log_cache": {"href": "https://log-cache.other.url"},
+		    "uaa": {"href": "https://uaa.other.url"}
+		  }
+		}`
+
+		e, err := t.d.Endpoints(context.Background())
+		Expect(t, err).To(BeNil())
+		Expect(t, e).To(Equal(discovery.Endpoints{
+			LogCache: "https://log-cache.other.url",
+			UAA:      "https://uaa.other.url",
+		}))
+
+		Expect(t, t.spyDoer.reqs).To(HaveLen(1))
+		Expect(t, t.spyDoer.reqs[0].URL.String()).To(Equal("https://api.some.url/"))
+		Expect(t, t.spyDoer.reqs[0].Method).To(Equal(http.MethodGet))
+	})
+
+	o.Spec("it leaves the links CAPI does not advertise empty", func(t TD) {
+		t.spyDoer.body = `{"links":{"log_cache":{"href":"https://log-cache.other.url"}}}`
+		e, err := t.d.Endpoints(context.Background())
+		Expect(t, err).To(BeNil())
+		Expect(t, e.LogCache).To(Equal("https://log-cache.other.url"))
+		Expect(t, e.UAA).To(Equal(""))
+	})
+
+	o.Spec("it returns an error for an unexpected status code", func(t TD) {
+		t.spyDoer.status = http.StatusInternalServerError
+		_, err := t.d.Endpoints(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TD) {
+		t.spyDoer.err = errors.New("some-error")
+		_, err := t.d.Endpoints(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for invalid JSON", func(t TD) {
+		t.spyDoer.body = "invalid"
+		_, err := t.d.Endpoints(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+type spyDoer struct {
+	reqs   []*http.Request
+	body   string
+	status int
+	err    error
+}
+
+func newSpyDoer() *spyDoer {
+	return &spyDoer{
+		status: http.StatusOK,
+	}
+}
+
+func (s *spyDoer) Do(r *http.Request) (*http.Response, error) {
+	s.reqs = append(s.reqs, r)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &http.Response{
+		StatusCode: s.status,
+		Body:       ioutil.NopCloser(strings.NewReader(s.body)),
+	}, nil
+}
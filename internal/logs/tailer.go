@@ -0,0 +1,387 @@
+package logs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/go-log-cache/rpc/logcache_v1"
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/internal/delivery"
+	"github.com/poy/cf-faas-log-cache/internal/web"
+	"github.com/poy/cf-faas-log-cache/pkg/promql"
+)
+
+// Tailer delivers the log lines of a logs event. Each Tick reads the lines
+// that arrived since the previous one and POSTs those that pass the
+// event's filter.
+type Tailer struct {
+	q   web.Query
+	r   DataReader
+	f   promql.GuidFetcher
+	d   Doer
+	log *log.Logger
+	cp  Checkpointer
+	a   SourceAuthorizer
+
+	match      func([]byte) bool
+	limit      int64
+	maxPages   int
+	maxBacklog time.Duration
+
+	postTimeout time.Duration
+
+	// cursor is the timestamp of the last envelope that was read and seen
+	// has the envelopes at the cursor that were read. A nil seen means
+	// every envelope at the cursor was read (e.g., after a restart).
+	cursor int64
+	seen   map[string]bool
+
+	// stopped is set if the filter is invalid.
+	stopped bool
+
+	timeouts uint64
+}
+
+// DefaultTimeout is used for logs events that don't set their own timeout.
+const DefaultTimeout = 5 * time.Second
+
+// DefaultPostTimeout is how long a function has to handle a batch of lines.
+const DefaultPostTimeout = 30 * time.Second
+
+// DataReader reads envelopes from Log Cache (e.g.,
+// pkg/promql.LogCacheReader).
+type DataReader interface {
+	Read(ctx context.Context, req *logcache_v1.ReadRequest) (*logcache_v1.ReadResponse, error)
+}
+
+// Checkpointer records the cursor so tailing resumes where it left off
+// after a restart.
+type Checkpointer interface {
+	Record(id string, t time.Time)
+	Last(id string) (time.Time, bool)
+}
+
+// SourceAuthorizer returns an error if the source may not be read (e.g.,
+// access.Authorizer).
+type SourceAuthorizer interface {
+	AuthorizeSource(ctx context.Context, sourceID string) error
+}
+
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// TailerOption configures a Tailer.
+type TailerOption func(*Tailer)
+
+// WithCheckpointer saves the cursor after each delivered batch. A Tailer
+// starts from the saved cursor (see WithMaxBacklog).
+func WithCheckpointer(cp Checkpointer) TailerOption {
+	return func(t *Tailer) {
+		t.cp = cp
+	}
+}
+
+// WithAuthorizer checks the source before each tick. Access can change
+// after the event was registered (e.g., an app moves to another space).
+func WithAuthorizer(a SourceAuthorizer) TailerOption {
+	return func(t *Tailer) {
+		t.a = a
+	}
+}
+
+// WithBatchSize sets how many envelopes are read (and at most delivered)
+// at a time. Defaults to 100.
+func WithBatchSize(n int) TailerOption {
+	return func(t *Tailer) {
+		t.limit = int64(n)
+	}
+}
+
+// WithMaxPages sets how many batches a tick reads at most. The rest is read
+// by the next tick. Defaults to 10.
+func WithMaxPages(n int) TailerOption {
+	return func(t *Tailer) {
+		t.maxPages = n
+	}
+}
+
+// WithMaxBacklog sets how far back a saved cursor may be. Older lines are
+// skipped. Defaults to 10 minutes.
+func WithMaxBacklog(d time.Duration) TailerOption {
+	return func(t *Tailer) {
+		t.maxBacklog = d
+	}
+}
+
+// WithPostTimeout sets how long a function has to handle a batch of lines.
+// The POST has its own deadline, so slow reads do not cut it short.
+// Defaults to DefaultPostTimeout.
+func WithPostTimeout(d time.Duration) TailerOption {
+	return func(t *Tailer) {
+		t.postTimeout = d
+	}
+}
+
+// NewTailer returns a Tailer for the logs event q (q.Logs must be set).
+// Without a saved cursor, it starts with the lines that arrive after it
+// was created.
+func NewTailer(
+	q web.Query,
+	r DataReader,
+	f promql.GuidFetcher,
+	d Doer,
+	log *log.Logger,
+	opts ...TailerOption,
+) *Tailer {
+	t := &Tailer{
+		q:          q,
+		r:          r,
+		f:          f,
+		d:          d,
+		log:        log,
+		limit:      100,
+		maxPages:   10,
+		maxBacklog: 10 * time.Minute,
+
+		postTimeout: DefaultPostTimeout,
+	}
+
+	for _, o := range opts {
+		o(t)
+	}
+
+	match, err := newMatcher(q.Logs)
+	if err != nil {
+		t.log.Printf("logs event for %q will not be delivered: %s", q.Logs.SourceID, err)
+		t.stopped = true
+	}
+	t.match = match
+
+	now := time.Now()
+	t.cursor = now.UnixNano()
+	if t.cp != nil {
+		if last, ok := t.cp.Last(q.ID()); ok {
+			t.cursor = last.UnixNano()
+		}
+	}
+
+	if oldest := now.Add(-t.maxBacklog).UnixNano(); t.cursor < oldest {
+		t.cursor = oldest
+	}
+
+	return t
+}
+
+func newMatcher(f *web.LogFilter) (func([]byte) bool, error) {
+	switch {
+	case f.Regex != "":
+		re, err := regexp.Compile(f.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile regex: %s", err)
+		}
+		return re.Match, nil
+	case f.Match != "":
+		match := []byte(f.Match)
+		return func(payload []byte) bool {
+			return bytes.Contains(payload, match)
+		}, nil
+	default:
+		return func([]byte) bool { return true }, nil
+	}
+}
+
+func (t *Tailer) Tick() {
+	if t.stopped {
+		return
+	}
+
+	d := t.q.Timeout
+	if d == 0 {
+		d = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	sourceID := t.q.Logs.SourceID
+	if t.a != nil {
+		if err := t.a.AuthorizeSource(ctx, sourceID); err != nil {
+			t.log.Printf("logs for %q are not allowed: %s", sourceID, err)
+			return
+		}
+	}
+
+	if !promql.IsGuid(sourceID) {
+		guid, err := t.f.GetAppGuid(ctx, sourceID)
+		if err != nil {
+			t.log.Printf("failed to resolve source_id %q: %s", sourceID, err)
+			return
+		}
+		sourceID = guid
+	}
+
+	end := time.Now().UnixNano()
+	for page := 0; page < t.maxPages; page++ {
+		start := t.cursor + 1
+		if t.seen != nil {
+			start = t.cursor
+		}
+
+		resp, err := t.r.Read(ctx, &logcache_v1.ReadRequest{
+			SourceId:      sourceID,
+			StartTime:     start,
+			EndTime:       end,
+			Limit:         t.limit,
+			EnvelopeTypes: []logcache_v1.EnvelopeType{logcache_v1.EnvelopeType_LOG},
+		})
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				atomic.AddUint64(&t.timeouts, 1)
+			}
+			t.log.Printf("failed to read logs for %q: %s", t.q.Logs.SourceID, err)
+			return
+		}
+
+		batch := resp.GetEnvelopes().GetBatch()
+		logs, cursor, seen, n := t.next(batch)
+		if n == 0 {
+			if int64(len(batch)) < t.limit {
+				// Nothing new.
+				return
+			}
+
+			// A full page of envelopes that were already read. They
+			// all share the cursor's timestamp, so reading from it
+			// again returns the same page. Move past it instead of
+			// stalling.
+			t.log.Printf("more than %d envelopes for %q at %d, skipping the rest of them", t.limit, t.q.Logs.SourceID, t.cursor)
+			t.seen = nil
+			if t.cp != nil {
+				t.cp.Record(t.q.ID(), time.Unix(0, t.cursor))
+			}
+			continue
+		}
+
+		if len(logs) > 0 && !t.post(logs) {
+			// The same lines are read again by the next tick.
+			return
+		}
+
+		t.cursor, t.seen = cursor, seen
+		if t.cp != nil {
+			t.cp.Record(t.q.ID(), time.Unix(0, t.cursor))
+		}
+
+		if int64(len(batch)) < t.limit {
+			return
+		}
+	}
+}
+
+// next returns the lines of the batch that pass the filter along with the
+// cursor after the batch and how many envelopes were new. Envelopes at the
+// cursor that were read before are skipped. Log Cache can return the same
+// envelope more than once, so duplicates are dropped too.
+func (t *Tailer) next(batch []*loggregator_v2.Envelope) ([]faaspromql.Log, int64, map[string]bool, int) {
+	var (
+		logs   []faaspromql.Log
+		cursor = t.cursor
+		seen   = t.seen
+		copied bool
+		read   = map[string]bool{}
+	)
+
+	for _, e := range batch {
+		ts, key := e.GetTimestamp(), envelopeKey(e)
+		if ts < t.cursor || read[key] {
+			continue
+		}
+
+		if ts == t.cursor && (t.seen == nil || t.seen[key]) {
+			continue
+		}
+		read[key] = true
+
+		switch {
+		case ts > cursor:
+			cursor = ts
+			seen = map[string]bool{key: true}
+			copied = true
+		case ts == cursor:
+			if !copied {
+				seen = copyKeys(t.seen)
+				copied = true
+			}
+			seen[key] = true
+		}
+
+		if t.match(e.GetLog().GetPayload()) {
+			logs = append(logs, convertLog(e))
+		}
+	}
+
+	return logs, cursor, seen, len(read)
+}
+
+func copyKeys(m map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(m)+1)
+	for k := range m {
+		c[k] = true
+	}
+
+	return c
+}
+
+func envelopeKey(e *loggregator_v2.Envelope) string {
+	return fmt.Sprintf("%d/%s/%s/%s/%q", e.GetTimestamp(), e.GetSourceId(), e.GetInstanceId(), e.GetLog().GetType(), e.GetLog().GetPayload())
+}
+
+func convertLog(e *loggregator_v2.Envelope) faaspromql.Log {
+	return faaspromql.Log{
+		Timestamp:  e.GetTimestamp(),
+		SourceID:   e.GetSourceId(),
+		InstanceID: e.GetInstanceId(),
+		Type:       e.GetLog().GetType().String(),
+		Payload:    string(e.GetLog().GetPayload()),
+		Tags:       e.GetTags(),
+	}
+}
+
+// post delivers the lines and reports whether the function accepted them.
+func (t *Tailer) post(logs []faaspromql.Log) bool {
+	data, err := json.Marshal(faaspromql.LogBatch{
+		Context:  t.q.Context,
+		SourceID: t.q.Logs.SourceID,
+		Logs:     logs,
+	})
+	if err != nil {
+		t.log.Panicf("failed to marshal logs: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.postTimeout)
+	defer cancel()
+
+	if err := delivery.Post(ctx, t.d, t.q.Path, data); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&t.timeouts, 1)
+		}
+		t.log.Printf("failed to deliver logs: %s", err)
+		return false
+	}
+
+	return true
+}
+
+// Timeouts returns the number of ticks that ran out of time.
+func (t *Tailer) Timeouts() uint64 {
+	return atomic.LoadUint64(&t.timeouts)
+}
@@ -0,0 +1,391 @@
+package logs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/go-log-cache/rpc/logcache_v1"
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/internal/logs"
+	"github.com/poy/cf-faas-log-cache/internal/web"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+const someGuid = "11111111-2222-3333-4444-555555555555"
+
+type TT struct {
+	*testing.T
+	q               web.Query
+	spyDataReader   *spyDataReader
+	spyGuidFetcher  *spyGuidFetcher
+	spyDoer         *spyDoer
+	spyCheckpointer *spyCheckpointer
+	spyAuthorizer   *spyAuthorizer
+	start           time.Time
+}
+
+func TestTailer(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TT {
+		return TT{
+			T: t,
+			q: web.Query{
+				Path:    "http://some.url/some-path",
+				Context: "some-context",
+				Logs: &web.LogFilter{
+					SourceID: "some-app",
+					Regex:    `status=5\d\d`,
+				},
+			},
+			spyDataReader:   &spyDataReader{},
+			spyGuidFetcher:  &spyGuidFetcher{guid: someGuid},
+			spyDoer:         &spyDoer{status: http.StatusOK},
+			spyCheckpointer: newSpyCheckpointer(),
+			spyAuthorizer:   &spyAuthorizer{},
+			start:           time.Now(),
+		}
+	})
+
+	o.Spec("it POSTs the lines that match", func(t TT) {
+		tailer := t.newTailer()
+		ts := time.Now().UnixNano()
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{{
+			logEnvelope(ts, "status=200"),
+			logEnvelope(ts+1, "status=503"),
+		}}
+
+		tailer.Tick()
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(1))
+		req := t.spyDataReader.reqs[0]
+		Expect(t, req.GetSourceId()).To(Equal(someGuid))
+		Expect(t, req.GetStartTime() > t.start.UnixNano()).To(BeTrue())
+		Expect(t, req.GetEnvelopeTypes()).To(Equal([]logcache_v1.EnvelopeType{logcache_v1.EnvelopeType_LOG}))
+		Expect(t, t.spyGuidFetcher.name).To(Equal("some-app"))
+
+		Expect(t, t.spyDoer.batches).To(HaveLen(1))
+		Expect(t, t.spyDoer.urls).To(Equal([]string{"http://some.url/some-path"}))
+		Expect(t, t.spyDoer.batches[0]).To(Equal(faaspromql.LogBatch{
+			Context:  "some-context",
+			SourceID: "some-app",
+			Logs: []faaspromql.Log{
+				{
+					Timestamp:  ts + 1,
+					SourceID:   someGuid,
+					InstanceID: "0",
+					Type:       "OUT",
+					Payload:    "status=503",
+				},
+			},
+		}))
+	})
+
+	o.Spec("it POSTs the lines that contain the match", func(t TT) {
+		t.q.Logs = &web.LogFilter{SourceID: someGuid, Match: "some-match"}
+		tailer := t.newTailer()
+		ts := time.Now().UnixNano()
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{{
+			logEnvelope(ts, "other"),
+			logEnvelope(ts+1, "a some-match b"),
+		}}
+
+		tailer.Tick()
+
+		Expect(t, t.spyGuidFetcher.name).To(Equal(""))
+		Expect(t, t.spyDoer.batches).To(HaveLen(1))
+		Expect(t, t.spyDoer.batches[0].Logs).To(HaveLen(1))
+		Expect(t, t.spyDoer.batches[0].Logs[0].Payload).To(Equal("a some-match b"))
+	})
+
+	o.Spec("it does not POST if no lines match", func(t TT) {
+		tailer := t.newTailer()
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{{
+			logEnvelope(time.Now().UnixNano(), "status=200"),
+		}}
+
+		tailer.Tick()
+
+		Expect(t, t.spyDoer.batches).To(HaveLen(0))
+	})
+
+	o.Spec("it drops duplicates", func(t TT) {
+		tailer := t.newTailer(logs.WithBatchSize(2))
+		ts := time.Now().UnixNano()
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{
+			{logEnvelope(ts, "status=500"), logEnvelope(ts, "status=500")},
+			{logEnvelope(ts, "status=500"), logEnvelope(ts+1, "status=501")},
+			{logEnvelope(ts+1, "status=501"), logEnvelope(ts+1, "status=501")},
+			{logEnvelope(ts+2, "status=502")},
+		}
+
+		tailer.Tick()
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(4))
+		Expect(t, t.spyDataReader.reqs[1].GetStartTime()).To(Equal(ts))
+		Expect(t, t.spyDataReader.reqs[2].GetStartTime()).To(Equal(ts + 1))
+
+		var payloads []string
+		for _, b := range t.spyDoer.batches {
+			for _, l := range b.Logs {
+				payloads = append(payloads, l.Payload)
+			}
+		}
+		Expect(t, payloads).To(Equal([]string{"status=500", "status=501", "status=502"}))
+	})
+
+	o.Spec("it pages through the lines", func(t TT) {
+		tailer := t.newTailer(logs.WithBatchSize(2), logs.WithCheckpointer(t.spyCheckpointer))
+		ts := time.Now().UnixNano()
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{
+			{logEnvelope(ts, "status=500"), logEnvelope(ts+1, "status=501")},
+			{logEnvelope(ts+2, "status=502")},
+		}
+
+		tailer.Tick()
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(2))
+		Expect(t, t.spyDataReader.reqs[1].GetStartTime()).To(Equal(ts + 1))
+		Expect(t, t.spyDoer.batches).To(HaveLen(2))
+
+		last, ok := t.spyCheckpointer.Last(t.q.ID())
+		Expect(t, ok).To(BeTrue())
+		Expect(t, last.UnixNano()).To(Equal(ts + 2))
+	})
+
+	o.Spec("it moves past a full page of lines that were already read", func(t TT) {
+		tailer := t.newTailer(logs.WithBatchSize(2))
+		ts := time.Now().UnixNano()
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{
+			{logEnvelope(ts, "status=500"), logEnvelope(ts, "status=501")},
+			{logEnvelope(ts, "status=500"), logEnvelope(ts, "status=501")},
+			{logEnvelope(ts+1, "status=502")},
+		}
+
+		tailer.Tick()
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(3))
+		Expect(t, t.spyDataReader.reqs[1].GetStartTime()).To(Equal(ts))
+		Expect(t, t.spyDataReader.reqs[2].GetStartTime()).To(Equal(ts + 1))
+		Expect(t, t.spyDoer.batches).To(HaveLen(2))
+		Expect(t, t.spyDoer.batches[1].Logs[0].Payload).To(Equal("status=502"))
+	})
+
+	o.Spec("it reads the same lines again if the POST fails", func(t TT) {
+		tailer := t.newTailer(logs.WithCheckpointer(t.spyCheckpointer))
+		ts := time.Now().UnixNano()
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{
+			{logEnvelope(ts, "status=500")},
+			{logEnvelope(ts, "status=500")},
+		}
+		t.spyDoer.status = http.StatusInternalServerError
+
+		tailer.Tick()
+		t.spyDoer.status = http.StatusOK
+		tailer.Tick()
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(2))
+		Expect(t, t.spyDataReader.reqs[1].GetStartTime()).To(Equal(t.spyDataReader.reqs[0].GetStartTime()))
+		Expect(t, t.spyDoer.batches).To(HaveLen(1))
+		Expect(t, t.spyDoer.batches[0].Logs[0].Payload).To(Equal("status=500"))
+	})
+
+	o.Spec("it gives the POST its own timeout", func(t TT) {
+		t.q.Timeout = time.Millisecond
+		tailer := t.newTailer(logs.WithPostTimeout(time.Hour))
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{{
+			logEnvelope(time.Now().UnixNano(), "status=503"),
+		}}
+
+		tailer.Tick()
+
+		Expect(t, t.spyDoer.batches).To(HaveLen(1))
+		deadline, ok := t.spyDoer.ctx.Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, deadline.After(time.Now().Add(time.Minute))).To(BeTrue())
+	})
+
+	o.Spec("it resumes from the saved cursor", func(t TT) {
+		saved := time.Now().Add(-time.Minute)
+		t.spyCheckpointer.Record(t.q.ID(), saved)
+
+		t.newTailer(logs.WithCheckpointer(t.spyCheckpointer)).Tick()
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(1))
+		Expect(t, t.spyDataReader.reqs[0].GetStartTime()).To(Equal(saved.UnixNano() + 1))
+	})
+
+	o.Spec("it does not go further back than the max backlog", func(t TT) {
+		t.spyCheckpointer.Record(t.q.ID(), time.Now().Add(-time.Hour))
+
+		t.newTailer(logs.WithCheckpointer(t.spyCheckpointer), logs.WithMaxBacklog(time.Minute)).Tick()
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(1))
+		Expect(t, t.spyDataReader.reqs[0].GetStartTime() > t.start.Add(-time.Minute).UnixNano()).To(BeTrue())
+	})
+
+	o.Spec("it does not read a source that is not allowed", func(t TT) {
+		t.spyAuthorizer.err = errors.New("some-error")
+
+		t.newTailer(logs.WithAuthorizer(t.spyAuthorizer)).Tick()
+
+		Expect(t, t.spyAuthorizer.sourceIDs).To(Equal([]string{"some-app"}))
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(0))
+	})
+
+	o.Spec("it does not read if the source can't be resolved", func(t TT) {
+		t.spyGuidFetcher.err = errors.New("some-error")
+
+		t.newTailer().Tick()
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(0))
+	})
+
+	o.Spec("it does not read with an invalid regex", func(t TT) {
+		t.q.Logs.Regex = "["
+
+		t.newTailer().Tick()
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(0))
+	})
+
+	o.Spec("it does not POST if the read fails", func(t TT) {
+		t.spyDataReader.err = errors.New("some-error")
+
+		t.newTailer().Tick()
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(1))
+		Expect(t, t.spyDoer.batches).To(HaveLen(0))
+	})
+}
+
+func (t TT) newTailer(opts ...logs.TailerOption) *logs.Tailer {
+	return logs.NewTailer(
+		t.q,
+		t.spyDataReader,
+		t.spyGuidFetcher,
+		t.spyDoer,
+		log.New(ioutil.Discard, "", 0),
+		opts...,
+	)
+}
+
+func logEnvelope(ts int64, payload string) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp:  ts,
+		SourceId:   someGuid,
+		InstanceId: "0",
+		Message: &loggregator_v2.Envelope_Log{
+			Log: &loggregator_v2.Log{
+				Payload: []byte(payload),
+				Type:    loggregator_v2.Log_OUT,
+			},
+		},
+	}
+}
+
+type spyDataReader struct {
+	reqs  []*logcache_v1.ReadRequest
+	pages [][]*loggregator_v2.Envelope
+	err   error
+}
+
+func (s *spyDataReader) Read(ctx context.Context, req *logcache_v1.ReadRequest) (*logcache_v1.ReadResponse, error) {
+	s.reqs = append(s.reqs, req)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var batch []*loggregator_v2.Envelope
+	if len(s.pages) > 0 {
+		batch, s.pages = s.pages[0], s.pages[1:]
+	}
+
+	return &logcache_v1.ReadResponse{
+		Envelopes: &loggregator_v2.EnvelopeBatch{Batch: batch},
+	}, nil
+}
+
+type spyGuidFetcher struct {
+	name string
+	guid string
+	err  error
+}
+
+func (s *spyGuidFetcher) GetAppGuid(ctx context.Context, name string) (string, error) {
+	s.name = name
+	return s.guid, s.err
+}
+
+type spyDoer struct {
+	urls    []string
+	batches []faaspromql.LogBatch
+	status  int
+	ctx     context.Context
+}
+
+func (s *spyDoer) Do(req *http.Request) (*http.Response, error) {
+	s.ctx = req.Context()
+
+	var b faaspromql.LogBatch
+	if err := json.NewDecoder(req.Body).Decode(&b); err != nil {
+		panic(err)
+	}
+
+	if s.status == http.StatusOK {
+		s.urls = append(s.urls, req.URL.String())
+		s.batches = append(s.batches, b)
+	}
+
+	return &http.Response{
+		StatusCode: s.status,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}, nil
+}
+
+type spyCheckpointer struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newSpyCheckpointer() *spyCheckpointer {
+	return &spyCheckpointer{
+		last: make(map[string]time.Time),
+	}
+}
+
+func (s *spyCheckpointer) Record(id string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last[id] = t
+}
+
+func (s *spyCheckpointer) Last(id string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.last[id]
+	return t, ok
+}
+
+type spyAuthorizer struct {
+	sourceIDs []string
+	err       error
+}
+
+func (s *spyAuthorizer) AuthorizeSource(ctx context.Context, sourceID string) error {
+	s.sourceIDs = append(s.sourceIDs, sourceID)
+	return s.err
+}
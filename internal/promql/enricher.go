@@ -0,0 +1,143 @@
+package promql
+
+import (
+	"context"
+	"log"
+
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/internal/capi"
+)
+
+// Enricher adds human readable labels to the results before they are
+// delivered. Every result with a source_id gets an app_name (or
+// service_instance_name) label. The space_name, org_name and instance_index
+// labels are opt-in (see EnricherOption).
+type Enricher struct {
+	n   SourceNamer
+	log *log.Logger
+
+	spaceName     bool
+	orgName       bool
+	instanceIndex bool
+}
+
+// SourceNamer looks up the names for a source ID (e.g., capi.SourceNamer).
+type SourceNamer interface {
+	Names(ctx context.Context, sourceID string) (capi.SourceNames, error)
+}
+
+// EnricherOption configures an Enricher.
+type EnricherOption func(*Enricher)
+
+// WithSpaceName adds a space_name label.
+func WithSpaceName() EnricherOption {
+	return func(e *Enricher) {
+		e.spaceName = true
+	}
+}
+
+// WithOrgName adds an org_name label.
+func WithOrgName() EnricherOption {
+	return func(e *Enricher) {
+		e.orgName = true
+	}
+}
+
+// WithInstanceIndex adds an instance_index label copied from the
+// instance_id Log Cache reports for each app instance.
+func WithInstanceIndex() EnricherOption {
+	return func(e *Enricher) {
+		e.instanceIndex = true
+	}
+}
+
+func NewEnricher(n SourceNamer, log *log.Logger, opts ...EnricherOption) *Enricher {
+	e := &Enricher{
+		n:   n,
+		log: log,
+	}
+
+	for _, o := range opts {
+		o(e)
+	}
+
+	return e
+}
+
+// Enrich adds the labels to each sample or series of the result. Sources
+// that can't be named are left as they are. The samples and series are
+// replaced rather than modified because the result may be shared with a
+// cache.
+func (e *Enricher) Enrich(ctx context.Context, result *faaspromql.QueryResult) {
+	// Look up (and log failures for) each source ID only once per result.
+	names := map[string]*capi.SourceNames{}
+	lookup := func(sourceID string) *capi.SourceNames {
+		if n, ok := names[sourceID]; ok {
+			return n
+		}
+
+		n, err := e.n.Names(ctx, sourceID)
+		if err != nil {
+			e.log.Printf("failed to look up names for source ID %s: %s", sourceID, err)
+			names[sourceID] = nil
+			return nil
+		}
+
+		names[sourceID] = &n
+		return &n
+	}
+
+	for i, r := range result.Data.Result {
+		switch s := r.(type) {
+		case *faaspromql.Sample:
+			cp := *s
+			cp.Metric = e.enrichMetric(s.Metric, lookup)
+			result.Data.Result[i] = &cp
+		case *faaspromql.Series:
+			cp := *s
+			cp.Metric = e.enrichMetric(s.Metric, lookup)
+			result.Data.Result[i] = &cp
+		}
+	}
+}
+
+func (e *Enricher) enrichMetric(
+	metric map[string]string,
+	lookup func(string) *capi.SourceNames,
+) map[string]string {
+	m := make(map[string]string, len(metric)+4)
+	for k, v := range metric {
+		m[k] = v
+	}
+
+	if id, ok := m["instance_id"]; ok && e.instanceIndex {
+		m["instance_index"] = id
+	}
+
+	sourceID, ok := m["source_id"]
+	if !ok {
+		return m
+	}
+
+	names := lookup(sourceID)
+	if names == nil {
+		return m
+	}
+
+	setLabel(m, "app_name", names.App)
+	setLabel(m, "service_instance_name", names.ServiceInstance)
+	if e.spaceName {
+		setLabel(m, "space_name", names.Space)
+	}
+	if e.orgName {
+		setLabel(m, "org_name", names.Org)
+	}
+
+	return m
+}
+
+func setLabel(m map[string]string, name, value string) {
+	if value != "" {
+		m[name] = value
+	}
+}
@@ -0,0 +1,159 @@
+package promql_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	faaspromql "github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/internal/capi"
+	"github.com/poy/cf-faas-log-cache/internal/promql"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TE struct {
+	*testing.T
+	spySourceNamer *spySourceNamer
+}
+
+func TestEnricher(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TE {
+		spySourceNamer := newSpySourceNamer()
+		spySourceNamer.names = map[string]capi.SourceNames{
+			"app-guid":     {App: "some-app", Space: "some-space", Org: "some-org"},
+			"service-guid": {ServiceInstance: "some-service", Space: "some-space", Org: "some-org"},
+		}
+
+		return TE{
+			T:              t,
+			spySourceNamer: spySourceNamer,
+		}
+	})
+
+	o.Spec("it adds the app and service instance names", func(t TE) {
+		e := promql.NewEnricher(t.spySourceNamer, discard())
+		result := &faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				Result: []interface{}{
+					&faaspromql.Sample{Metric: map[string]string{"source_id": "app-guid"}},
+					&faaspromql.Series{Metric: map[string]string{"source_id": "service-guid"}},
+				},
+			},
+		}
+
+		e.Enrich(context.Background(), result)
+
+		Expect(t, result.Data.Result[0].(*faaspromql.Sample).Metric).To(Equal(map[string]string{
+			"source_id": "app-guid",
+			"app_name":  "some-app",
+		}))
+		Expect(t, result.Data.Result[1].(*faaspromql.Series).Metric).To(Equal(map[string]string{
+			"source_id":             "service-guid",
+			"service_instance_name": "some-service",
+		}))
+	})
+
+	o.Spec("it adds the optional labels", func(t TE) {
+		e := promql.NewEnricher(
+			t.spySourceNamer,
+			discard(),
+			promql.WithSpaceName(),
+			promql.WithOrgName(),
+			promql.WithInstanceIndex(),
+		)
+		result := &faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				Result: []interface{}{
+					&faaspromql.Sample{Metric: map[string]string{"source_id": "app-guid", "instance_id": "3"}},
+				},
+			},
+		}
+
+		e.Enrich(context.Background(), result)
+
+		Expect(t, result.Data.Result[0].(*faaspromql.Sample).Metric).To(Equal(map[string]string{
+			"source_id":      "app-guid",
+			"instance_id":    "3",
+			"instance_index": "3",
+			"app_name":       "some-app",
+			"space_name":     "some-space",
+			"org_name":       "some-org",
+		}))
+	})
+
+	o.Spec("it does not modify the original samples", func(t TE) {
+		e := promql.NewEnricher(t.spySourceNamer, discard())
+		sample := &faaspromql.Sample{Metric: map[string]string{"source_id": "app-guid"}}
+		result := &faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				Result: []interface{}{sample},
+			},
+		}
+
+		e.Enrich(context.Background(), result)
+
+		Expect(t, sample.Metric).To(Equal(map[string]string{"source_id": "app-guid"}))
+	})
+
+	o.Spec("it looks up each source ID once", func(t TE) {
+		e := promql.NewEnricher(t.spySourceNamer, discard())
+		result := &faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				Result: []interface{}{
+					&faaspromql.Sample{Metric: map[string]string{"source_id": "app-guid"}},
+					&faaspromql.Sample{Metric: map[string]string{"source_id": "app-guid"}},
+					&faaspromql.Sample{Metric: map[string]string{"other": "value"}},
+				},
+			},
+		}
+
+		e.Enrich(context.Background(), result)
+
+		Expect(t, t.spySourceNamer.sourceIDs).To(Equal([]string{"app-guid"}))
+	})
+
+	o.Spec("it leaves sources that can't be named as they are", func(t TE) {
+		t.spySourceNamer.err = errors.New("some-error")
+		e := promql.NewEnricher(t.spySourceNamer, discard())
+		result := &faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				Result: []interface{}{
+					&faaspromql.Sample{Metric: map[string]string{"source_id": "app-guid"}},
+				},
+			},
+		}
+
+		e.Enrich(context.Background(), result)
+
+		Expect(t, result.Data.Result[0].(*faaspromql.Sample).Metric).To(Equal(map[string]string{
+			"source_id": "app-guid",
+		}))
+	})
+}
+
+func discard() *log.Logger {
+	return log.New(ioutil.Discard, "", 0)
+}
+
+type spySourceNamer struct {
+	sourceIDs []string
+	names     map[string]capi.SourceNames
+	err       error
+}
+
+func newSpySourceNamer() *spySourceNamer {
+	return &spySourceNamer{}
+}
+
+func (s *spySourceNamer) Names(ctx context.Context, sourceID string) (capi.SourceNames, error) {
+	s.sourceIDs = append(s.sourceIDs, sourceID)
+	return s.names[sourceID], s.err
+}
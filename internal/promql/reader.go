@@ -1,16 +1,15 @@
 package promql
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/internal/delivery"
 	"github.com/poy/cf-faas-log-cache/internal/web"
 )
 
@@ -19,13 +18,115 @@ type Reader struct {
 	d   Doer
 	log *log.Logger
 	q   web.Query
+	cp  Checkpointer
+	e   ResultEnricher
+	a   Authorizer
+
+	postTimeout time.Duration
+
+	mu sync.Mutex
+
+	// stopped is set once the query is found to be invalid. Retrying will
+	// not fix it.
+	stopped bool
+
+	// failures is the number of consecutive ticks whose query failed and
+	// skip the number of ticks left to skip before the next attempt.
+	failures uint
+	skip     int
+
+	// backfilling is set while Backfill runs. Ticks don't record
+	// checkpoints in the meantime.
+	backfilling int32
+
+	timeouts uint64
 }
 
+// DefaultTimeout is used for queries that don't set their own timeout.
+const DefaultTimeout = 5 * time.Second
+
+// DefaultPostTimeout is how long a function has to handle a result.
+const DefaultPostTimeout = 30 * time.Second
+
 type PromQLClient interface {
 	PromQL(
 		ctx context.Context,
 		query string,
 	) (*faaspromql.QueryResult, error)
+
+	PromQLAt(
+		ctx context.Context,
+		query string,
+		t time.Time,
+	) (*faaspromql.QueryResult, error)
+}
+
+// Checkpointer records when a query was last evaluated.
+type Checkpointer interface {
+	Record(id string, t time.Time)
+	Last(id string) (time.Time, bool)
+}
+
+// ReaderOption configures a Reader.
+type ReaderOption func(*Reader)
+
+// WithCheckpointer records each successful evaluation so that missed ticks
+// can be backfilled (see Backfill).
+func WithCheckpointer(cp Checkpointer) ReaderOption {
+	return func(r *Reader) {
+		r.cp = cp
+	}
+}
+
+// WithPostTimeout sets how long a function has to handle a result. The POST
+// has its own deadline, so a slow query does not cut it short. Defaults to
+// DefaultPostTimeout.
+func WithPostTimeout(d time.Duration) ReaderOption {
+	return func(r *Reader) {
+		r.postTimeout = d
+	}
+}
+
+// ResultEnricher adds labels to a result before it is delivered (e.g.,
+// Enricher).
+type ResultEnricher interface {
+	Enrich(ctx context.Context, result *faaspromql.QueryResult)
+}
+
+// WithEnricher enriches each result before it is POSTed.
+func WithEnricher(e ResultEnricher) ReaderOption {
+	return func(r *Reader) {
+		r.e = e
+	}
+}
+
+// Authorizer returns an error if the query reads sources it is not allowed
+// to (e.g., access.Authorizer).
+type Authorizer interface {
+	Authorize(ctx context.Context, query string) error
+}
+
+// WithAuthorizer checks the query before each evaluation. Access can change
+// after the query was registered (e.g., an app moves to another space).
+func WithAuthorizer(a Authorizer) ReaderOption {
+	return func(r *Reader) {
+		r.a = a
+	}
+}
+
+// badQuery is implemented by errors that know whether the query itself is
+// invalid (e.g., pkg/promql.Error).
+type badQuery interface {
+	BadQuery() bool
+}
+
+// maxSkippedTicks caps the backoff after consecutive failures.
+const maxSkippedTicks = 32
+
+// timeout is implemented by errors that know whether they were caused by a
+// deadline.
+type timeout interface {
+	Timeout() bool
 }
 
 type Doer interface {
@@ -37,63 +138,236 @@ func NewReader(
 	c PromQLClient,
 	d Doer,
 	log *log.Logger,
+	opts ...ReaderOption,
 ) *Reader {
-	return &Reader{
-		q:   q,
-		c:   c,
-		d:   d,
-		log: log,
+	r := &Reader{
+		q:           q,
+		c:           c,
+		d:           d,
+		log:         log,
+		postTimeout: DefaultPostTimeout,
+	}
+
+	for _, o := range opts {
+		o(r)
 	}
+
+	return r
 }
 
+// Tick evaluates the query and POSTs the result. After a query fails,
+// ticks are skipped with an exponential backoff. An invalid query is not
+// evaluated again.
 func (r *Reader) Tick() {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	if !r.ready() {
+		return
+	}
 
-	result, err := r.c.PromQL(ctx, r.q.Query)
-	if err != nil {
-		r.log.Printf("failed to make PromQL query: %s", err)
+	now := time.Now()
+	ok := r.evaluate(func(ctx context.Context) (*faaspromql.QueryResult, error) {
+		return r.c.PromQL(ctx, r.q.Query)
+	}, false)
+
+	// While backfilling, only Backfill records checkpoints. Otherwise a
+	// backfill that fails part way would not be resumed after a restart.
+	if ok && r.cp != nil && atomic.LoadInt32(&r.backfilling) == 0 {
+		r.cp.Record(r.q.ID(), now)
+	}
+}
+
+// ready reports whether the tick should be evaluated. It uses up one of
+// the ticks to skip.
+func (r *Reader) ready() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stopped {
+		return false
+	}
+
+	if r.skip > 0 {
+		r.skip--
+		return false
+	}
+
+	return true
+}
+
+func (r *Reader) isStopped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stopped
+}
+
+// Backfill evaluates the ticks that were missed since the query was last
+// evaluated, going back at most max. The results are flagged as
+// backfilled. It does nothing if the query does not want to be backfilled
+// or has never been evaluated. It stops at the first tick that fails so
+// that the next restart can pick up from there.
+//
+// Backfill may run while the reader ticks. It only covers the ticks
+// before it started.
+func (r *Reader) Backfill(interval, max time.Duration) {
+	if !r.q.Backfill || r.cp == nil || interval <= 0 {
 		return
 	}
 
-	if len(result.Data.Result) == 0 {
+	last, ok := r.cp.Last(r.q.ID())
+	if !ok {
 		return
 	}
 
-	for _, rr := range result.Data.Result {
-		data, err := json.Marshal(rr)
-		if err != nil {
-			r.log.Panicf("failed to marshal response: %s", err)
+	atomic.StoreInt32(&r.backfilling, 1)
+	defer atomic.StoreInt32(&r.backfilling, 0)
+
+	now := time.Now()
+	if oldest := now.Add(-max); last.Before(oldest) {
+		last = oldest
+	}
+
+	var backfilled int
+	for t := last.Add(interval); t.Before(now); t = t.Add(interval) {
+		if r.isStopped() {
+			return
+		}
+
+		ok := r.evaluate(func(ctx context.Context) (*faaspromql.QueryResult, error) {
+			return r.c.PromQLAt(ctx, r.q.Query, t)
+		}, true)
+
+		if !ok {
+			r.log.Printf("backfilling PromQL query %q stopped at %s", r.q.Query, t)
+			return
+		}
+
+		r.cp.Record(r.q.ID(), t)
+		backfilled++
+	}
+
+	if backfilled > 0 {
+		r.log.Printf("backfilled %d ticks for PromQL query %q", backfilled, r.q.Query)
+	}
+}
+
+// evaluate runs the query and POSTs a non-empty result. It reports whether
+// the result was delivered (or was empty).
+func (r *Reader) evaluate(
+	query func(context.Context) (*faaspromql.QueryResult, error),
+	backfilled bool,
+) bool {
+	d := r.q.Timeout
+	if d == 0 {
+		d = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	if r.a != nil {
+		if err := r.a.Authorize(ctx, r.q.Query); err != nil {
+			r.log.Printf("PromQL query %q is not allowed: %s", r.q.Query, err)
+			return false
+		}
+	}
+
+	result, err := query(ctx)
+	if err != nil {
+		if b, ok := err.(badQuery); ok && b.BadQuery() {
+			r.log.Printf("PromQL query %q is invalid and will not be retried: %s", r.q.Query, err)
+			r.mu.Lock()
+			r.stopped = true
+			r.mu.Unlock()
+			return false
+		}
+
+		// Only ticks back off. Backfill stops at the first failure anyway.
+		var skip int
+		if !backfilled {
+			skip = r.backOff()
 		}
-		result.Data.RawResult = append(result.Data.RawResult, json.RawMessage(data))
+
+		if isTimeout(ctx, err) {
+			atomic.AddUint64(&r.timeouts, 1)
+			r.log.Printf("PromQL query %q timed out after %s (skipping %d ticks): %s", r.q.Query, d, skip, err)
+			return false
+		}
+
+		r.log.Printf("failed to make PromQL query %q (skipping %d ticks): %s", r.q.Query, skip, err)
+		return false
 	}
+
+	if !backfilled {
+		r.mu.Lock()
+		r.failures = 0
+		r.mu.Unlock()
+	}
+
+	for _, w := range result.Warnings {
+		r.log.Printf("PromQL query %q returned a warning: %s", r.q.Query, w)
+	}
+
+	if len(result.Data.Result) == 0 {
+		return true
+	}
+
+	return r.deliver(result, backfilled)
+}
+
+// deliver enriches and POSTs the result. It has its own deadline rather
+// than whatever is left of the query's.
+func (r *Reader) deliver(result *faaspromql.QueryResult, backfilled bool) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), r.postTimeout)
+	defer cancel()
+
+	if r.e != nil {
+		r.e.Enrich(ctx, result)
+	}
+
 	result.Context = r.q.Context
-	data, err := json.Marshal(result)
+	result.Backfilled = backfilled
+	data, err := faaspromql.MarshalJSON(result)
 	if err != nil {
 		r.log.Panicf("failed to marshal response: %s", err)
 	}
 
-	req, err := http.NewRequest("POST", r.q.Path, bytes.NewReader(data))
-	if err != nil {
-		r.log.Panicf("failed to parse request: %s", err)
+	if err := delivery.Post(ctx, r.d, r.q.Path, data); err != nil {
+		if isTimeout(ctx, err) {
+			atomic.AddUint64(&r.timeouts, 1)
+		}
+		r.log.Printf("failed to deliver result: %s", err)
+		return false
 	}
 
-	resp, err := r.d.Do(req)
-	if err != nil {
-		r.log.Printf("failed to make POST: %s", err)
-		return
+	r.log.Println("successfully made POST")
+	return true
+}
+
+// backOff skips 2^(n-1)-1 ticks after the nth consecutive failure, so a
+// single failure does not skip any. It returns the number of ticks to
+// skip.
+func (r *Reader) backOff() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures++
+	r.skip = maxSkippedTicks
+	if r.failures <= 6 {
+		r.skip = 1<<(r.failures-1) - 1
 	}
 
-	defer func() {
-		io.Copy(ioutil.Discard, resp.Body)
-		resp.Body.Close()
-	}()
+	return r.skip
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		r.log.Printf("POST returned unexected status code %d: %s", resp.StatusCode, body)
-		return
+// Timeouts returns the number of ticks that ran out of time.
+func (r *Reader) Timeouts() uint64 {
+	return atomic.LoadUint64(&r.timeouts)
+}
+
+func isTimeout(ctx context.Context, err error) bool {
+	if t, ok := err.(timeout); ok && t.Timeout() {
+		return true
 	}
 
-	r.log.Println("successfully made POST")
+	return ctx.Err() == context.DeadlineExceeded
 }
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"testing"
+	"time"
 
 	faaspromql "github.com/poy/cf-faas-log-cache"
 	"github.com/poy/cf-faas-log-cache/internal/promql"
@@ -72,6 +73,30 @@ func TestReader(t *testing.T) {
 		Expect(t, r).To(MatchJSON(data))
 	})
 
+	o.Spec("it POSTs scalar results", func(t TR) {
+		t.spyPromQLClient.result = &faaspromql.QueryResult{
+			Status: "success",
+			Data: faaspromql.RawResult{
+				ResultType: "scalar",
+				Result: []interface{}{
+					&faaspromql.Scalar{Timestamp: "100", Value: "1.5"},
+				},
+			},
+		}
+		t.r.Tick()
+
+		Expect(t, t.spyDoer.req).To(Not(BeNil()))
+		r, err := ioutil.ReadAll(t.spyDoer.req.Body)
+		Expect(t, err).To(BeNil())
+
+		var result faaspromql.QueryResult
+		Expect(t, faaspromql.UnmarshalJSON(r, &result)).To(BeNil())
+		Expect(t, result.Context).To(Equal("some-context"))
+		Expect(t, result.Data.Result).To(Equal([]interface{}{
+			&faaspromql.Scalar{Timestamp: "100", Value: "1.5"},
+		}))
+	})
+
 	o.Spec("it does not POST for empty results", func(t TR) {
 		t.spyPromQLClient.result = &faaspromql.QueryResult{
 			Data: faaspromql.RawResult{},
@@ -92,11 +117,308 @@ func TestReader(t *testing.T) {
 		Expect(t, t.spyPromQLClient.ctx).To(Not(BeNil()))
 		Expect(t, t.spyDoer.req).To(BeNil())
 	})
+
+	o.Spec("it stops querying after a bad query", func(t TR) {
+		t.spyPromQLClient.err = stubError{badQuery: true}
+		t.r.Tick()
+		Expect(t, t.spyPromQLClient.ctx).To(Not(BeNil()))
+
+		t.spyPromQLClient.ctx = nil
+		t.r.Tick()
+		Expect(t, t.spyPromQLClient.ctx).To(BeNil())
+	})
+
+	o.Spec("it keeps querying after an error that is not a bad query", func(t TR) {
+		t.spyPromQLClient.err = stubError{}
+		t.r.Tick()
+		Expect(t, t.spyPromQLClient.ctx).To(Not(BeNil()))
+
+		t.spyPromQLClient.ctx = nil
+		t.r.Tick()
+		Expect(t, t.spyPromQLClient.ctx).To(Not(BeNil()))
+	})
+
+	o.Spec("it backs off after consecutive failures", func(t TR) {
+		t.spyPromQLClient.err = stubError{}
+
+		var queried []bool
+		for i := 0; i < 8; i++ {
+			t.spyPromQLClient.ctx = nil
+			t.r.Tick()
+			queried = append(queried, t.spyPromQLClient.ctx != nil)
+		}
+		Expect(t, queried).To(Equal([]bool{true, true, false, true, false, false, false, true}))
+
+		t.spyPromQLClient.err = nil
+		t.spyPromQLClient.result = &faaspromql.QueryResult{}
+		for i := 0; i < 8; i++ {
+			t.r.Tick()
+		}
+
+		t.spyPromQLClient.ctx = nil
+		t.r.Tick()
+		Expect(t, t.spyPromQLClient.ctx).To(Not(BeNil()))
+	})
+
+	o.Spec("it uses the query's timeout for the query", func(t TR) {
+		t.r = promql.NewReader(
+			web.Query{Path: "http://some.url/some-path", Query: "some-query", Timeout: time.Hour},
+			t.spyPromQLClient,
+			t.spyDoer,
+			log.New(ioutil.Discard, "", 0),
+		)
+		t.spyPromQLClient.result = &faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				Result: []interface{}{1},
+			},
+		}
+		t.r.Tick()
+
+		deadline, ok := t.spyPromQLClient.ctx.Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, deadline.After(time.Now().Add(time.Minute))).To(BeTrue())
+	})
+
+	o.Spec("it gives the POST its own timeout", func(t TR) {
+		t.r = promql.NewReader(
+			web.Query{Path: "http://some.url/some-path", Query: "some-query", Timeout: time.Millisecond},
+			t.spyPromQLClient,
+			t.spyDoer,
+			log.New(ioutil.Discard, "", 0),
+			promql.WithPostTimeout(time.Hour),
+		)
+		t.spyPromQLClient.result = &faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				Result: []interface{}{1},
+			},
+		}
+		t.r.Tick()
+
+		Expect(t, t.spyDoer.req).To(Not(BeNil()))
+		Expect(t, t.spyDoer.req.Context()).To(Not(Equal(t.spyPromQLClient.ctx)))
+
+		deadline, ok := t.spyDoer.req.Context().Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, deadline.After(time.Now().Add(time.Minute))).To(BeTrue())
+	})
+
+	o.Spec("it uses the default timeout", func(t TR) {
+		t.spyPromQLClient.result = &faaspromql.QueryResult{}
+		t.r.Tick()
+
+		deadline, ok := t.spyPromQLClient.ctx.Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, deadline.Before(time.Now().Add(promql.DefaultTimeout))).To(BeTrue())
+	})
+
+	o.Spec("it counts timeouts", func(t TR) {
+		t.spyPromQLClient.err = stubError{timeout: true}
+		t.r.Tick()
+		t.r.Tick()
+		Expect(t, t.r.Timeouts()).To(Equal(uint64(2)))
+
+		t.spyPromQLClient.err = stubError{}
+		t.r.Tick()
+		Expect(t, t.r.Timeouts()).To(Equal(uint64(2)))
+	})
+
+	o.Spec("it records a checkpoint after a successful tick", func(t TR) {
+		spyCheckpointer := newSpyCheckpointer()
+		q := web.Query{Path: "http://some.url/some-path", Query: "some-query"}
+		t.r = promql.NewReader(q, t.spyPromQLClient, t.spyDoer, log.New(ioutil.Discard, "", 0), promql.WithCheckpointer(spyCheckpointer))
+		t.spyPromQLClient.result = &faaspromql.QueryResult{}
+
+		before := time.Now()
+		t.r.Tick()
+
+		last, ok := spyCheckpointer.Last(q.ID())
+		Expect(t, ok).To(BeTrue())
+		Expect(t, last.Before(before)).To(BeFalse())
+	})
+
+	o.Spec("it does not record a checkpoint after a failed tick", func(t TR) {
+		spyCheckpointer := newSpyCheckpointer()
+		q := web.Query{Path: "http://some.url/some-path", Query: "some-query"}
+		t.r = promql.NewReader(q, t.spyPromQLClient, t.spyDoer, log.New(ioutil.Discard, "", 0), promql.WithCheckpointer(spyCheckpointer))
+		t.spyPromQLClient.err = errors.New("some-error")
+
+		t.r.Tick()
+
+		_, ok := spyCheckpointer.Last(q.ID())
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("it backfills the missed ticks", func(t TR) {
+		spyCheckpointer := newSpyCheckpointer()
+		q := web.Query{Path: "http://some.url/some-path", Query: "some-query", Backfill: true}
+		last := time.Now().Add(-3500 * time.Millisecond)
+		spyCheckpointer.Record(q.ID(), last)
+
+		t.r = promql.NewReader(q, t.spyPromQLClient, t.spyDoer, log.New(ioutil.Discard, "", 0), promql.WithCheckpointer(spyCheckpointer))
+		t.spyPromQLClient.result = &faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				Result: []interface{}{1},
+			},
+		}
+		t.spyDoer.resp = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+
+		t.r.Backfill(time.Second, time.Hour)
+
+		Expect(t, t.spyPromQLClient.times).To(Equal([]time.Time{
+			last.Add(time.Second),
+			last.Add(2 * time.Second),
+			last.Add(3 * time.Second),
+		}))
+
+		body, err := ioutil.ReadAll(t.spyDoer.req.Body)
+		Expect(t, err).To(BeNil())
+		var result struct {
+			Backfilled bool `json:"backfilled"`
+		}
+		Expect(t, json.Unmarshal(body, &result)).To(BeNil())
+		Expect(t, result.Backfilled).To(BeTrue())
+
+		checkpoint, _ := spyCheckpointer.Last(q.ID())
+		Expect(t, checkpoint).To(Equal(last.Add(3 * time.Second)))
+	})
+
+	o.Spec("it only backfills up to the max", func(t TR) {
+		spyCheckpointer := newSpyCheckpointer()
+		q := web.Query{Path: "http://some.url/some-path", Query: "some-query", Backfill: true}
+		spyCheckpointer.Record(q.ID(), time.Now().Add(-time.Hour))
+
+		t.r = promql.NewReader(q, t.spyPromQLClient, t.spyDoer, log.New(ioutil.Discard, "", 0), promql.WithCheckpointer(spyCheckpointer))
+		t.spyPromQLClient.result = &faaspromql.QueryResult{}
+
+		t.r.Backfill(time.Second, 2500*time.Millisecond)
+
+		Expect(t, t.spyPromQLClient.times).To(HaveLen(2))
+	})
+
+	o.Spec("it stops backfilling at the first failure", func(t TR) {
+		spyCheckpointer := newSpyCheckpointer()
+		q := web.Query{Path: "http://some.url/some-path", Query: "some-query", Backfill: true}
+		last := time.Now().Add(-3500 * time.Millisecond)
+		spyCheckpointer.Record(q.ID(), last)
+
+		t.r = promql.NewReader(q, t.spyPromQLClient, t.spyDoer, log.New(ioutil.Discard, "", 0), promql.WithCheckpointer(spyCheckpointer))
+		t.spyPromQLClient.err = errors.New("some-error")
+
+		t.r.Backfill(time.Second, time.Hour)
+
+		Expect(t, t.spyPromQLClient.times).To(HaveLen(1))
+		checkpoint, _ := spyCheckpointer.Last(q.ID())
+		Expect(t, checkpoint).To(Equal(last))
+	})
+
+	o.Spec("it does not backfill queries that did not ask for it", func(t TR) {
+		spyCheckpointer := newSpyCheckpointer()
+		q := web.Query{Path: "http://some.url/some-path", Query: "some-query"}
+		spyCheckpointer.Record(q.ID(), time.Now().Add(-time.Hour))
+
+		t.r = promql.NewReader(q, t.spyPromQLClient, t.spyDoer, log.New(ioutil.Discard, "", 0), promql.WithCheckpointer(spyCheckpointer))
+		t.r.Backfill(time.Second, time.Hour)
+
+		Expect(t, t.spyPromQLClient.times).To(HaveLen(0))
+	})
+
+	o.Spec("it authorizes the query before each evaluation", func(t TR) {
+		spyAuthorizer := &spyAuthorizer{}
+		q := web.Query{Path: "http://some.url/some-path", Query: "some-query"}
+		t.r = promql.NewReader(q, t.spyPromQLClient, t.spyDoer, log.New(ioutil.Discard, "", 0), promql.WithAuthorizer(spyAuthorizer))
+		t.spyPromQLClient.result = &faaspromql.QueryResult{}
+
+		t.r.Tick()
+		t.r.Tick()
+
+		Expect(t, spyAuthorizer.queries).To(Equal([]string{"some-query", "some-query"}))
+		Expect(t, t.spyPromQLClient.query).To(Equal("some-query"))
+	})
+
+	o.Spec("it does not evaluate a query that is not allowed", func(t TR) {
+		spyAuthorizer := &spyAuthorizer{err: errors.New("some-error")}
+		q := web.Query{Path: "http://some.url/some-path", Query: "some-query"}
+		t.r = promql.NewReader(q, t.spyPromQLClient, t.spyDoer, log.New(ioutil.Discard, "", 0), promql.WithAuthorizer(spyAuthorizer))
+
+		t.r.Tick()
+
+		Expect(t, t.spyPromQLClient.query).To(Equal(""))
+		Expect(t, t.spyDoer.req).To(BeNil())
+	})
+
+	o.Spec("it enriches the result before POSTing it", func(t TR) {
+		spyEnricher := &spyEnricher{}
+		q := web.Query{Path: "http://some.url/some-path", Query: "some-query"}
+		t.r = promql.NewReader(q, t.spyPromQLClient, t.spyDoer, log.New(ioutil.Discard, "", 0), promql.WithEnricher(spyEnricher))
+		t.spyPromQLClient.result = &faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				Result: []interface{}{1},
+			},
+		}
+
+		t.r.Tick()
+
+		Expect(t, spyEnricher.result).To(Equal(t.spyPromQLClient.result))
+		Expect(t, spyEnricher.ctx).To(Not(BeNil()))
+		Expect(t, t.spyDoer.req).To(Not(BeNil()))
+	})
+
+	o.Spec("it does not enrich an empty result", func(t TR) {
+		spyEnricher := &spyEnricher{}
+		q := web.Query{Path: "http://some.url/some-path", Query: "some-query"}
+		t.r = promql.NewReader(q, t.spyPromQLClient, t.spyDoer, log.New(ioutil.Discard, "", 0), promql.WithEnricher(spyEnricher))
+		t.spyPromQLClient.result = &faaspromql.QueryResult{}
+
+		t.r.Tick()
+
+		Expect(t, spyEnricher.result).To(BeNil())
+	})
+}
+
+type spyAuthorizer struct {
+	queries []string
+	err     error
+}
+
+func (s *spyAuthorizer) Authorize(ctx context.Context, query string) error {
+	s.queries = append(s.queries, query)
+	return s.err
+}
+
+type spyEnricher struct {
+	ctx    context.Context
+	result *faaspromql.QueryResult
+}
+
+func (s *spyEnricher) Enrich(ctx context.Context, result *faaspromql.QueryResult) {
+	s.ctx = ctx
+	s.result = result
+}
+
+type stubError struct {
+	badQuery bool
+	timeout  bool
+}
+
+func (e stubError) Error() string {
+	return "some-error"
+}
+
+func (e stubError) BadQuery() bool {
+	return e.badQuery
+}
+
+func (e stubError) Timeout() bool {
+	return e.timeout
 }
 
 type spyPromQLClient struct {
 	ctx    context.Context
 	query  string
+	times  []time.Time
 	result *faaspromql.QueryResult
 	err    error
 }
@@ -112,6 +434,38 @@ func (s *spyPromQLClient) PromQL(ctx context.Context, query string) (*faaspromql
 	return s.result, s.err
 }
 
+func (s *spyPromQLClient) PromQLAt(ctx context.Context, query string, t time.Time) (*faaspromql.QueryResult, error) {
+	s.times = append(s.times, t)
+	result, err := s.PromQL(ctx, query)
+	if result == nil {
+		return nil, err
+	}
+
+	// Each evaluation gets its own result like it would from a real
+	// client.
+	cp := *result
+	return &cp, err
+}
+
+type spyCheckpointer struct {
+	last map[string]time.Time
+}
+
+func newSpyCheckpointer() *spyCheckpointer {
+	return &spyCheckpointer{
+		last: make(map[string]time.Time),
+	}
+}
+
+func (s *spyCheckpointer) Record(id string, t time.Time) {
+	s.last[id] = t
+}
+
+func (s *spyCheckpointer) Last(id string) (time.Time, bool) {
+	t, ok := s.last[id]
+	return t, ok
+}
+
 type spyDoer struct {
 	req  *http.Request
 	resp *http.Response
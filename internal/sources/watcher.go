@@ -0,0 +1,318 @@
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/go-log-cache/rpc/logcache_v1"
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/internal/capi"
+	"github.com/poy/cf-faas-log-cache/internal/delivery"
+	"github.com/poy/cf-faas-log-cache/internal/web"
+)
+
+// Watcher delivers the changes of a sources event. Each Tick lists the
+// sources Log Cache has and POSTs those that appeared or went stale since
+// the previous one.
+type Watcher struct {
+	q   web.Query
+	l   SourceLister
+	n   SourceNamer
+	d   Doer
+	log *log.Logger
+	a   SourceAuthorizer
+
+	// active are the sources of the last delivered snapshot. It is nil
+	// until the first snapshot, which is only used as the baseline.
+	active map[string]bool
+
+	// denied are the sources that may not be read and when to check them
+	// again.
+	denied    map[string]time.Time
+	denialTTL time.Duration
+
+	postTimeout time.Duration
+
+	timeouts uint64
+}
+
+// DefaultTimeout is used for sources events that don't set their own
+// timeout.
+const DefaultTimeout = 5 * time.Second
+
+// DefaultStaleAfter is used for sources events that don't set their own
+// StaleAfter.
+const DefaultStaleAfter = 5 * time.Minute
+
+// DefaultPostTimeout is how long a function has to handle the changes.
+const DefaultPostTimeout = 30 * time.Second
+
+// SourceLister lists the sources Log Cache has (e.g.,
+// pkg/promql.LogCacheReader).
+type SourceLister interface {
+	Meta(ctx context.Context) (map[string]*logcache_v1.MetaInfo, error)
+}
+
+// SourceNamer looks up the names of a source ID (e.g., capi.SourceNamer).
+type SourceNamer interface {
+	Names(ctx context.Context, sourceID string) (capi.SourceNames, error)
+}
+
+// SourceAuthorizer returns an error if the source may not be read (e.g.,
+// access.Authorizer). An error that has a Denied method returning true
+// means that the source may not be read. Any other error means that it
+// could not be checked.
+type SourceAuthorizer interface {
+	AuthorizeSource(ctx context.Context, sourceID string) error
+}
+
+type denied interface {
+	Denied() bool
+}
+
+// DefaultDenialTTL is how long a source that may not be read is remembered
+// by default.
+const DefaultDenialTTL = 10 * time.Minute
+
+type Doer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// WatcherOption configures a Watcher.
+type WatcherOption func(*Watcher)
+
+// WithAuthorizer only reports the sources that may be read. Others are
+// treated as if Log Cache did not have them. While a source can not be
+// checked, its state is unknown and nothing is reported (or used as the
+// baseline) until it can be.
+func WithAuthorizer(a SourceAuthorizer) WatcherOption {
+	return func(w *Watcher) {
+		w.a = a
+	}
+}
+
+// WithDenialTTL sets how long a source that may not be read is remembered
+// before it is checked again. Defaults to DefaultDenialTTL.
+func WithDenialTTL(d time.Duration) WatcherOption {
+	return func(w *Watcher) {
+		w.denialTTL = d
+	}
+}
+
+// WithPostTimeout sets how long a function has to handle the changes. The
+// POST has its own deadline, so slow lookups do not cut it short. Defaults
+// to DefaultPostTimeout.
+func WithPostTimeout(d time.Duration) WatcherOption {
+	return func(w *Watcher) {
+		w.postTimeout = d
+	}
+}
+
+// NewWatcher returns a Watcher for the sources event q (q.Sources must be
+// set). The snapshot is not saved, so the sources that change while the
+// service restarts are not reported.
+func NewWatcher(
+	q web.Query,
+	l SourceLister,
+	n SourceNamer,
+	d Doer,
+	log *log.Logger,
+	opts ...WatcherOption,
+) *Watcher {
+	w := &Watcher{
+		q:         q,
+		l:         l,
+		n:         n,
+		d:         d,
+		log:       log,
+		denied:    make(map[string]time.Time),
+		denialTTL: DefaultDenialTTL,
+
+		postTimeout: DefaultPostTimeout,
+	}
+
+	for _, o := range opts {
+		o(w)
+	}
+
+	return w
+}
+
+func (w *Watcher) Tick() {
+	d := w.q.Timeout
+	if d == 0 {
+		d = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	meta, err := w.l.Meta(ctx)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&w.timeouts, 1)
+		}
+		w.log.Printf("failed to list sources: %s", err)
+		return
+	}
+
+	active, unknown := w.activeSources(ctx, meta)
+	if len(unknown) > 0 {
+		// Leaving them out would report them as stale (or as appeared
+		// once they are checked).
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&w.timeouts, 1)
+		}
+		w.log.Printf("access to %d sources could not be checked, skipping changes", len(unknown))
+		return
+	}
+
+	if w.active == nil {
+		w.active = active
+		return
+	}
+
+	changes := faaspromql.SourceChanges{
+		Context: w.q.Context,
+	}
+	for _, sourceID := range diff(active, w.active) {
+		changes.Appeared = append(changes.Appeared, w.source(ctx, sourceID))
+	}
+	for _, sourceID := range diff(w.active, active) {
+		changes.Stale = append(changes.Stale, w.source(ctx, sourceID))
+	}
+
+	if len(changes.Appeared) == 0 && len(changes.Stale) == 0 {
+		return
+	}
+
+	if !w.post(changes) {
+		// The next tick diffs against the same snapshot.
+		return
+	}
+
+	w.active = active
+}
+
+// activeSources returns the sources that have emitted within StaleAfter and
+// may be read along with those that could not be checked.
+func (w *Watcher) activeSources(ctx context.Context, meta map[string]*logcache_v1.MetaInfo) (active, unknown map[string]bool) {
+	staleAfter := w.q.Sources.StaleAfter
+	if staleAfter <= 0 {
+		staleAfter = DefaultStaleAfter
+	}
+	oldest := time.Now().Add(-staleAfter).UnixNano()
+
+	active = make(map[string]bool)
+	unknown = make(map[string]bool)
+	for sourceID, m := range meta {
+		if m.GetNewestTimestamp() < oldest {
+			continue
+		}
+
+		if w.a != nil {
+			allowed, err := w.allowed(ctx, sourceID)
+			if err != nil {
+				w.log.Printf("failed to check access to source %s: %s", sourceID, err)
+				unknown[sourceID] = true
+				continue
+			}
+
+			if !allowed {
+				continue
+			}
+		}
+
+		active[sourceID] = true
+	}
+
+	return active, unknown
+}
+
+// allowed reports whether the source may be read. It returns an error if
+// the source could not be checked.
+func (w *Watcher) allowed(ctx context.Context, sourceID string) (bool, error) {
+	now := time.Now()
+	if until, ok := w.denied[sourceID]; ok {
+		if now.Before(until) {
+			return false, nil
+		}
+		delete(w.denied, sourceID)
+	}
+
+	err := w.a.AuthorizeSource(ctx, sourceID)
+	if err == nil {
+		return true, nil
+	}
+
+	if d, ok := err.(denied); ok && d.Denied() {
+		w.denied[sourceID] = now.Add(w.denialTTL)
+		return false, nil
+	}
+
+	return false, err
+}
+
+// diff returns the sorted source IDs that are in a but not in b.
+func diff(a, b map[string]bool) []string {
+	var sourceIDs []string
+	for sourceID := range a {
+		if !b[sourceID] {
+			sourceIDs = append(sourceIDs, sourceID)
+		}
+	}
+	sort.Strings(sourceIDs)
+
+	return sourceIDs
+}
+
+// source names the source. A source that is not an app or a service
+// instance (e.g., a platform component) only has its source ID.
+func (w *Watcher) source(ctx context.Context, sourceID string) faaspromql.Source {
+	s := faaspromql.Source{
+		SourceID: sourceID,
+	}
+
+	names, err := w.n.Names(ctx, sourceID)
+	if err != nil {
+		return s
+	}
+
+	s.AppName = names.App
+	s.ServiceInstanceName = names.ServiceInstance
+	s.SpaceName = names.Space
+	s.OrgName = names.Org
+
+	return s
+}
+
+// post delivers the changes and reports whether the function accepted them.
+func (w *Watcher) post(changes faaspromql.SourceChanges) bool {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		w.log.Panicf("failed to marshal source changes: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.postTimeout)
+	defer cancel()
+
+	if err := delivery.Post(ctx, w.d, w.q.Path, data); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&w.timeouts, 1)
+		}
+		w.log.Printf("failed to deliver source changes: %s", err)
+		return false
+	}
+
+	return true
+}
+
+// Timeouts returns the number of ticks that ran out of time.
+func (w *Watcher) Timeouts() uint64 {
+	return atomic.LoadUint64(&w.timeouts)
+}
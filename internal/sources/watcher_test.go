@@ -0,0 +1,350 @@
+package sources_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/go-log-cache/rpc/logcache_v1"
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/internal/access"
+	"github.com/poy/cf-faas-log-cache/internal/capi"
+	"github.com/poy/cf-faas-log-cache/internal/sources"
+	"github.com/poy/cf-faas-log-cache/internal/web"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TW struct {
+	*testing.T
+	w               *sources.Watcher
+	spySourceLister *spySourceLister
+	spySourceNamer  *spySourceNamer
+	spyDoer         *spyDoer
+}
+
+func TestWatcher(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TW {
+		spySourceLister := &spySourceLister{}
+		spySourceNamer := &spySourceNamer{
+			names: map[string]capi.SourceNames{
+				"some-guid": {App: "some-app", Space: "some-space", Org: "some-org"},
+			},
+		}
+		spyDoer := &spyDoer{status: http.StatusOK}
+
+		return TW{
+			T: t,
+			w: sources.NewWatcher(
+				web.Query{
+					Path:    "http://some.url/some-path",
+					Context: "some-context",
+					Sources: &web.SourceFilter{StaleAfter: time.Minute},
+				},
+				spySourceLister,
+				spySourceNamer,
+				spyDoer,
+				log.New(ioutil.Discard, "", 0),
+			),
+			spySourceLister: spySourceLister,
+			spySourceNamer:  spySourceNamer,
+			spyDoer:         spyDoer,
+		}
+	})
+
+	o.Spec("it only uses the first snapshot as the baseline", func(t TW) {
+		t.spySourceLister.meta = meta("some-guid", "other-guid")
+
+		t.w.Tick()
+		t.w.Tick()
+
+		Expect(t, t.spyDoer.changes).To(HaveLen(0))
+	})
+
+	o.Spec("it POSTs the sources that appear", func(t TW) {
+		t.spySourceLister.meta = meta("other-guid")
+		t.w.Tick()
+
+		t.spySourceLister.meta = meta("other-guid", "some-guid", "platform")
+		t.w.Tick()
+
+		Expect(t, t.spyDoer.urls).To(Equal([]string{"http://some.url/some-path"}))
+		Expect(t, t.spyDoer.changes).To(Equal([]faaspromql.SourceChanges{
+			{
+				Context: "some-context",
+				Appeared: []faaspromql.Source{
+					{SourceID: "platform"},
+					{SourceID: "some-guid", AppName: "some-app", SpaceName: "some-space", OrgName: "some-org"},
+				},
+			},
+		}))
+
+		t.w.Tick()
+		Expect(t, t.spyDoer.changes).To(HaveLen(1))
+	})
+
+	o.Spec("it POSTs the sources that go stale", func(t TW) {
+		t.spySourceLister.meta = meta("some-guid", "other-guid", "platform")
+		t.w.Tick()
+
+		t.spySourceLister.meta = meta("other-guid", "platform")
+		t.spySourceLister.meta["platform"].NewestTimestamp = time.Now().Add(-time.Hour).UnixNano()
+		t.w.Tick()
+
+		Expect(t, t.spyDoer.changes).To(HaveLen(1))
+		Expect(t, t.spyDoer.changes[0].Appeared).To(HaveLen(0))
+		Expect(t, t.spyDoer.changes[0].Stale).To(Equal([]faaspromql.Source{
+			{SourceID: "platform"},
+			{SourceID: "some-guid", AppName: "some-app", SpaceName: "some-space", OrgName: "some-org"},
+		}))
+	})
+
+	o.Spec("it POSTs the changes again if the POST fails", func(t TW) {
+		t.spySourceLister.meta = meta()
+		t.w.Tick()
+
+		t.spySourceLister.meta = meta("some-guid")
+		t.spyDoer.status = http.StatusInternalServerError
+		t.w.Tick()
+
+		t.spyDoer.status = http.StatusOK
+		t.w.Tick()
+
+		Expect(t, t.spyDoer.attempts).To(Equal(2))
+		Expect(t, t.spyDoer.changes).To(HaveLen(1))
+		Expect(t, t.spyDoer.changes[0].Appeared).To(HaveLen(1))
+	})
+
+	o.Spec("it gives the POST its own timeout", func(t TW) {
+		t.w = sources.NewWatcher(
+			web.Query{Path: "http://some.url/some-path", Sources: &web.SourceFilter{}, Timeout: time.Millisecond},
+			t.spySourceLister,
+			t.spySourceNamer,
+			t.spyDoer,
+			log.New(ioutil.Discard, "", 0),
+			sources.WithPostTimeout(time.Hour),
+		)
+		t.spySourceLister.meta = meta()
+		t.w.Tick()
+
+		t.spySourceLister.meta = meta("some-guid")
+		t.w.Tick()
+
+		Expect(t, t.spyDoer.changes).To(HaveLen(1))
+		deadline, ok := t.spyDoer.ctx.Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, deadline.After(time.Now().Add(time.Minute))).To(BeTrue())
+	})
+
+	o.Spec("it only reports the sources that may be read", func(t TW) {
+		spyAuthorizer := &spyAuthorizer{allowed: map[string]bool{"some-guid": true}}
+		t.w = sources.NewWatcher(
+			web.Query{Path: "http://some.url/some-path", Sources: &web.SourceFilter{}},
+			t.spySourceLister,
+			t.spySourceNamer,
+			t.spyDoer,
+			log.New(ioutil.Discard, "", 0),
+			sources.WithAuthorizer(spyAuthorizer),
+		)
+
+		t.spySourceLister.meta = meta()
+		t.w.Tick()
+
+		t.spySourceLister.meta = meta("some-guid", "other-guid")
+		t.w.Tick()
+
+		Expect(t, t.spyDoer.changes).To(HaveLen(1))
+		Expect(t, t.spyDoer.changes[0].Appeared).To(HaveLen(1))
+		Expect(t, t.spyDoer.changes[0].Appeared[0].SourceID).To(Equal("some-guid"))
+	})
+
+	o.Spec("it remembers the sources that may not be read", func(t TW) {
+		spyAuthorizer := &spyAuthorizer{}
+		t.w = sources.NewWatcher(
+			web.Query{Path: "http://some.url/some-path", Sources: &web.SourceFilter{}},
+			t.spySourceLister,
+			t.spySourceNamer,
+			t.spyDoer,
+			log.New(ioutil.Discard, "", 0),
+			sources.WithAuthorizer(spyAuthorizer),
+		)
+
+		t.spySourceLister.meta = meta("other-guid")
+		t.w.Tick()
+		t.w.Tick()
+
+		Expect(t, spyAuthorizer.sourceIDs).To(Equal([]string{"other-guid"}))
+	})
+
+	o.Spec("it checks denied sources again after the TTL", func(t TW) {
+		spyAuthorizer := &spyAuthorizer{}
+		t.w = sources.NewWatcher(
+			web.Query{Path: "http://some.url/some-path", Sources: &web.SourceFilter{}},
+			t.spySourceLister,
+			t.spySourceNamer,
+			t.spyDoer,
+			log.New(ioutil.Discard, "", 0),
+			sources.WithAuthorizer(spyAuthorizer),
+			sources.WithDenialTTL(time.Nanosecond),
+		)
+
+		t.spySourceLister.meta = meta("other-guid")
+		t.w.Tick()
+		time.Sleep(time.Millisecond)
+		t.w.Tick()
+
+		Expect(t, spyAuthorizer.sourceIDs).To(HaveLen(2))
+	})
+
+	o.Spec("it does not report changes while a source can not be checked", func(t TW) {
+		spyAuthorizer := &spyAuthorizer{allowed: map[string]bool{"some-guid": true}}
+		t.w = sources.NewWatcher(
+			web.Query{Path: "http://some.url/some-path", Sources: &web.SourceFilter{}},
+			t.spySourceLister,
+			t.spySourceNamer,
+			t.spyDoer,
+			log.New(ioutil.Discard, "", 0),
+			sources.WithAuthorizer(spyAuthorizer),
+		)
+
+		t.spySourceLister.meta = meta("some-guid")
+		t.w.Tick()
+
+		spyAuthorizer.err = errors.New("some-error")
+		t.w.Tick()
+		Expect(t, t.spyDoer.attempts).To(Equal(0))
+
+		spyAuthorizer.err = nil
+		t.w.Tick()
+		Expect(t, t.spyDoer.attempts).To(Equal(0))
+	})
+
+	o.Spec("it does not use a snapshot with unchecked sources as the baseline", func(t TW) {
+		spyAuthorizer := &spyAuthorizer{allowed: map[string]bool{"some-guid": true, "other-guid": true}}
+		t.w = sources.NewWatcher(
+			web.Query{Path: "http://some.url/some-path", Sources: &web.SourceFilter{}},
+			t.spySourceLister,
+			t.spySourceNamer,
+			t.spyDoer,
+			log.New(ioutil.Discard, "", 0),
+			sources.WithAuthorizer(spyAuthorizer),
+		)
+
+		t.spySourceLister.meta = meta("some-guid")
+		spyAuthorizer.err = context.DeadlineExceeded
+		t.w.Tick()
+
+		spyAuthorizer.err = nil
+		t.w.Tick()
+		Expect(t, t.spyDoer.attempts).To(Equal(0))
+
+		t.spySourceLister.meta = meta("some-guid", "other-guid")
+		t.w.Tick()
+		Expect(t, t.spyDoer.changes).To(HaveLen(1))
+		Expect(t, t.spyDoer.changes[0].Appeared).To(Equal([]faaspromql.Source{
+			{SourceID: "other-guid"},
+		}))
+	})
+
+	o.Spec("it does not POST if listing fails", func(t TW) {
+		t.spySourceLister.meta = meta()
+		t.w.Tick()
+
+		t.spySourceLister.err = errors.New("some-error")
+		t.w.Tick()
+
+		Expect(t, t.spyDoer.attempts).To(Equal(0))
+	})
+}
+
+func meta(sourceIDs ...string) map[string]*logcache_v1.MetaInfo {
+	m := make(map[string]*logcache_v1.MetaInfo)
+	for _, sourceID := range sourceIDs {
+		m[sourceID] = &logcache_v1.MetaInfo{
+			NewestTimestamp: time.Now().UnixNano(),
+		}
+	}
+
+	return m
+}
+
+type spySourceLister struct {
+	meta map[string]*logcache_v1.MetaInfo
+	err  error
+}
+
+func (s *spySourceLister) Meta(ctx context.Context) (map[string]*logcache_v1.MetaInfo, error) {
+	return s.meta, s.err
+}
+
+type spySourceNamer struct {
+	names map[string]capi.SourceNames
+}
+
+func (s *spySourceNamer) Names(ctx context.Context, sourceID string) (capi.SourceNames, error) {
+	names, ok := s.names[sourceID]
+	if !ok {
+		return capi.SourceNames{}, errors.New("some-error")
+	}
+
+	return names, nil
+}
+
+type spyAuthorizer struct {
+	allowed   map[string]bool
+	err       error
+	sourceIDs []string
+}
+
+func (s *spyAuthorizer) AuthorizeSource(ctx context.Context, sourceID string) error {
+	s.sourceIDs = append(s.sourceIDs, sourceID)
+
+	if s.err != nil {
+		return s.err
+	}
+
+	if !s.allowed[sourceID] {
+		return &access.Error{SourceID: sourceID}
+	}
+
+	return nil
+}
+
+type spyDoer struct {
+	urls     []string
+	changes  []faaspromql.SourceChanges
+	attempts int
+	status   int
+	ctx      context.Context
+}
+
+func (s *spyDoer) Do(req *http.Request) (*http.Response, error) {
+	s.attempts++
+	s.ctx = req.Context()
+
+	var c faaspromql.SourceChanges
+	if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+		panic(err)
+	}
+
+	if s.status == http.StatusOK {
+		s.urls = append(s.urls, req.URL.String())
+		s.changes = append(s.changes, c)
+	}
+
+	return &http.Response{
+		StatusCode: s.status,
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}, nil
+}
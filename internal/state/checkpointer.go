@@ -0,0 +1,112 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CheckpointsEnv is the environment variable the checkpoints are saved in.
+// The container's disk does not survive a restart, the app's environment
+// does.
+const CheckpointsEnv = "CHECKPOINTS"
+
+// Checkpoints maps a query ID to the time (in unix nanoseconds) it was last
+// evaluated.
+type Checkpoints map[string]int64
+
+func (c *Checkpoints) UnmarshalEnv(data string) error {
+	if data == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(data), c)
+}
+
+// Checkpointer records when each query was last evaluated so the ticks that
+// were missed while the app was down can be backfilled.
+type Checkpointer struct {
+	appGuid string
+	c       CapiClient
+
+	mu    sync.Mutex
+	last  Checkpoints
+	dirty bool
+}
+
+// NewCheckpointer returns a Checkpointer that starts with the given
+// checkpoints (typically loaded from CheckpointsEnv).
+func NewCheckpointer(appGuid string, c CapiClient, initial Checkpoints) *Checkpointer {
+	last := Checkpoints{}
+	for k, v := range initial {
+		last[k] = v
+	}
+
+	return &Checkpointer{
+		appGuid: appGuid,
+		c:       c,
+		last:    last,
+	}
+}
+
+// Record sets the last evaluation time for the query.
+func (c *Checkpointer) Record(id string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t.UnixNano() <= c.last[id] {
+		return
+	}
+
+	c.last[id] = t.UnixNano()
+	c.dirty = true
+}
+
+// Last returns the last evaluation time for the query.
+func (c *Checkpointer) Last(id string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ts, ok := c.last[id]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, ts), true
+}
+
+// EnvironmentVariables returns the checkpoints as environment variables.
+func (c *Checkpointer) EnvironmentVariables() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.Marshal(c.last)
+	if err != nil {
+		// This can't happen with a map[string]int64.
+		panic(err)
+	}
+
+	return map[string]string{CheckpointsEnv: string(data)}
+}
+
+// Flush saves the checkpoints if any have changed since the last Flush.
+func (c *Checkpointer) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	dirty := c.dirty
+	c.dirty = false
+	c.mu.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	if err := c.c.SetEnvironmentVariables(ctx, c.appGuid, c.EnvironmentVariables()); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return fmt.Errorf("saving checkpoints failed: %s", err)
+	}
+
+	return nil
+}
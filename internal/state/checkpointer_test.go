@@ -0,0 +1,83 @@
+package state_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache/internal/state"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TC struct {
+	*testing.T
+	c             *state.Checkpointer
+	spyCapiClient *spyCapiClient
+}
+
+func TestCheckpointer(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyCapiClient := newSpyCapiClient()
+		return TC{
+			T:             t,
+			c:             state.NewCheckpointer("some-guid", spyCapiClient, state.Checkpoints{"a": 99}),
+			spyCapiClient: spyCapiClient,
+		}
+	})
+
+	o.Spec("it starts with the initial checkpoints", func(t TC) {
+		last, ok := t.c.Last("a")
+		Expect(t, ok).To(BeTrue())
+		Expect(t, last).To(Equal(time.Unix(0, 99)))
+
+		_, ok = t.c.Last("b")
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("it records the latest evaluation", func(t TC) {
+		t.c.Record("a", time.Unix(0, 100))
+		t.c.Record("a", time.Unix(0, 50))
+
+		last, _ := t.c.Last("a")
+		Expect(t, last).To(Equal(time.Unix(0, 100)))
+	})
+
+	o.Spec("it flushes the checkpoints to the environment", func(t TC) {
+		t.c.Record("b", time.Unix(0, 100))
+		Expect(t, t.c.Flush(context.Background())).To(BeNil())
+
+		Expect(t, t.spyCapiClient.setEnvAppGuid).To(Equal("some-guid"))
+		Expect(t, t.spyCapiClient.setEnvVars[state.CheckpointsEnv]).To(MatchJSON(`{"a":99,"b":100}`))
+	})
+
+	o.Spec("it only flushes when something changed", func(t TC) {
+		Expect(t, t.c.Flush(context.Background())).To(BeNil())
+		Expect(t, t.spyCapiClient.setEnvVars).To(BeNil())
+	})
+
+	o.Spec("it flushes again after a failure", func(t TC) {
+		t.c.Record("b", time.Unix(0, 100))
+		t.spyCapiClient.setEnvErr = errors.New("some-error")
+		Expect(t, t.c.Flush(context.Background())).To(Not(BeNil()))
+
+		t.spyCapiClient.setEnvErr = nil
+		t.spyCapiClient.setEnvVars = nil
+		Expect(t, t.c.Flush(context.Background())).To(BeNil())
+		Expect(t, t.spyCapiClient.setEnvVars).To(Not(BeNil()))
+	})
+
+	o.Spec("it unmarshals checkpoints from the environment", func(t TC) {
+		var c state.Checkpoints
+		Expect(t, c.UnmarshalEnv(`{"a":1}`)).To(BeNil())
+		Expect(t, c).To(Equal(state.Checkpoints{"a": 1}))
+
+		Expect(t, c.UnmarshalEnv(`invalid`)).To(Not(BeNil()))
+	})
+}
@@ -20,14 +20,48 @@ type Saver struct {
 	appGuid string
 	c       CapiClient
 	log     *log.Logger
+	timeout time.Duration
+	envs    []EnvironmentProvider
 }
 
-func NewSaver(appGuid string, c CapiClient, log *log.Logger) *Saver {
-	return &Saver{
+// EnvironmentProvider has state (e.g., a Checkpointer) that has to be saved
+// before the app restarts.
+type EnvironmentProvider interface {
+	EnvironmentVariables() map[string]string
+}
+
+// SaverOption configures a Saver.
+type SaverOption func(*Saver)
+
+// WithTimeout sets how long saving the state and restarting the app may
+// take. Defaults to 5 seconds.
+func WithTimeout(d time.Duration) SaverOption {
+	return func(s *Saver) {
+		s.timeout = d
+	}
+}
+
+// WithEnvironment saves the provider's environment variables along with the
+// queries.
+func WithEnvironment(p EnvironmentProvider) SaverOption {
+	return func(s *Saver) {
+		s.envs = append(s.envs, p)
+	}
+}
+
+func NewSaver(appGuid string, c CapiClient, log *log.Logger, opts ...SaverOption) *Saver {
+	s := &Saver{
 		appGuid: appGuid,
 		c:       c,
 		log:     log,
+		timeout: 5 * time.Second,
+	}
+
+	for _, o := range opts {
+		o(s)
 	}
+
+	return s
 }
 
 func (s *Saver) SaveState(ctx context.Context, qs []web.Query) error {
@@ -39,9 +73,16 @@ func (s *Saver) SaveState(ctx context.Context, qs []web.Query) error {
 		s.log.Panicf("failed to marshal queries: %s", err)
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
-	if err := s.c.SetEnvironmentVariables(ctx, s.appGuid, map[string]string{"QUERIES": string(data)}); err != nil {
+	vars := map[string]string{"QUERIES": string(data)}
+	for _, p := range s.envs {
+		for k, v := range p.EnvironmentVariables() {
+			vars[k] = v
+		}
+	}
+
+	if err := s.c.SetEnvironmentVariables(ctx, s.appGuid, vars); err != nil {
 		return fmt.Errorf("setting env vars failed: %s", err)
 	}
 
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"testing"
+	"time"
 
 	"github.com/poy/cf-faas-log-cache/internal/state"
 	"github.com/poy/cf-faas-log-cache/internal/web"
@@ -57,6 +58,30 @@ func TestStateSaver(t *testing.T) {
 		)
 	})
 
+	o.Spec("it uses the configured timeout", func(t TS) {
+		t.s = state.NewSaver("some-guid", t.spyCapiClient, log.New(ioutil.Discard, "", 0), state.WithTimeout(time.Hour))
+		err := t.s.SaveState(context.Background(), nil)
+		Expect(t, err).To(BeNil())
+
+		deadline, ok := t.spyCapiClient.setEnvCtx.Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, deadline.After(time.Now().Add(time.Minute))).To(BeTrue())
+	})
+
+	o.Spec("it saves the environment of the given providers", func(t TS) {
+		t.s = state.NewSaver(
+			"some-guid",
+			t.spyCapiClient,
+			log.New(ioutil.Discard, "", 0),
+			state.WithEnvironment(stubEnvironmentProvider{"A": "1"}),
+		)
+		err := t.s.SaveState(context.Background(), nil)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyCapiClient.setEnvVars).To(HaveLen(2))
+		Expect(t, t.spyCapiClient.setEnvVars["A"]).To(Equal("1"))
+	})
+
 	o.Spec("it returns an error if saving the env fails", func(t TS) {
 		t.spyCapiClient.setEnvErr = errors.New("some-error")
 		err := t.s.SaveState(context.Background(), []web.Query{
@@ -108,6 +133,12 @@ func TestStateSaver(t *testing.T) {
 	})
 }
 
+type stubEnvironmentProvider map[string]string
+
+func (p stubEnvironmentProvider) EnvironmentVariables() map[string]string {
+	return p
+}
+
 type spyCapiClient struct {
 	setEnvCtx     context.Context
 	setEnvAppGuid string
@@ -0,0 +1,202 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config describes how to build the TLS configuration shared by every
+// outbound client.
+type Config struct {
+	// SkipSSLValidation disables verification of the server's certificate.
+	SkipSSLValidation bool
+
+	// CACerts is a PEM bundle of additional CAs to trust.
+	CACerts string
+
+	// CAFile is a file with a PEM bundle of additional CAs to trust.
+	CAFile string
+
+	// CertFile and KeyFile are the client certificate used for mTLS.
+	CertFile string
+	KeyFile  string
+}
+
+// Client is a Doer that uses the TLS configuration built from Config. The
+// configuration is rebuilt when any of the files change (see Reload).
+type Client struct {
+	cfg Config
+	log *log.Logger
+
+	mu       sync.RWMutex
+	c        *http.Client
+	modTimes map[string]time.Time
+}
+
+// NewClient returns a Client. It returns an error if the certificates can
+// not be loaded.
+func NewClient(cfg Config, log *log.Logger) (*Client, error) {
+	c := &Client{
+		cfg: cfg,
+		log: log,
+	}
+
+	c.modTimes = c.readModTimes()
+	hc, err := c.build()
+	if err != nil {
+		return nil, err
+	}
+	c.c = hc
+
+	return c, nil
+}
+
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	c.mu.RLock()
+	hc := c.c
+	c.mu.RUnlock()
+
+	return hc.Do(req)
+}
+
+// Reload rebuilds the TLS configuration if any of the files have changed
+// since they were last loaded. It reports whether the configuration was
+// rebuilt. If the new files are invalid, the previous configuration is
+// kept.
+func (c *Client) Reload() (bool, error) {
+	modTimes := c.readModTimes()
+
+	c.mu.RLock()
+	changed := false
+	for f, t := range modTimes {
+		if !t.Equal(c.modTimes[f]) {
+			changed = true
+		}
+	}
+	c.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	hc, err := c.build()
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	old := c.c
+	c.c = hc
+	c.modTimes = modTimes
+	c.mu.Unlock()
+
+	// Requests in flight finish on the old transport. Its idle connections
+	// would otherwise stay open (with the old configuration) until they
+	// time out.
+	old.CloseIdleConnections()
+
+	return true, nil
+}
+
+// Watch calls Reload on every interval. It does not return.
+func (c *Client) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := c.Reload()
+		if err != nil {
+			c.log.Printf("failed to reload TLS configuration: %s", err)
+			continue
+		}
+
+		if reloaded {
+			c.log.Printf("reloaded TLS configuration")
+		}
+	}
+}
+
+func (c *Client) build() (*http.Client, error) {
+	tlsConfig, err := NewTLSConfig(c.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Timeouts are left to each request's context.
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConnsPerHost: 10,
+		},
+	}, nil
+}
+
+func (c *Client) readModTimes() map[string]time.Time {
+	m := make(map[string]time.Time)
+	for _, f := range []string{c.cfg.CAFile, c.cfg.CertFile, c.cfg.KeyFile} {
+		if f == "" {
+			continue
+		}
+
+		info, err := os.Stat(f)
+		if err != nil {
+			// Leave it as the zero time. Building the config will report
+			// the error.
+			m[f] = time.Time{}
+			continue
+		}
+		m[f] = info.ModTime()
+	}
+
+	return m
+}
+
+// NewTLSConfig builds a tls.Config from the given Config. The system's CAs
+// are always trusted.
+func NewTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.SkipSSLValidation,
+	}
+
+	if cfg.CACerts != "" || cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if cfg.CACerts != "" && !pool.AppendCertsFromPEM([]byte(cfg.CACerts)) {
+			return nil, fmt.Errorf("failed to parse CA certs")
+		}
+
+		if cfg.CAFile != "" {
+			data, err := ioutil.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file: %s", err)
+			}
+
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("failed to parse CA file %s", cfg.CAFile)
+			}
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
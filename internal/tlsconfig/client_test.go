@@ -0,0 +1,256 @@
+package tlsconfig_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache/internal/tlsconfig"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TC struct {
+	*testing.T
+	server *httptest.Server
+	dir    string
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		dir, err := ioutil.TempDir("", "tlsconfig")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return TC{
+			T:      t,
+			server: server,
+			dir:    dir,
+		}
+	})
+
+	o.AfterEach(func(t TC) {
+		t.server.Close()
+		os.RemoveAll(t.dir)
+	})
+
+	o.Spec("it does not trust unknown CAs", func(t TC) {
+		c, err := tlsconfig.NewClient(tlsconfig.Config{}, discard())
+		Expect(t, err).To(BeNil())
+
+		_, err = c.Do(newRequest(t.server.URL))
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it skips validation", func(t TC) {
+		c, err := tlsconfig.NewClient(tlsconfig.Config{SkipSSLValidation: true}, discard())
+		Expect(t, err).To(BeNil())
+
+		resp, err := c.Do(newRequest(t.server.URL))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	o.Spec("it trusts the given CA certs", func(t TC) {
+		c, err := tlsconfig.NewClient(tlsconfig.Config{CACerts: serverPEM(t.server)}, discard())
+		Expect(t, err).To(BeNil())
+
+		resp, err := c.Do(newRequest(t.server.URL))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	o.Spec("it trusts the CA file", func(t TC) {
+		caFile := writeFile(t, t.dir, "ca.pem", serverPEM(t.server))
+		c, err := tlsconfig.NewClient(tlsconfig.Config{CAFile: caFile}, discard())
+		Expect(t, err).To(BeNil())
+
+		resp, err := c.Do(newRequest(t.server.URL))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	o.Spec("it reloads the CA file when it changes", func(t TC) {
+		certPEM, _ := selfSigned(t)
+		caFile := writeFile(t, t.dir, "ca.pem", certPEM)
+		c, err := tlsconfig.NewClient(tlsconfig.Config{CAFile: caFile}, discard())
+		Expect(t, err).To(BeNil())
+
+		reloaded, err := c.Reload()
+		Expect(t, err).To(BeNil())
+		Expect(t, reloaded).To(BeFalse())
+
+		_, err = c.Do(newRequest(t.server.URL))
+		Expect(t, err).To(Not(BeNil()))
+
+		writeFile(t, t.dir, "ca.pem", serverPEM(t.server))
+		later := time.Now().Add(time.Minute)
+		Expect(t, os.Chtimes(caFile, later, later)).To(BeNil())
+
+		reloaded, err = c.Reload()
+		Expect(t, err).To(BeNil())
+		Expect(t, reloaded).To(BeTrue())
+
+		resp, err := c.Do(newRequest(t.server.URL))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	o.Spec("it closes the idle connections of the previous config", func(t TC) {
+		closed := make(chan struct{}, 1)
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+			if s == http.StateClosed {
+				closed <- struct{}{}
+			}
+		}
+		server.StartTLS()
+		defer server.Close()
+
+		caFile := writeFile(t, t.dir, "ca.pem", serverPEM(server))
+		c, err := tlsconfig.NewClient(tlsconfig.Config{CAFile: caFile}, discard())
+		Expect(t, err).To(BeNil())
+
+		resp, err := c.Do(newRequest(server.URL))
+		Expect(t, err).To(BeNil())
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		later := time.Now().Add(time.Minute)
+		Expect(t, os.Chtimes(caFile, later, later)).To(BeNil())
+		reloaded, err := c.Reload()
+		Expect(t, err).To(BeNil())
+		Expect(t, reloaded).To(BeTrue())
+
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the idle connection was not closed")
+		}
+	})
+
+	o.Spec("it keeps the previous config if the new files are invalid", func(t TC) {
+		caFile := writeFile(t, t.dir, "ca.pem", serverPEM(t.server))
+		c, err := tlsconfig.NewClient(tlsconfig.Config{CAFile: caFile}, discard())
+		Expect(t, err).To(BeNil())
+
+		writeFile(t, t.dir, "ca.pem", "invalid")
+		later := time.Now().Add(time.Minute)
+		Expect(t, os.Chtimes(caFile, later, later)).To(BeNil())
+
+		_, err = c.Reload()
+		Expect(t, err).To(Not(BeNil()))
+
+		resp, err := c.Do(newRequest(t.server.URL))
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	o.Spec("it loads the client certificate", func(t TC) {
+		certPEM, keyPEM := selfSigned(t)
+		tlsConfig, err := tlsconfig.NewTLSConfig(tlsconfig.Config{
+			CertFile: writeFile(t, t.dir, "cert.pem", certPEM),
+			KeyFile:  writeFile(t, t.dir, "key.pem", keyPEM),
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, tlsConfig.Certificates).To(HaveLen(1))
+	})
+
+	o.Spec("it returns an error for invalid CA certs", func(t TC) {
+		_, err := tlsconfig.NewClient(tlsconfig.Config{CACerts: "invalid"}, discard())
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for a missing CA file", func(t TC) {
+		_, err := tlsconfig.NewClient(tlsconfig.Config{CAFile: filepath.Join(t.dir, "missing")}, discard())
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for an invalid client certificate", func(t TC) {
+		_, err := tlsconfig.NewClient(tlsconfig.Config{
+			CertFile: writeFile(t, t.dir, "cert.pem", "invalid"),
+			KeyFile:  writeFile(t, t.dir, "key.pem", "invalid"),
+		}, discard())
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+func discard() *log.Logger {
+	return log.New(ioutil.Discard, "", 0)
+}
+
+func newRequest(u string) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
+func serverPEM(s *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: s.Certificate().Raw,
+	}))
+}
+
+func writeFile(t TC, dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func selfSigned(t TC) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "some-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(certPEM), string(keyPEM)
+}
@@ -0,0 +1,247 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache/pkg/promql"
+)
+
+// LabelsHandler serves label discovery in the format of the Prometheus
+// API:
+//
+//	GET /api/v1/labels?source_id=<name>
+//	GET /api/v1/label/<name>/values?source_id=<name>
+//
+// At least one source_id (an app or service instance name, or a GUID) is
+// required. The optional start and end parameters (Unix seconds or
+// RFC3339) default to the last 5 minutes.
+type LabelsHandler struct {
+	c   LabelClient
+	f   promql.GuidFetcher
+	a   SourceAuthorizer
+	log *log.Logger
+	now func() time.Time
+}
+
+// LabelClient discovers labels (e.g., pkg/promql.LocalClient).
+type LabelClient interface {
+	LabelNames(
+		ctx context.Context,
+		sourceIDs []string,
+		start time.Time,
+		end time.Time,
+	) ([]string, []string, error)
+
+	LabelValues(
+		ctx context.Context,
+		name string,
+		sourceIDs []string,
+		start time.Time,
+		end time.Time,
+	) ([]string, []string, error)
+}
+
+// SourceAuthorizer returns an error if the source may not be read.
+type SourceAuthorizer interface {
+	AuthorizeSource(ctx context.Context, sourceID string) error
+}
+
+// LabelsHandlerOption configures a LabelsHandler.
+type LabelsHandlerOption func(*LabelsHandler)
+
+// WithSourceAuthorizer rejects requests for sources that may not be read.
+func WithSourceAuthorizer(a SourceAuthorizer) LabelsHandlerOption {
+	return func(h *LabelsHandler) {
+		h.a = a
+	}
+}
+
+// defaultLabelWindow is how far back labels are discovered when no start is
+// given.
+const defaultLabelWindow = 5 * time.Minute
+
+func NewLabelsHandler(
+	c LabelClient,
+	f promql.GuidFetcher,
+	log *log.Logger,
+	opts ...LabelsHandlerOption,
+) *LabelsHandler {
+	h := &LabelsHandler{
+		c:   c,
+		f:   f,
+		log: log,
+		now: time.Now,
+	}
+
+	for _, o := range opts {
+		o(h)
+	}
+
+	return h
+}
+
+type labelsResponse struct {
+	Status    string   `json:"status"`
+	Data      []string `json:"data"`
+	ErrorType string   `json:"errorType,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+func (h *LabelsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+	}()
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// label is left empty for the names.
+	var label string
+	if r.URL.Path != "/api/v1/labels" {
+		rest := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+		parts := strings.Split(rest, "/")
+		if rest == r.URL.Path || len(parts) != 2 || parts[0] == "" || parts[1] != "values" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		label = parts[0]
+	}
+
+	start, end, err := h.window(r)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, string(promql.ErrBadData), err.Error())
+		return
+	}
+
+	names := r.URL.Query()["source_id"]
+	if len(names) == 0 {
+		h.writeError(w, http.StatusBadRequest, string(promql.ErrBadData), "at least one source_id is required")
+		return
+	}
+
+	var sourceIDs []string
+	for _, name := range names {
+		if h.a != nil {
+			if err := h.a.AuthorizeSource(r.Context(), name); err != nil {
+				h.writeError(w, http.StatusForbidden, "forbidden", err.Error())
+				return
+			}
+		}
+
+		sourceID := name
+		if !promql.IsGuid(name) {
+			sourceID, err = h.f.GetAppGuid(r.Context(), name)
+			if err != nil {
+				h.writeError(w, http.StatusBadRequest, string(promql.ErrBadData), fmt.Sprintf("failed to resolve source_id %q: %s", name, err))
+				return
+			}
+		}
+		sourceIDs = append(sourceIDs, sourceID)
+	}
+
+	var values, warnings []string
+	if label == "" {
+		values, warnings, err = h.c.LabelNames(r.Context(), sourceIDs, start, end)
+	} else {
+		values, warnings, err = h.c.LabelValues(r.Context(), label, sourceIDs, start, end)
+	}
+
+	if err != nil {
+		h.log.Printf("failed to discover labels: %s", err)
+
+		errType, status := promql.ErrServer, http.StatusInternalServerError
+		if e, ok := err.(*promql.Error); ok {
+			errType = e.Type
+			switch e.Type {
+			case promql.ErrBadData:
+				status = http.StatusBadRequest
+			case promql.ErrTimeout:
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		h.writeError(w, status, string(errType), err.Error())
+		return
+	}
+
+	if values == nil {
+		values = []string{}
+	}
+
+	h.write(w, http.StatusOK, labelsResponse{
+		Status:   "success",
+		Data:     values,
+		Warnings: warnings,
+	})
+}
+
+func (h *LabelsHandler) window(r *http.Request) (time.Time, time.Time, error) {
+	end := h.now()
+	if s := r.URL.Query().Get("end"); s != "" {
+		var err error
+		end, err = parseTime(s)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid end: %s", err)
+		}
+	}
+
+	start := end.Add(-defaultLabelWindow)
+	if s := r.URL.Query().Get("start"); s != "" {
+		var err error
+		start, err = parseTime(s)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid start: %s", err)
+		}
+	}
+
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end is before start")
+	}
+
+	return start, end, nil
+}
+
+// parseTime accepts the same formats as the Prometheus API: Unix seconds
+// (with an optional fraction) or RFC3339.
+func parseTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func (h *LabelsHandler) writeError(w http.ResponseWriter, status int, errType, msg string) {
+	h.write(w, status, labelsResponse{
+		Status:    "error",
+		Data:      []string{},
+		ErrorType: errType,
+		Error:     msg,
+	})
+}
+
+func (h *LabelsHandler) write(w http.ResponseWriter, status int, resp labelsResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		h.log.Panicf("failed to marshal response: %s", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
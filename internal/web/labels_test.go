@@ -0,0 +1,217 @@
+package web_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache/internal/web"
+	"github.com/poy/cf-faas-log-cache/pkg/promql"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+const someGuid = "8f6a4c2e-1b3d-4e5f-a6b7-c8d9e0f1a2b3"
+
+type TL struct {
+	*testing.T
+	recorder       *httptest.ResponseRecorder
+	h              *web.LabelsHandler
+	spyLabelClient *spyLabelClient
+	spyGuidFetcher *spyGuidFetcher
+}
+
+func TestLabelsHandler(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TL {
+		spyLabelClient := &spyLabelClient{values: []string{"a", "b"}}
+		spyGuidFetcher := &spyGuidFetcher{guids: map[string]string{"some-app": "some-guid"}}
+
+		return TL{
+			T:              t,
+			recorder:       httptest.NewRecorder(),
+			h:              web.NewLabelsHandler(spyLabelClient, spyGuidFetcher, log.New(ioutil.Discard, "", 0)),
+			spyLabelClient: spyLabelClient,
+			spyGuidFetcher: spyGuidFetcher,
+		}
+	})
+
+	o.Spec("it returns the label names", func(t TL) {
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels?source_id=some-app&source_id="+someGuid+"&start=1&end=2.5", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, decodeLabels(t)).To(Equal(map[string]interface{}{
+			"status": "success",
+			"data":   []interface{}{"a", "b"},
+		}))
+
+		Expect(t, t.spyLabelClient.method).To(Equal("LabelNames"))
+		Expect(t, t.spyLabelClient.sourceIDs).To(Equal([]string{"some-guid", someGuid}))
+		Expect(t, t.spyLabelClient.start).To(Equal(time.Unix(1, 0)))
+		Expect(t, t.spyLabelClient.end).To(Equal(time.Unix(2, int64(500*time.Millisecond))))
+		Expect(t, t.spyGuidFetcher.names).To(Equal([]string{"some-app"}))
+	})
+
+	o.Spec("it returns the label values", func(t TL) {
+		t.spyLabelClient.warnings = []string{"some-warning"}
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/label/job/values?source_id=some-app&start=2018-01-01T00:00:00Z", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, decodeLabels(t)).To(Equal(map[string]interface{}{
+			"status":   "success",
+			"data":     []interface{}{"a", "b"},
+			"warnings": []interface{}{"some-warning"},
+		}))
+
+		Expect(t, t.spyLabelClient.method).To(Equal("LabelValues"))
+		Expect(t, t.spyLabelClient.name).To(Equal("job"))
+		Expect(t, t.spyLabelClient.start).To(Equal(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)))
+	})
+
+	o.Spec("it defaults to the last 5 minutes", func(t TL) {
+		before := time.Now()
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels?source_id=some-app", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.spyLabelClient.end.Before(before)).To(BeFalse())
+		Expect(t, t.spyLabelClient.end.Sub(t.spyLabelClient.start)).To(Equal(5 * time.Minute))
+	})
+
+	o.Spec("it returns an empty list instead of null", func(t TL) {
+		t.spyLabelClient.values = nil
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels?source_id=some-app", nil))
+
+		Expect(t, decodeLabels(t)["data"]).To(Equal([]interface{}{}))
+	})
+
+	o.Spec("it authorizes each source", func(t TL) {
+		spyAuthorizer := &spyAuthorizer{}
+		t.h = web.NewLabelsHandler(t.spyLabelClient, t.spyGuidFetcher, log.New(ioutil.Discard, "", 0), web.WithSourceAuthorizer(spyAuthorizer))
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels?source_id=some-app", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, spyAuthorizer.queries).To(Equal([]string{"some-app"}))
+	})
+
+	o.Spec("it returns a 403 for a source that is not allowed", func(t TL) {
+		spyAuthorizer := &spyAuthorizer{err: errors.New("some-error")}
+		t.h = web.NewLabelsHandler(t.spyLabelClient, t.spyGuidFetcher, log.New(ioutil.Discard, "", 0), web.WithSourceAuthorizer(spyAuthorizer))
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels?source_id=some-app", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusForbidden))
+		Expect(t, t.spyLabelClient.method).To(Equal(""))
+	})
+
+	o.Spec("it returns a 400 without a source_id", func(t TL) {
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(t, decodeLabels(t)["errorType"]).To(Equal("bad_data"))
+	})
+
+	o.Spec("it returns a 400 for an unknown source", func(t TL) {
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels?source_id=unknown", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	o.Spec("it returns a 400 for an invalid time", func(t TL) {
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels?source_id=some-app&start=invalid", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	o.Spec("it returns a 400 for an end before the start", func(t TL) {
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels?source_id=some-app&start=2&end=1", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	o.Spec("it returns the client's error", func(t TL) {
+		t.spyLabelClient.err = &promql.Error{Type: promql.ErrTimeout, Msg: "some-error"}
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels?source_id=some-app", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, decodeLabels(t)["errorType"]).To(Equal("timeout"))
+	})
+
+	o.Spec("it returns a 500 for other errors", func(t TL) {
+		t.spyLabelClient.err = errors.New("some-error")
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/labels?source_id=some-app", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusInternalServerError))
+	})
+
+	o.Spec("it returns a 404 for other paths", func(t TL) {
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("GET", "http://some.url/api/v1/label/values", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusNotFound))
+	})
+
+	o.Spec("it returns a 405 for non GET requests", func(t TL) {
+		t.h.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url/api/v1/labels", nil))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+}
+
+func decodeLabels(t TL) map[string]interface{} {
+	var resp map[string]interface{}
+	if err := json.NewDecoder(t.recorder.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+type spyLabelClient struct {
+	method    string
+	name      string
+	sourceIDs []string
+	start     time.Time
+	end       time.Time
+
+	values   []string
+	warnings []string
+	err      error
+}
+
+func (s *spyLabelClient) LabelNames(ctx context.Context, sourceIDs []string, start, end time.Time) ([]string, []string, error) {
+	s.method = "LabelNames"
+	s.sourceIDs = sourceIDs
+	s.start = start
+	s.end = end
+	return s.values, s.warnings, s.err
+}
+
+func (s *spyLabelClient) LabelValues(ctx context.Context, name string, sourceIDs []string, start, end time.Time) ([]string, []string, error) {
+	s.method = "LabelValues"
+	s.name = name
+	s.sourceIDs = sourceIDs
+	s.start = start
+	s.end = end
+	return s.values, s.warnings, s.err
+}
+
+type spyGuidFetcher struct {
+	names []string
+	guids map[string]string
+}
+
+func (s *spyGuidFetcher) GetAppGuid(ctx context.Context, name string) (string, error) {
+	s.names = append(s.names, name)
+	guid, ok := s.guids[name]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return guid, nil
+}
@@ -3,12 +3,16 @@ package web
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
 
 	faas "github.com/poy/cf-faas"
 )
@@ -16,23 +20,136 @@ import (
 type Resolver struct {
 	s   StateSaver
 	log *log.Logger
+	a   Authorizer
 }
 
 type Query struct {
-	Query   string `json:"query"`
-	Path    string `json:"path"`
-	Context string `json:"context,omitempty"`
+	Query   string        `json:"query"`
+	Path    string        `json:"path"`
+	Context string        `json:"context,omitempty"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// Backfill makes the reader evaluate the ticks it missed while the
+	// service was down.
+	Backfill bool `json:"backfill,omitempty"`
+
+	// Function names the function the event belongs to (see
+	// FunctionName).
+	Function string `json:"function,omitempty"`
+
+	// Logs is set for a logs event. Instead of evaluating Query, the
+	// source's log lines that pass the filter are delivered.
+	Logs *LogFilter `json:"logs,omitempty"`
+
+	// AuditEvents is set for an audit_events event. Instead of evaluating
+	// Query, the CAPI audit events that pass the filter are delivered.
+	AuditEvents *AuditEventFilter `json:"audit_events,omitempty"`
+
+	// Sources is set for a sources event. Instead of evaluating Query, the
+	// Log Cache sources that appear or go stale are delivered.
+	Sources *SourceFilter `json:"sources,omitempty"`
+}
+
+// LogFilter selects the log lines of a source (an app name or a source
+// ID). Lines that contain Match or match Regex pass. Without either, every
+// line passes.
+type LogFilter struct {
+	SourceID string `json:"source_id"`
+	Match    string `json:"match,omitempty"`
+	Regex    string `json:"regex,omitempty"`
+}
+
+// AuditEventFilter selects audit events by type (e.g.,
+// audit.app.process.crash) and by the name of their target (e.g., an app).
+// An empty filter selects every event.
+type AuditEventFilter struct {
+	Types      []string `json:"types,omitempty"`
+	TargetName string   `json:"target_name,omitempty"`
+}
+
+// SourceFilter configures a sources event. A source goes stale when it has
+// not emitted for StaleAfter.
+type SourceFilter struct {
+	StaleAfter time.Duration `json:"stale_after,omitempty"`
+}
+
+// ID identifies the query across restarts. Unlike the Path, it does not
+// change when the functions are converted again. Two functions with the same
+// event have different IDs.
+func (q Query) ID() string {
+	if q.Function != "" {
+		return q.Function + ":" + q.eventID()
+	}
+
+	return q.eventID()
+}
+
+func (q Query) eventID() string {
+	if q.Logs != nil {
+		return q.Context + ":logs:" + q.Logs.SourceID + ":" + q.Logs.Match + ":" + q.Logs.Regex
+	}
+
+	if q.AuditEvents != nil {
+		return q.Context + ":audit_events:" + strings.Join(q.AuditEvents.Types, ",") + ":" + q.AuditEvents.TargetName
+	}
+
+	if q.Sources != nil {
+		return q.Context + ":sources:" + q.Sources.StaleAfter.String()
+	}
+
+	return q.Context + ":" + q.Query
 }
 
 type StateSaver interface {
 	SaveState(context.Context, []Query) error
 }
 
-func NewResolver(s StateSaver, log *log.Logger) http.Handler {
-	return &Resolver{
+// Authorizer returns an error if a query (or a logs event) reads sources
+// it is not allowed to (e.g., access.Authorizer). An error that has a Denied
+// method returning true means that the sources may not be read. Any other
+// error means that access could not be checked.
+type Authorizer interface {
+	Authorize(ctx context.Context, query string) error
+	AuthorizeSource(ctx context.Context, sourceID string) error
+}
+
+type denied interface {
+	Denied() bool
+}
+
+// authorizationStatus returns the status code for an error of the
+// Authorizer. The function can register again if access could not be
+// checked.
+func authorizationStatus(err error) int {
+	if d, ok := err.(denied); ok && d.Denied() {
+		return http.StatusForbidden
+	}
+
+	return http.StatusServiceUnavailable
+}
+
+// ResolverOption configures a Resolver.
+type ResolverOption func(*Resolver)
+
+// WithAuthorizer rejects functions whose queries read sources they are not
+// allowed to.
+func WithAuthorizer(a Authorizer) ResolverOption {
+	return func(r *Resolver) {
+		r.a = a
+	}
+}
+
+func NewResolver(s StateSaver, log *log.Logger, opts ...ResolverOption) http.Handler {
+	r := &Resolver{
 		s:   s,
 		log: log,
 	}
+
+	for _, o := range opts {
+		o(r)
+	}
+
+	return r
 }
 
 func (s *Resolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -58,28 +175,59 @@ func (s *Resolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	)
 
 	for _, f := range req.Functions {
-		gd, ok := f.Events["promql"]
-		if !ok {
+		promQLEvents, hasPromQL := f.Events["promql"]
+		logsEvents, hasLogs := f.Events["logs"]
+		auditEvents, hasAuditEvents := f.Events["audit_events"]
+		sourcesEvents, hasSources := f.Events["sources"]
+		if !hasPromQL && !hasLogs && !hasAuditEvents && !hasSources {
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf(`{"error":%q}`, "promql type")))
+			w.Write([]byte(fmt.Sprintf(`{"error":%q}`, "promql, logs, audit_events or sources type")))
 			return
 		}
 
-		for _, e := range gd {
-			qs, _ := e["query"].(string)
-			if qs == "" {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(fmt.Sprintf(`{"error":%q}`, "invalid/missing Query")))
+		var fqs []Query
+		for _, e := range promQLEvents {
+			q, status, err := s.promQLQuery(r.Context(), e)
+			if err != nil {
+				w.WriteHeader(status)
+				w.Write([]byte(fmt.Sprintf(`{"error":%q}`, err)))
 				return
 			}
+			fqs = append(fqs, q)
+		}
 
-			queryContext, _ := e["context"].(string)
+		for _, e := range logsEvents {
+			q, status, err := s.logsQuery(r.Context(), e)
+			if err != nil {
+				w.WriteHeader(status)
+				w.Write([]byte(fmt.Sprintf(`{"error":%q}`, err)))
+				return
+			}
+			fqs = append(fqs, q)
+		}
 
-			q := Query{
-				Query:   qs,
-				Context: queryContext,
-				Path:    fmt.Sprintf("/%d-prom-ql", rand.Int63()),
+		for _, e := range auditEvents {
+			q, err := auditEventsQuery(e)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf(`{"error":%q}`, err)))
+				return
 			}
+			fqs = append(fqs, q)
+		}
+
+		for _, e := range sourcesEvents {
+			q, err := sourcesQuery(e)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf(`{"error":%q}`, err)))
+				return
+			}
+			fqs = append(fqs, q)
+		}
+
+		for _, q := range fqs {
+			q.Function = FunctionName(f.Handler)
 			queries = append(queries, q)
 
 			hf := faas.ConvertHTTPFunction{
@@ -110,3 +258,165 @@ func (s *Resolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.log.Printf("failed to save state: %s", err)
 	}
 }
+
+// FunctionName identifies a function by its app and command.
+func FunctionName(h faas.ConvertHandler) string {
+	if h.AppName == "" {
+		return h.Command
+	}
+
+	return h.AppName + ":" + h.Command
+}
+
+// promQLQuery converts a promql event. The returned status code is only set
+// with an error.
+func (s *Resolver) promQLQuery(ctx context.Context, e map[string]interface{}) (Query, int, error) {
+	qs, _ := e["query"].(string)
+	if qs == "" {
+		return Query{}, http.StatusBadRequest, errors.New("invalid/missing Query")
+	}
+
+	if s.a != nil {
+		if err := s.a.Authorize(ctx, qs); err != nil {
+			return Query{}, authorizationStatus(err), err
+		}
+	}
+
+	timeout, err := eventTimeout(e)
+	if err != nil {
+		return Query{}, http.StatusBadRequest, err
+	}
+
+	queryContext, _ := e["context"].(string)
+	backfill, _ := e["backfill"].(bool)
+
+	return Query{
+		Query:    qs,
+		Context:  queryContext,
+		Timeout:  timeout,
+		Backfill: backfill,
+		Path:     fmt.Sprintf("/%d-prom-ql", rand.Int63()),
+	}, 0, nil
+}
+
+// logsQuery converts a logs event. The returned status code is only set
+// with an error.
+func (s *Resolver) logsQuery(ctx context.Context, e map[string]interface{}) (Query, int, error) {
+	sourceID, _ := e["source_id"].(string)
+	if sourceID == "" {
+		return Query{}, http.StatusBadRequest, errors.New("invalid/missing source_id")
+	}
+
+	match, _ := e["match"].(string)
+	regex, _ := e["regex"].(string)
+	if match != "" && regex != "" {
+		return Query{}, http.StatusBadRequest, errors.New("only one of match and regex may be set")
+	}
+
+	if _, err := regexp.Compile(regex); err != nil {
+		return Query{}, http.StatusBadRequest, fmt.Errorf("invalid regex: %s", err)
+	}
+
+	if s.a != nil {
+		if err := s.a.AuthorizeSource(ctx, sourceID); err != nil {
+			return Query{}, authorizationStatus(err), err
+		}
+	}
+
+	timeout, err := eventTimeout(e)
+	if err != nil {
+		return Query{}, http.StatusBadRequest, err
+	}
+
+	queryContext, _ := e["context"].(string)
+
+	return Query{
+		Context: queryContext,
+		Timeout: timeout,
+		Path:    fmt.Sprintf("/%d-logs", rand.Int63()),
+		Logs: &LogFilter{
+			SourceID: sourceID,
+			Match:    match,
+			Regex:    regex,
+		},
+	}, 0, nil
+}
+
+// auditEventsQuery converts an audit_events event. The events are always
+// those of the service's own space.
+func auditEventsQuery(e map[string]interface{}) (Query, error) {
+	var types []string
+	switch t := e["types"].(type) {
+	case nil:
+	case []interface{}:
+		for _, v := range t {
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return Query{}, errors.New("invalid types")
+			}
+			types = append(types, s)
+		}
+	default:
+		return Query{}, errors.New("invalid types")
+	}
+
+	timeout, err := eventTimeout(e)
+	if err != nil {
+		return Query{}, err
+	}
+
+	queryContext, _ := e["context"].(string)
+	targetName, _ := e["target_name"].(string)
+
+	return Query{
+		Context: queryContext,
+		Timeout: timeout,
+		Path:    fmt.Sprintf("/%d-audit-events", rand.Int63()),
+		AuditEvents: &AuditEventFilter{
+			Types:      types,
+			TargetName: targetName,
+		},
+	}, nil
+}
+
+// sourcesQuery converts a sources event.
+func sourcesQuery(e map[string]interface{}) (Query, error) {
+	var staleAfter time.Duration
+	if sa, ok := e["stale_after"].(string); ok {
+		var err error
+		staleAfter, err = time.ParseDuration(sa)
+		if err != nil || staleAfter <= 0 {
+			return Query{}, errors.New("invalid stale_after")
+		}
+	}
+
+	timeout, err := eventTimeout(e)
+	if err != nil {
+		return Query{}, err
+	}
+
+	queryContext, _ := e["context"].(string)
+
+	return Query{
+		Context: queryContext,
+		Timeout: timeout,
+		Path:    fmt.Sprintf("/%d-sources", rand.Int63()),
+		Sources: &SourceFilter{
+			StaleAfter: staleAfter,
+		},
+	}, nil
+}
+
+func eventTimeout(e map[string]interface{}) (time.Duration, error) {
+	ts, ok := e["timeout"].(string)
+	if !ok {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(ts)
+	if err != nil || timeout <= 0 {
+		return 0, errors.New("invalid timeout")
+	}
+
+	return timeout, nil
+}
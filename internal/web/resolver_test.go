@@ -3,12 +3,14 @@ package web_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	faas "github.com/poy/cf-faas"
 	"github.com/poy/cf-faas-log-cache/internal/web"
@@ -59,11 +61,214 @@ func TestResolverRejects(t *testing.T) {
 		Expect(t, resp.Functions[0].Events[0].Method).To(Equal(http.MethodPost))
 
 		Expect(t, t.spyStateSaver.queries).To(Equal([]web.Query{
-			{Query: "some-query", Context: "some-context", Path: resp.Functions[0].Events[0].Path},
+			{Query: "some-query", Context: "some-context", Path: resp.Functions[0].Events[0].Path, Function: "some-app-name:some-command"},
 		}))
 		Expect(t, t.spyStateSaver.ctx).To(Equal(req.Context()))
 	})
 
+	o.Spec("it includes the query's timeout", func(t TR) {
+		req := httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"promql":[{"query":"some-query","timeout":"10s"}]},"handler":{"command":"some-command"}}]}`))
+		t.s.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.spyStateSaver.queries).To(HaveLen(1))
+		Expect(t, t.spyStateSaver.queries[0].Timeout).To(Equal(10 * time.Second))
+	})
+
+	o.Spec("it includes whether the query is backfilled", func(t TR) {
+		req := httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"promql":[{"query":"some-query","backfill":true}]},"handler":{"command":"some-command"}}]}`))
+		t.s.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.spyStateSaver.queries).To(HaveLen(1))
+		Expect(t, t.spyStateSaver.queries[0].Backfill).To(BeTrue())
+	})
+
+	o.Spec("it authorizes each query", func(t TR) {
+		spyAuthorizer := &spyAuthorizer{}
+		t.s = web.NewResolver(t.spyStateSaver, log.New(ioutil.Discard, "", 0), web.WithAuthorizer(spyAuthorizer))
+		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"promql":[{"query":"some-query"}]},"handler":{"command":"some-command"}}]}`)))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, spyAuthorizer.queries).To(Equal([]string{"some-query"}))
+	})
+
+	o.Spec("it returns a 403 for a query that is not allowed", func(t TR) {
+		spyAuthorizer := &spyAuthorizer{err: deniedError("some-error")}
+		t.s = web.NewResolver(t.spyStateSaver, log.New(ioutil.Discard, "", 0), web.WithAuthorizer(spyAuthorizer))
+		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"promql":[{"query":"some-query"}]},"handler":{"command":"some-command"}}]}`)))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusForbidden))
+		Expect(t, t.recorder.Body.String()).To(ContainSubstring("some-error"))
+		Expect(t, t.spyStateSaver.queries).To(BeNil())
+	})
+
+	o.Spec("it returns a 503 if access to a query could not be checked", func(t TR) {
+		spyAuthorizer := &spyAuthorizer{err: errors.New("some-error")}
+		t.s = web.NewResolver(t.spyStateSaver, log.New(ioutil.Discard, "", 0), web.WithAuthorizer(spyAuthorizer))
+		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"promql":[{"query":"some-query"}]},"handler":{"command":"some-command"}}]}`)))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.spyStateSaver.queries).To(BeNil())
+	})
+
+	o.Spec("it accepts logs events", func(t TR) {
+		spyAuthorizer := &spyAuthorizer{}
+		t.s = web.NewResolver(t.spyStateSaver, log.New(ioutil.Discard, "", 0), web.WithAuthorizer(spyAuthorizer))
+		req := httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"logs":[{"source_id":"some-app","regex":"5\\d\\d","context":"some-context","timeout":"10s"}]},"handler":{"command":"some-command"}}]}`))
+		t.s.ServeHTTP(t.recorder, req)
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		var resp faas.ConvertResponse
+		Expect(t, json.NewDecoder(t.recorder.Body).Decode(&resp)).To(BeNil())
+		Expect(t, resp.Functions).To(HaveLen(1))
+		Expect(t, resp.Functions[0].Events).To(HaveLen(1))
+
+		Expect(t, t.spyStateSaver.queries).To(Equal([]web.Query{
+			{
+				Context:  "some-context",
+				Timeout:  10 * time.Second,
+				Path:     resp.Functions[0].Events[0].Path,
+				Function: "some-command",
+				Logs: &web.LogFilter{
+					SourceID: "some-app",
+					Regex:    `5\d\d`,
+				},
+			},
+		}))
+		Expect(t, spyAuthorizer.queries).To(Equal([]string{"some-app"}))
+	})
+
+	o.Spec("it accepts promql and logs events for the same function", func(t TR) {
+		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"promql":[{"query":"some-query"}],"logs":[{"source_id":"some-app","match":"some-match"}]},"handler":{"command":"some-command"}}]}`)))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.spyStateSaver.queries).To(HaveLen(2))
+		Expect(t, t.spyStateSaver.queries[0].Query).To(Equal("some-query"))
+		Expect(t, t.spyStateSaver.queries[1].Logs.Match).To(Equal("some-match"))
+		Expect(t, t.spyStateSaver.queries[0].ID()).To(Not(Equal(t.spyStateSaver.queries[1].ID())))
+	})
+
+	o.Spec("it gives the same event of different functions different IDs", func(t TR) {
+		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[
+			{"events":{"promql":[{"query":"some-query","context":"some-context"}]},"handler":{"command":"some-command"}},
+			{"events":{"promql":[{"query":"some-query","context":"some-context"}]},"handler":{"command":"other-command"}}
+		]}`)))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.spyStateSaver.queries).To(HaveLen(2))
+		Expect(t, t.spyStateSaver.queries[0].ID()).To(Not(Equal(t.spyStateSaver.queries[1].ID())))
+	})
+
+	o.Spec("it returns a 403 for a logs event that is not allowed", func(t TR) {
+		spyAuthorizer := &spyAuthorizer{err: deniedError("some-error")}
+		t.s = web.NewResolver(t.spyStateSaver, log.New(ioutil.Discard, "", 0), web.WithAuthorizer(spyAuthorizer))
+		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"logs":[{"source_id":"some-app"}]},"handler":{"command":"some-command"}}]}`)))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusForbidden))
+		Expect(t, t.spyStateSaver.queries).To(BeNil())
+	})
+
+	o.Spec("it returns a 503 if access to a logs event could not be checked", func(t TR) {
+		spyAuthorizer := &spyAuthorizer{err: errors.New("some-error")}
+		t.s = web.NewResolver(t.spyStateSaver, log.New(ioutil.Discard, "", 0), web.WithAuthorizer(spyAuthorizer))
+		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"logs":[{"source_id":"some-app"}]},"handler":{"command":"some-command"}}]}`)))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.spyStateSaver.queries).To(BeNil())
+	})
+
+	o.Spec("it returns a 400 for an invalid logs event", func(t TR) {
+		for _, event := range []string{
+			`{}`,
+			`{"source_id":"some-app","regex":"["}`,
+			`{"source_id":"some-app","regex":"a","match":"b"}`,
+			`{"source_id":"some-app","timeout":"invalid"}`,
+		} {
+			recorder := httptest.NewRecorder()
+			t.s.ServeHTTP(recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"logs":[`+event+`]},"handler":{"command":"some-command"}}]}`)))
+
+			Expect(t, recorder.Code).To(Equal(http.StatusBadRequest))
+		}
+	})
+
+	o.Spec("it accepts audit_events events", func(t TR) {
+		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"audit_events":[{"types":["audit.app.process.crash","audit.app.restage"],"target_name":"some-app","context":"some-context"}]},"handler":{"command":"some-command"}}]}`)))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		var resp faas.ConvertResponse
+		Expect(t, json.NewDecoder(t.recorder.Body).Decode(&resp)).To(BeNil())
+		Expect(t, resp.Functions).To(HaveLen(1))
+		Expect(t, resp.Functions[0].Events).To(HaveLen(1))
+
+		Expect(t, t.spyStateSaver.queries).To(Equal([]web.Query{
+			{
+				Context:  "some-context",
+				Path:     resp.Functions[0].Events[0].Path,
+				Function: "some-command",
+				AuditEvents: &web.AuditEventFilter{
+					Types:      []string{"audit.app.process.crash", "audit.app.restage"},
+					TargetName: "some-app",
+				},
+			},
+		}))
+	})
+
+	o.Spec("it returns a 400 for an invalid audit_events event", func(t TR) {
+		for _, event := range []string{
+			`{"types":"audit.app.restage"}`,
+			`{"types":[1]}`,
+			`{"timeout":"invalid"}`,
+		} {
+			recorder := httptest.NewRecorder()
+			t.s.ServeHTTP(recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"audit_events":[`+event+`]},"handler":{"command":"some-command"}}]}`)))
+
+			Expect(t, recorder.Code).To(Equal(http.StatusBadRequest))
+		}
+	})
+
+	o.Spec("it accepts sources events", func(t TR) {
+		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"sources":[{"stale_after":"10m","context":"some-context"}]},"handler":{"command":"some-command"}}]}`)))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		var resp faas.ConvertResponse
+		Expect(t, json.NewDecoder(t.recorder.Body).Decode(&resp)).To(BeNil())
+		Expect(t, resp.Functions).To(HaveLen(1))
+
+		Expect(t, t.spyStateSaver.queries).To(Equal([]web.Query{
+			{
+				Context:  "some-context",
+				Path:     resp.Functions[0].Events[0].Path,
+				Function: "some-command",
+				Sources: &web.SourceFilter{
+					StaleAfter: 10 * time.Minute,
+				},
+			},
+		}))
+	})
+
+	o.Spec("it returns a 400 for an invalid sources event", func(t TR) {
+		for _, event := range []string{
+			`{"stale_after":"invalid"}`,
+			`{"stale_after":"-1m"}`,
+			`{"timeout":"invalid"}`,
+		} {
+			recorder := httptest.NewRecorder()
+			t.s.ServeHTTP(recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"sources":[`+event+`]},"handler":{"command":"some-command"}}]}`)))
+
+			Expect(t, recorder.Code).To(Equal(http.StatusBadRequest))
+		}
+	})
+
+	o.Spec("it returns a 400 for an invalid timeout", func(t TR) {
+		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"events":{"promql":[{"query":"some-query","timeout":"invalid"}]},"handler":{"command":"some-command"}}]}`)))
+
+		Expect(t, t.recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
 	o.Spec("it returns a 400 for a POST missing the query", func(t TR) {
 		t.s.ServeHTTP(t.recorder, httptest.NewRequest("POST", "http://some.url", strings.NewReader(`{"functions":[{"handler":{"command":"some-command"}}]}`)))
 
@@ -83,6 +288,31 @@ func TestResolverRejects(t *testing.T) {
 	})
 }
 
+type spyAuthorizer struct {
+	queries []string
+	err     error
+}
+
+func (s *spyAuthorizer) Authorize(ctx context.Context, query string) error {
+	s.queries = append(s.queries, query)
+	return s.err
+}
+
+func (s *spyAuthorizer) AuthorizeSource(ctx context.Context, sourceID string) error {
+	s.queries = append(s.queries, sourceID)
+	return s.err
+}
+
+type deniedError string
+
+func (e deniedError) Error() string {
+	return string(e)
+}
+
+func (e deniedError) Denied() bool {
+	return true
+}
+
 type spyStateSaver struct {
 	ctx     context.Context
 	queries []web.Query
@@ -0,0 +1,55 @@
+package faaspromql
+
+import (
+	"encoding/json"
+	"net/http"
+
+	faas "github.com/poy/cf-faas"
+)
+
+// LogHandler handles the batches POSTed for a logs event.
+type LogHandler interface {
+	HandleLogs(LogBatch) error
+}
+
+type LogHandlerFunc func(LogBatch) error
+
+func (f LogHandlerFunc) HandleLogs(b LogBatch) error {
+	return f(b)
+}
+
+// StartLogs is like Start, but for functions that have a logs event.
+func StartLogs(h LogHandler) {
+	faas.Start(faas.HandlerFunc(func(req faas.Request) (faas.Response, error) {
+		var b LogBatch
+		if err := json.Unmarshal(req.Body, &b); err != nil {
+			return faas.Response{}, err
+		}
+
+		if err := h.HandleLogs(b); err != nil {
+			return faas.Response{}, err
+		}
+
+		return faas.Response{
+			StatusCode: http.StatusOK,
+		}, nil
+	}))
+}
+
+// LogBatch is POSTed for a logs event. It has the log lines that matched
+// the event's filter since the previous batch, oldest first.
+type LogBatch struct {
+	Context  string `json:"context"`
+	SourceID string `json:"source_id"`
+	Logs     []Log  `json:"logs"`
+}
+
+type Log struct {
+	// Timestamp is in unix nanoseconds.
+	Timestamp  int64             `json:"timestamp"`
+	SourceID   string            `json:"source_id"`
+	InstanceID string            `json:"instance_id,omitempty"`
+	Type       string            `json:"type"`
+	Payload    string            `json:"payload"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
@@ -0,0 +1,158 @@
+package promql
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// Analysis describes what a PromQL query reads and how. It is built from the
+// query's syntax tree alone, so nothing is fetched from Log Cache.
+type Analysis struct {
+	// MetricNames are the distinct metric names that are selected, in the
+	// order they appear.
+	MetricNames []string
+
+	// Selectors are the vector and range selectors in the order they
+	// appear.
+	Selectors []Selector
+
+	// Aggregations (e.g., "sum") and Functions (e.g., "rate") are the
+	// distinct operators that are used, in the order they appear.
+	Aggregations []string
+	Functions    []string
+}
+
+// Selector is a single vector (e.g., metric{a="b"}) or range (e.g.,
+// metric{a="b"}[1m]) selector.
+type Selector struct {
+	// MetricName is empty if the name is only matched by the __name__
+	// label.
+	MetricName string
+
+	// Matchers includes the __name__ matcher.
+	Matchers []Matcher
+
+	// Range is zero for a vector selector.
+	Range  time.Duration
+	Offset time.Duration
+}
+
+// Matcher is a label matcher of a Selector.
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+}
+
+// MatchType is the operator of a Matcher.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Analyze parses the query and reports on it. It returns an error if the
+// query is invalid.
+func Analyze(query string) (*Analysis, error) {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Analysis{}
+	seen := map[string]bool{}
+	addOnce := func(list *[]string, kind, value string) {
+		if value == "" || seen[kind+":"+value] {
+			return
+		}
+		seen[kind+":"+value] = true
+		*list = append(*list, value)
+	}
+
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			addOnce(&a.MetricNames, "metric", n.Name)
+			a.Selectors = append(a.Selectors, Selector{
+				MetricName: n.Name,
+				Matchers:   convertMatchers(n.LabelMatchers),
+				Offset:     n.Offset,
+			})
+		case *promql.MatrixSelector:
+			addOnce(&a.MetricNames, "metric", n.Name)
+			a.Selectors = append(a.Selectors, Selector{
+				MetricName: n.Name,
+				Matchers:   convertMatchers(n.LabelMatchers),
+				Range:      n.Range,
+				Offset:     n.Offset,
+			})
+		case *promql.AggregateExpr:
+			addOnce(&a.Aggregations, "aggregation", n.Op.String())
+		case *promql.Call:
+			addOnce(&a.Functions, "function", n.Func.Name)
+		}
+		return nil
+	})
+
+	return a, nil
+}
+
+// SourceIDs returns the value of the source_id matcher of each selector. It
+// returns an error if a selector does not have one.
+func (a *Analysis) SourceIDs() ([]string, error) {
+	var sourceIDs []string
+	for _, s := range a.Selectors {
+		sourceID, ok := s.Matcher("source_id")
+		if !ok || sourceID.Value == "" {
+			return nil, fmt.Errorf("Metric '%s' does not have a 'source_id' label.", s.MetricName)
+		}
+		sourceIDs = append(sourceIDs, sourceID.Value)
+	}
+
+	return sourceIDs, nil
+}
+
+// Lookback returns how far before the evaluation time the query reads
+// (i.e., the largest range plus offset of any selector).
+func (a *Analysis) Lookback() time.Duration {
+	var max time.Duration
+	for _, s := range a.Selectors {
+		if d := s.Range + s.Offset; d > max {
+			max = d
+		}
+	}
+
+	return max
+}
+
+// Matcher returns the selector's (first) matcher for the given label. A
+// selector can have several matchers for the same label (e.g.,
+// {source_id="a", source_id=~".+"}), so use Matchers to check all of them.
+func (s Selector) Matcher(name string) (Matcher, bool) {
+	for _, m := range s.Matchers {
+		if m.Name == name {
+			return m, true
+		}
+	}
+
+	return Matcher{}, false
+}
+
+func convertMatchers(ms []*labels.Matcher) []Matcher {
+	var result []Matcher
+	for _, m := range ms {
+		result = append(result, Matcher{
+			Name:  m.Name,
+			Type:  MatchType(m.Type.String()),
+			Value: m.Value,
+		})
+	}
+
+	return result
+}
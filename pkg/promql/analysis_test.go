@@ -0,0 +1,82 @@
+package promql_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache/pkg/promql"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+func TestAnalyze(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Spec("it reports the selectors", func(t *testing.T) {
+		a, err := promql.Analyze(`rate(metric{source_id="a",job=~"j.*"}[5m] offset 1m) / other{source_id!="b"}`)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, a.MetricNames).To(Equal([]string{"metric", "other"}))
+		Expect(t, a.Selectors).To(Equal([]promql.Selector{
+			{
+				MetricName: "metric",
+				Matchers: []promql.Matcher{
+					{Name: "source_id", Type: promql.MatchEqual, Value: "a"},
+					{Name: "job", Type: promql.MatchRegexp, Value: "j.*"},
+					{Name: "__name__", Type: promql.MatchEqual, Value: "metric"},
+				},
+				Range:  5 * time.Minute,
+				Offset: time.Minute,
+			},
+			{
+				MetricName: "other",
+				Matchers: []promql.Matcher{
+					{Name: "source_id", Type: promql.MatchNotEqual, Value: "b"},
+					{Name: "__name__", Type: promql.MatchEqual, Value: "other"},
+				},
+			},
+		}))
+		Expect(t, a.Functions).To(Equal([]string{"rate"}))
+	})
+
+	o.Spec("it reports each aggregation and function once", func(t *testing.T) {
+		a, err := promql.Analyze(`sum(rate(a{source_id="a"}[1m])) + sum(avg(rate(a{source_id="a"}[1m]))) + abs(b{source_id="b"})`)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, a.MetricNames).To(Equal([]string{"a", "b"}))
+		Expect(t, a.Aggregations).To(Equal([]string{"sum", "avg"}))
+		Expect(t, a.Functions).To(Equal([]string{"rate", "abs"}))
+		Expect(t, a.Selectors).To(HaveLen(3))
+	})
+
+	o.Spec("it reports the lookback", func(t *testing.T) {
+		a, err := promql.Analyze(`rate(a{source_id="a"}[5m]) + rate(b{source_id="b"}[1m] offset 10m) + c{source_id="c"}`)
+		Expect(t, err).To(BeNil())
+		Expect(t, a.Lookback()).To(Equal(11 * time.Minute))
+	})
+
+	o.Spec("it returns the source IDs", func(t *testing.T) {
+		a, err := promql.Analyze(`a{source_id="a"} + b{source_id="b"}`)
+		Expect(t, err).To(BeNil())
+
+		sourceIDs, err := a.SourceIDs()
+		Expect(t, err).To(BeNil())
+		Expect(t, sourceIDs).To(Equal([]string{"a", "b"}))
+	})
+
+	o.Spec("it returns an error for a selector without a source ID", func(t *testing.T) {
+		a, err := promql.Analyze(`a{source_id="a"} + b`)
+		Expect(t, err).To(BeNil())
+
+		_, err = a.SourceIDs()
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for an invalid query", func(t *testing.T) {
+		_, err := promql.Analyze(`}{`)
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
@@ -0,0 +1,207 @@
+package promql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache"
+)
+
+// CachingClient sits in front of a PromQLClient. Identical queries that are
+// made while one is already in flight share its result, and results are
+// cached for a short TTL so readers registered with the same query only hit
+// Log Cache once per tick.
+//
+// A shared query is not bound to the context of the caller that started
+// it. It runs until the client's own timeout while each caller only waits
+// as long as its own context allows.
+type CachingClient struct {
+	c       PromQLClient
+	ttl     time.Duration
+	timeout time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+
+	hits      uint64
+	misses    uint64
+	coalesced uint64
+}
+
+type PromQLClient interface {
+	PromQL(ctx context.Context, query string) (*faaspromql.QueryResult, error)
+	PromQLAt(ctx context.Context, query string, t time.Time) (*faaspromql.QueryResult, error)
+}
+
+// CacheStats are the counters reported by CachingClient.
+type CacheStats struct {
+	// Hits is the number of queries answered from the cache.
+	Hits uint64
+
+	// Misses is the number of queries that were sent to the PromQLClient.
+	Misses uint64
+
+	// Coalesced is the number of queries that waited on an identical
+	// in-flight query instead of making their own.
+	Coalesced uint64
+}
+
+type cacheEntry struct {
+	done    chan struct{}
+	result  *faaspromql.QueryResult
+	err     error
+	expires time.Time
+}
+
+// CachingClientOption configures a CachingClient.
+type CachingClientOption func(*CachingClient)
+
+// WithCacheTimeout sets how long a shared query may take. It should be at
+// least as long as the longest timeout of the callers. Defaults to 5
+// seconds.
+func WithCacheTimeout(d time.Duration) CachingClientOption {
+	return func(c *CachingClient) {
+		c.timeout = d
+	}
+}
+
+func NewCachingClient(c PromQLClient, ttl time.Duration, opts ...CachingClientOption) *CachingClient {
+	cc := &CachingClient{
+		c:       c,
+		ttl:     ttl,
+		timeout: 5 * time.Second,
+		now:     time.Now,
+		entries: make(map[string]*cacheEntry),
+	}
+
+	for _, o := range opts {
+		o(cc)
+	}
+
+	return cc
+}
+
+func (c *CachingClient) PromQL(ctx context.Context, query string) (*faaspromql.QueryResult, error) {
+	return c.do(ctx, query, func(ctx context.Context) (*faaspromql.QueryResult, error) {
+		return c.c.PromQL(ctx, query)
+	})
+}
+
+// PromQLAt is like PromQL, however the query is evaluated at the given time.
+// It only shares results with queries for the same time.
+func (c *CachingClient) PromQLAt(ctx context.Context, query string, t time.Time) (*faaspromql.QueryResult, error) {
+	key := fmt.Sprintf("%s@%d", query, t.UnixNano())
+	return c.do(ctx, key, func(ctx context.Context) (*faaspromql.QueryResult, error) {
+		return c.c.PromQLAt(ctx, query, t)
+	})
+}
+
+func (c *CachingClient) do(
+	ctx context.Context,
+	key string,
+	f func(context.Context) (*faaspromql.QueryResult, error),
+) (*faaspromql.QueryResult, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		select {
+		case <-e.done:
+			if c.now().Before(e.expires) {
+				c.mu.Unlock()
+				atomic.AddUint64(&c.hits, 1)
+				return copyResult(e.result), nil
+			}
+		default:
+			c.mu.Unlock()
+			atomic.AddUint64(&c.coalesced, 1)
+			return c.wait(ctx, e)
+		}
+	}
+
+	c.pruneLocked()
+	e = &cacheEntry{
+		done: make(chan struct{}),
+	}
+	c.entries[key] = e
+	c.mu.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	go c.run(key, e, f)
+
+	return c.wait(ctx, e)
+}
+
+// run makes the shared query on its own context, so that it is not cut
+// short when the caller that started it gives up.
+func (c *CachingClient) run(
+	key string,
+	e *cacheEntry,
+	f func(context.Context) (*faaspromql.QueryResult, error),
+) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	e.result, e.err = f(ctx)
+	e.expires = c.now().Add(c.ttl)
+
+	if e.err != nil {
+		// Don't cache failures. Anyone already waiting will still get the
+		// error.
+		c.mu.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+	close(e.done)
+}
+
+// Stats returns the cache counters.
+func (c *CachingClient) Stats() CacheStats {
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Coalesced: atomic.LoadUint64(&c.coalesced),
+	}
+}
+
+func (c *CachingClient) wait(ctx context.Context, e *cacheEntry) (*faaspromql.QueryResult, error) {
+	select {
+	case <-e.done:
+		if e.err != nil {
+			return nil, e.err
+		}
+		return copyResult(e.result), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pruneLocked removes expired entries. c.mu must be held.
+func (c *CachingClient) pruneLocked() {
+	now := c.now()
+	for k, e := range c.entries {
+		select {
+		case <-e.done:
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		default:
+		}
+	}
+}
+
+// copyResult returns a copy of the result that the caller can modify
+// without affecting the cached value.
+func copyResult(r *faaspromql.QueryResult) *faaspromql.QueryResult {
+	cp := *r
+	cp.Data.Result = append([]interface{}(nil), r.Data.Result...)
+	cp.Data.RawResult = append([]json.RawMessage(nil), r.Data.RawResult...)
+	cp.Warnings = append([]string(nil), r.Warnings...)
+	return &cp
+}
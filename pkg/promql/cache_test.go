@@ -0,0 +1,235 @@
+package promql_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/pkg/promql"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TCC struct {
+	*testing.T
+	spyPromQLClient *spyPromQLClient
+}
+
+func TestCachingClient(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TCC {
+		return TCC{
+			T:               t,
+			spyPromQLClient: newSpyPromQLClient(),
+		}
+	})
+
+	o.Spec("it caches results for the TTL", func(t TCC) {
+		t.spyPromQLClient.result = &faaspromql.QueryResult{
+			Status: "success",
+			Data: faaspromql.RawResult{
+				Result: []interface{}{1},
+			},
+		}
+		c := promql.NewCachingClient(t.spyPromQLClient, time.Hour)
+
+		r1, err := c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(BeNil())
+		r2, err := c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyPromQLClient.Calls()).To(Equal(1))
+		Expect(t, r1).To(Equal(t.spyPromQLClient.result))
+		Expect(t, r2).To(Equal(t.spyPromQLClient.result))
+		Expect(t, c.Stats()).To(Equal(promql.CacheStats{Hits: 1, Misses: 1}))
+	})
+
+	o.Spec("it returns copies that can be modified", func(t TCC) {
+		t.spyPromQLClient.result = &faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				Result: []interface{}{1},
+			},
+		}
+		c := promql.NewCachingClient(t.spyPromQLClient, time.Hour)
+
+		r1, _ := c.PromQL(context.Background(), "some-query")
+		r1.Context = "some-context"
+		r1.Data.Result[0] = 2
+
+		r2, _ := c.PromQL(context.Background(), "some-query")
+		Expect(t, r2.Context).To(Equal(""))
+		Expect(t, r2.Data.Result).To(Equal([]interface{}{1}))
+	})
+
+	o.Spec("it does not share results between different queries", func(t TCC) {
+		t.spyPromQLClient.result = &faaspromql.QueryResult{}
+		c := promql.NewCachingClient(t.spyPromQLClient, time.Hour)
+
+		c.PromQL(context.Background(), "some-query")
+		c.PromQL(context.Background(), "other-query")
+
+		Expect(t, t.spyPromQLClient.Calls()).To(Equal(2))
+		Expect(t, c.Stats()).To(Equal(promql.CacheStats{Misses: 2}))
+	})
+
+	o.Spec("it only shares results for queries at the same time", func(t TCC) {
+		t.spyPromQLClient.result = &faaspromql.QueryResult{}
+		c := promql.NewCachingClient(t.spyPromQLClient, time.Hour)
+
+		c.PromQLAt(context.Background(), "some-query", time.Unix(1, 0))
+		c.PromQLAt(context.Background(), "some-query", time.Unix(1, 0))
+		c.PromQLAt(context.Background(), "some-query", time.Unix(2, 0))
+		c.PromQL(context.Background(), "some-query")
+
+		Expect(t, t.spyPromQLClient.Calls()).To(Equal(3))
+		Expect(t, t.spyPromQLClient.Times()).To(Equal([]time.Time{time.Unix(1, 0), time.Unix(2, 0)}))
+	})
+
+	o.Spec("it queries again after the TTL", func(t TCC) {
+		t.spyPromQLClient.result = &faaspromql.QueryResult{}
+		c := promql.NewCachingClient(t.spyPromQLClient, 0)
+
+		c.PromQL(context.Background(), "some-query")
+		c.PromQL(context.Background(), "some-query")
+
+		Expect(t, t.spyPromQLClient.Calls()).To(Equal(2))
+	})
+
+	o.Spec("it does not cache errors", func(t TCC) {
+		t.spyPromQLClient.err = errors.New("some-error")
+		c := promql.NewCachingClient(t.spyPromQLClient, time.Hour)
+
+		_, err := c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(Not(BeNil()))
+		_, err = c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(Not(BeNil()))
+
+		Expect(t, t.spyPromQLClient.Calls()).To(Equal(2))
+	})
+
+	o.Spec("it coalesces identical in-flight queries", func(t TCC) {
+		t.spyPromQLClient.result = &faaspromql.QueryResult{Status: "success"}
+		t.spyPromQLClient.block = make(chan struct{})
+		c := promql.NewCachingClient(t.spyPromQLClient, time.Hour)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.PromQL(context.Background(), "some-query")
+		}()
+		Expect(t, t.spyPromQLClient.Calls).To(ViaPolling(Equal(1)))
+
+		done := make(chan *faaspromql.QueryResult, 1)
+		go func() {
+			r, _ := c.PromQL(context.Background(), "some-query")
+			done <- r
+		}()
+		Expect(t, func() uint64 { return c.Stats().Coalesced }).To(ViaPolling(Equal(uint64(1))))
+
+		close(t.spyPromQLClient.block)
+		wg.Wait()
+
+		Expect(t, <-done).To(Equal(t.spyPromQLClient.result))
+		Expect(t, t.spyPromQLClient.Calls()).To(Equal(1))
+	})
+
+	o.Spec("it does not bind a shared query to the context of its first caller", func(t TCC) {
+		t.spyPromQLClient.result = &faaspromql.QueryResult{Status: "success"}
+		t.spyPromQLClient.block = make(chan struct{})
+		c := promql.NewCachingClient(t.spyPromQLClient, time.Hour, promql.WithCacheTimeout(time.Hour))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 1)
+		go func() {
+			_, err := c.PromQL(ctx, "some-query")
+			errs <- err
+		}()
+		Expect(t, t.spyPromQLClient.Calls).To(ViaPolling(Equal(1)))
+
+		done := make(chan *faaspromql.QueryResult, 1)
+		go func() {
+			r, _ := c.PromQL(context.Background(), "some-query")
+			done <- r
+		}()
+		Expect(t, func() uint64 { return c.Stats().Coalesced }).To(ViaPolling(Equal(uint64(1))))
+
+		cancel()
+		Expect(t, <-errs).To(Equal(context.Canceled))
+		Expect(t, t.spyPromQLClient.Ctx().Err()).To(BeNil())
+
+		close(t.spyPromQLClient.block)
+		Expect(t, <-done).To(Equal(t.spyPromQLClient.result))
+	})
+
+	o.Spec("it bounds a shared query by its own timeout", func(t TCC) {
+		t.spyPromQLClient.result = &faaspromql.QueryResult{}
+		c := promql.NewCachingClient(t.spyPromQLClient, time.Hour, promql.WithCacheTimeout(time.Minute))
+
+		c.PromQL(context.Background(), "some-query")
+
+		deadline, ok := t.spyPromQLClient.Ctx().Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, deadline.Before(time.Now().Add(time.Minute))).To(BeTrue())
+	})
+}
+
+type spyPromQLClient struct {
+	mu     sync.Mutex
+	calls  int
+	ctx    context.Context
+	times  []time.Time
+	result *faaspromql.QueryResult
+	err    error
+	block  chan struct{}
+}
+
+func newSpyPromQLClient() *spyPromQLClient {
+	return &spyPromQLClient{}
+}
+
+func (s *spyPromQLClient) PromQL(ctx context.Context, query string) (*faaspromql.QueryResult, error) {
+	s.mu.Lock()
+	s.calls++
+	s.ctx = ctx
+	s.mu.Unlock()
+
+	if s.block != nil {
+		<-s.block
+	}
+
+	return s.result, s.err
+}
+
+func (s *spyPromQLClient) PromQLAt(ctx context.Context, query string, t time.Time) (*faaspromql.QueryResult, error) {
+	s.mu.Lock()
+	s.times = append(s.times, t)
+	s.mu.Unlock()
+
+	return s.PromQL(ctx, query)
+}
+
+func (s *spyPromQLClient) Times() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.times
+}
+
+func (s *spyPromQLClient) Ctx() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ctx
+}
+
+func (s *spyPromQLClient) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
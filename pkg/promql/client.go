@@ -12,9 +12,22 @@ import (
 )
 
 type Client struct {
-	addr string
-	s    AppNameSanitizer
-	d    Doer
+	addr    string
+	s       AppNameSanitizer
+	d       Doer
+	timeout time.Duration
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithTimeout sets how long a query (including sanitizing it) may take. The
+// timeout only ever shortens the deadline of the given context. Defaults to
+// 5 seconds.
+func WithTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.timeout = d
+	}
 }
 
 type Doer interface {
@@ -25,12 +38,19 @@ type AppNameSanitizer interface {
 	Sanitize(ctx context.Context, query string) (string, error)
 }
 
-func NewClient(addr string, s AppNameSanitizer, d Doer) *Client {
-	return &Client{
-		addr: addr,
-		d:    d,
-		s:    s,
+func NewClient(addr string, s AppNameSanitizer, d Doer, opts ...ClientOption) *Client {
+	c := &Client{
+		addr:    addr,
+		d:       d,
+		s:       s,
+		timeout: 5 * time.Second,
 	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
 }
 
 func (c *Client) PromQLRange(
@@ -47,6 +67,14 @@ func (c *Client) PromQL(ctx context.Context, query string) (*faaspromql.QueryRes
 	return c.promql(ctx, query, false, time.Time{}, time.Time{}, 0)
 }
 
+// PromQLAt evaluates an instant query at the given time instead of at the
+// time Log Cache receives the query.
+func (c *Client) PromQLAt(ctx context.Context, query string, t time.Time) (*faaspromql.QueryResult, error) {
+	return c.promql(ctx, query, false, t, time.Time{}, 0)
+}
+
+// promql makes an instant query (evaluated at start if it is set) or a range
+// query.
 func (c *Client) promql(
 	ctx context.Context,
 	query string,
@@ -55,9 +83,10 @@ func (c *Client) promql(
 	end time.Time,
 	step time.Duration,
 ) (*faaspromql.QueryResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
 
-	sctx, _ := context.WithTimeout(ctx, 5*time.Second)
-	query, err := c.s.Sanitize(sctx, query)
+	query, err := c.s.Sanitize(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -74,19 +103,27 @@ func (c *Client) promql(
 	v := req.URL.Query()
 	v.Set("query", query)
 
+	// Log Cache expects timestamps in nanoseconds.
 	if isRange {
-		v.Set("start", fmt.Sprint(start.Unix()))
-		v.Set("end", fmt.Sprint(end.Unix()))
+		v.Set("start", fmt.Sprint(start.UnixNano()))
+		v.Set("end", fmt.Sprint(end.UnixNano()))
 		v.Set("step", step.String())
+	} else if !start.IsZero() {
+		v.Set("time", fmt.Sprint(start.UnixNano()))
 	}
 
 	req.URL.RawQuery = v.Encode()
 
-	rctx, _ := context.WithTimeout(ctx, 5*time.Second)
-	req = req.WithContext(rctx)
+	req = req.WithContext(ctx)
 
 	resp, err := c.d.Do(req)
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &Error{
+				Type: ErrTimeout,
+				Msg:  fmt.Sprintf("PromQL request timed out: %s", err),
+			}
+		}
 		return nil, fmt.Errorf("failed to make PromQL request: %s", err)
 	}
 
@@ -95,19 +132,26 @@ func (c *Client) promql(
 		resp.Body.Close()
 	}()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status code %d getting PromQL results: %s", resp.StatusCode, body)
-	}
-
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read body: %s", err)
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError(resp.StatusCode, data)
+	}
+
 	var result faaspromql.QueryResult
 	if err := faaspromql.UnmarshalJSON(data, &result); err != nil {
-		return nil, fmt.Errorf("failed to parse QueryResult: %s", err)
+		return nil, &Error{
+			Type:       ErrBadResponse,
+			Msg:        fmt.Sprintf("failed to parse QueryResult: %s", err),
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	if result.Status == "error" {
+		return nil, newError(resp.StatusCode, data)
 	}
 
 	return &result, nil
@@ -142,6 +142,23 @@ func TestClientPromQL(t *testing.T) {
 		}))
 	})
 
+	o.Spec("evaluates the query at the given time", func(t TC) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(
+				strings.NewReader(vectorResult()),
+			),
+		}
+		t.spyAppNameSanitizer.result = "some-san-query"
+
+		_, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(0, 99))
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyDoer.req.URL.Path).To(Equal("/api/v1/query"))
+		Expect(t, t.spyDoer.req.URL.Query()["query"]).To(Equal([]string{"some-san-query"}))
+		Expect(t, t.spyDoer.req.URL.Query()["time"]).To(Equal([]string{"99"}))
+	})
+
 	o.Spec("returns an error if the request fails", func(t TC) {
 		t.spyAppNameSanitizer.err = errors.New("some-error")
 		t.spyDoer.resp = &http.Response{
@@ -200,6 +217,128 @@ func TestClientPromQL(t *testing.T) {
 		Expect(t, err).To(Not(BeNil()))
 	})
 
+	o.Spec("returns a typed error for a Prometheus API error", func(t TC) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: 400,
+			Body: ioutil.NopCloser(
+				strings.NewReader(`{"status":"error","errorType":"bad_data","error":"parse error"}`),
+			),
+		}
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(Not(BeNil()))
+
+		e, ok := err.(*promql.Error)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, e.Type).To(Equal(promql.ErrBadData))
+		Expect(t, e.Msg).To(Equal("parse error"))
+		Expect(t, e.StatusCode).To(Equal(400))
+		Expect(t, e.Temporary()).To(BeFalse())
+		Expect(t, e.BadQuery()).To(BeTrue())
+	})
+
+	o.Spec("returns a temporary error for a timeout", func(t TC) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: 503,
+			Body: ioutil.NopCloser(
+				strings.NewReader(`{"status":"error","errorType":"timeout","error":"query timed out"}`),
+			),
+		}
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		e, ok := err.(*promql.Error)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, e.Type).To(Equal(promql.ErrTimeout))
+		Expect(t, e.Temporary()).To(BeTrue())
+	})
+
+	o.Spec("returns a server error for a 5xx without an API envelope", func(t TC) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: 502,
+			Body: ioutil.NopCloser(
+				strings.NewReader("bad gateway"),
+			),
+		}
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		e, ok := err.(*promql.Error)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, e.Type).To(Equal(promql.ErrServer))
+		Expect(t, e.Msg).To(Equal("bad gateway"))
+		Expect(t, e.Temporary()).To(BeTrue())
+	})
+
+	o.Spec("returns a client error for a 4xx without an API envelope", func(t TC) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: 404,
+			Body: ioutil.NopCloser(
+				strings.NewReader("not found"),
+			),
+		}
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		e, ok := err.(*promql.Error)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, e.Type).To(Equal(promql.ErrClient))
+		Expect(t, e.Temporary()).To(BeFalse())
+	})
+
+	o.Spec("returns a typed error for an error status with a 200", func(t TC) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(
+				strings.NewReader(`{"status":"error","errorType":"execution","error":"some-error"}`),
+			),
+		}
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		e, ok := err.(*promql.Error)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, e.Type).To(Equal(promql.ErrExec))
+	})
+
+	o.Spec("surfaces warnings on the result", func(t TC) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(
+				strings.NewReader(`{"status":"success","data":{"resultType":"vector"},"warnings":["some-warning"]}`),
+			),
+		}
+
+		results, err := t.c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(BeNil())
+		Expect(t, results.Warnings).To(Equal([]string{"some-warning"}))
+	})
+
+	o.Spec("it uses the configured timeout", func(t TC) {
+		t.c = promql.NewClient("http://some.url", t.spyAppNameSanitizer, t.spyDoer, promql.WithTimeout(time.Hour))
+		t.spyDoer.resp = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(
+				strings.NewReader(emptyVectorResult()),
+			),
+		}
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(BeNil())
+
+		deadline, ok := t.spyDoer.req.Context().Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, deadline.After(time.Now().Add(time.Minute))).To(BeTrue())
+		Expect(t, t.spyAppNameSanitizer.ctx).To(Equal(t.spyDoer.req.Context()))
+	})
+
+	o.Spec("returns a timeout error if the deadline is exceeded", func(t TC) {
+		t.c = promql.NewClient("http://some.url", t.spyAppNameSanitizer, t.spyDoer, promql.WithTimeout(0))
+		t.spyDoer.err = errors.New("some-error")
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		e, ok := err.(*promql.Error)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, e.Timeout()).To(BeTrue())
+		Expect(t, e.Temporary()).To(BeTrue())
+	})
+
 	o.Spec("it returns an error for an invalid addr", func(t TC) {
 		t.spyDoer.resp = &http.Response{
 			StatusCode: 200,
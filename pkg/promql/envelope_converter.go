@@ -0,0 +1,236 @@
+package promql
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+)
+
+// DefaultTimerBuckets are the upper bounds (in seconds) of the histograms
+// built from timers. They match Prometheus client's default buckets.
+var DefaultTimerBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	// LogLinesMetric counts the log envelopes of each series. Besides the
+	// envelope's tags, each series has a log_type label (OUT or ERR) and
+	// the labels captured by the log patterns.
+	LogLinesMetric = "log_lines_total"
+
+	// EventsMetric counts the event envelopes of each series. Besides the
+	// envelope's tags, each series has a title label.
+	EventsMetric = "events_total"
+)
+
+// point is a value for the series with the given tags.
+type point struct {
+	tags map[string]string
+	v    float64
+}
+
+// envelopeConverter turns the envelopes of a single source into points for
+// a metric. It is stateful: counters that only report deltas and timer
+// histograms accumulate across the envelopes of the window. Therefore the
+// envelopes must be converted in order.
+type envelopeConverter struct {
+	metric      string
+	buckets     []float64
+	logPatterns []*regexp.Regexp
+
+	counters   map[string]float64
+	histograms map[string]*histogram
+}
+
+// histogram is the cumulative state of a timer's histogram series.
+type histogram struct {
+	counts []float64
+	count  float64
+	sum    float64
+}
+
+func newEnvelopeConverter(metric string, buckets []float64, logPatterns []*regexp.Regexp) *envelopeConverter {
+	if len(buckets) == 0 {
+		buckets = DefaultTimerBuckets
+	}
+
+	return &envelopeConverter{
+		metric:      metric,
+		buckets:     buckets,
+		logPatterns: logPatterns,
+		counters:    make(map[string]float64),
+		histograms:  make(map[string]*histogram),
+	}
+}
+
+// labels returns a copy of the envelope's tags with the labels derived from
+// logs and events. The named groups of each log pattern that matches the
+// payload become labels (e.g., (?P<status>\d{3}) adds a status label).
+// Logs and events are only labeled for their own metric (or for any metric
+// if the converter has none, e.g., for label discovery) since matching the
+// patterns is expensive.
+func (c *envelopeConverter) labels(e *loggregator_v2.Envelope) map[string]string {
+	tags := make(map[string]string, len(e.GetTags())+2)
+	for k, v := range e.GetTags() {
+		tags[k] = v
+	}
+
+	switch e.Message.(type) {
+	case *loggregator_v2.Envelope_Log:
+		if !c.labelsFor(LogLinesMetric) {
+			break
+		}
+
+		tags["log_type"] = e.GetLog().GetType().String()
+
+		payload := e.GetLog().GetPayload()
+		for _, re := range c.logPatterns {
+			match := re.FindSubmatch(payload)
+			if match == nil {
+				continue
+			}
+
+			for i, name := range re.SubexpNames() {
+				if name != "" && match[i] != nil {
+					tags[name] = string(match[i])
+				}
+			}
+		}
+	case *loggregator_v2.Envelope_Event:
+		if c.labelsFor(EventsMetric) {
+			tags["title"] = e.GetEvent().GetTitle()
+		}
+	}
+
+	return tags
+}
+
+func (c *envelopeConverter) labelsFor(metric string) bool {
+	return c.metric == "" || c.metric == metric
+}
+
+// convert returns the points the envelope has for the converter's metric.
+// The tags are owned by the converter's points and must not be reused by
+// the caller.
+func (c *envelopeConverter) convert(e *loggregator_v2.Envelope, tags map[string]string) []point {
+	switch e.Message.(type) {
+	case *loggregator_v2.Envelope_Counter:
+		return c.convertCounter(e.GetCounter(), tags)
+	case *loggregator_v2.Envelope_Gauge:
+		v := checkMapForSanitizedMetricName(e.GetGauge(), c.metric)
+		if v == nil {
+			return nil
+		}
+		return []point{{tags: tags, v: v.GetValue()}}
+	case *loggregator_v2.Envelope_Timer:
+		return c.convertTimer(e.GetTimer(), tags)
+	case *loggregator_v2.Envelope_Log:
+		return c.count(LogLinesMetric, tags)
+	case *loggregator_v2.Envelope_Event:
+		return c.count(EventsMetric, tags)
+	default:
+		return nil
+	}
+}
+
+// count returns the number of envelopes of the series so far. Like any
+// counter, it is meant to be used with rate, increase, etc. (e.g.,
+// increase(log_lines_total{status=~"5.."}[1m])). It starts at zero with
+// each query's window.
+func (c *envelopeConverter) count(metric string, tags map[string]string) []point {
+	if c.metric != metric {
+		return nil
+	}
+
+	id := getSeriesID(tags)
+	c.counters[id]++
+
+	return []point{{tags: tags, v: c.counters[id]}}
+}
+
+// convertCounter uses the counter's total. Some emitters only report
+// deltas, in which case the running total is accumulated over the window.
+// A total that goes down is a reset, which Prometheus' rate and increase
+// already account for.
+func (c *envelopeConverter) convertCounter(counter *loggregator_v2.Counter, tags map[string]string) []point {
+	if sanitizedNames.sanitize(counter.GetName()) != c.metric {
+		return nil
+	}
+
+	id := getSeriesID(tags)
+	total := float64(counter.GetTotal())
+	if counter.GetTotal() == 0 && counter.GetDelta() != 0 {
+		total = c.counters[id] + float64(counter.GetDelta())
+	}
+	c.counters[id] = total
+
+	return []point{{tags: tags, v: total}}
+}
+
+// convertTimer returns the timer's duration in nanoseconds for its own
+// name, and the cumulative _bucket, _sum and _count series of a histogram
+// of its durations in seconds for the derived names. This allows queries
+// such as histogram_quantile(0.99, rate(http_bucket[5m])).
+func (c *envelopeConverter) convertTimer(timer *loggregator_v2.Timer, tags map[string]string) []point {
+	name := sanitizedNames.sanitize(timer.GetName())
+	duration := timer.GetStop() - timer.GetStart()
+
+	switch c.metric {
+	case name:
+		return []point{{tags: tags, v: float64(duration)}}
+	case name + "_bucket", name + "_sum", name + "_count":
+	default:
+		return nil
+	}
+
+	id := getSeriesID(tags)
+	h, ok := c.histograms[id]
+	if !ok {
+		h = &histogram{counts: make([]float64, len(c.buckets))}
+		c.histograms[id] = h
+	}
+
+	seconds := float64(duration) / 1e9
+	h.count++
+	h.sum += seconds
+	if i := sort.SearchFloat64s(c.buckets, seconds); i < len(c.buckets) {
+		// Buckets are cumulative, so the duration counts toward each
+		// bucket from the first one it fits into.
+		for ; i < len(h.counts); i++ {
+			h.counts[i]++
+		}
+	}
+
+	switch c.metric {
+	case name + "_sum":
+		return []point{{tags: tags, v: h.sum}}
+	case name + "_count":
+		return []point{{tags: tags, v: h.count}}
+	}
+
+	points := make([]point, 0, len(c.buckets)+1)
+	for i, b := range c.buckets {
+		points = append(points, point{tags: withLabel(tags, "le", formatBound(b)), v: h.counts[i]})
+	}
+
+	return append(points, point{tags: withLabel(tags, "le", "+Inf"), v: h.count})
+}
+
+func withLabel(tags map[string]string, name, value string) map[string]string {
+	m := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		m[k] = v
+	}
+	m[name] = value
+
+	return m
+}
+
+func formatBound(b float64) string {
+	if math.IsInf(b, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(b, 'f', -1, 64)
+}
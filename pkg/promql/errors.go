@@ -0,0 +1,101 @@
+package promql
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ErrorType is the errorType reported by the Prometheus HTTP API. Types
+// that the API does not report itself (e.g., ErrServer) are derived from
+// the status code.
+type ErrorType string
+
+const (
+	ErrBadData     ErrorType = "bad_data"
+	ErrTimeout     ErrorType = "timeout"
+	ErrCanceled    ErrorType = "canceled"
+	ErrExec        ErrorType = "execution"
+	ErrBadResponse ErrorType = "bad_response"
+	ErrServer      ErrorType = "server_error"
+	ErrClient      ErrorType = "client_error"
+)
+
+// Error is returned by the Client when the PromQL endpoint reports a
+// failure.
+type Error struct {
+	Type       ErrorType
+	Msg        string
+	StatusCode int
+	Warnings   []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (status code %d): %s", e.Type, e.StatusCode, e.Msg)
+}
+
+// Temporary reports whether the same query might succeed if retried. A bad
+// query will never succeed, whereas a timeout or an unavailable server
+// might.
+func (e *Error) Temporary() bool {
+	switch e.Type {
+	case ErrBadData, ErrExec:
+		return false
+	case ErrClient:
+		return e.StatusCode == http.StatusTooManyRequests
+	default:
+		return true
+	}
+}
+
+// BadQuery reports whether the query itself is invalid (e.g., it can't be
+// parsed). Unlike other errors that are not temporary (e.g., a 401 from an
+// expired token), nothing but changing the query will fix it.
+func (e *Error) BadQuery() bool {
+	return e.Type == ErrBadData
+}
+
+// Timeout reports whether the query failed because it ran out of time.
+func (e *Error) Timeout() bool {
+	return e.Type == ErrTimeout
+}
+
+// apiEnvelope is the part of the Prometheus API response that describes a
+// failure.
+type apiEnvelope struct {
+	Status    string   `json:"status"`
+	ErrorType string   `json:"errorType"`
+	Error     string   `json:"error"`
+	Warnings  []string `json:"warnings"`
+}
+
+// newError builds an Error from a response body. If the body is not a
+// Prometheus API envelope, the error type is derived from the status code.
+func newError(statusCode int, body []byte) *Error {
+	var env apiEnvelope
+	if err := json.Unmarshal(body, &env); err != nil || env.ErrorType == "" {
+		return &Error{
+			Type:       statusErrorType(statusCode),
+			Msg:        string(body),
+			StatusCode: statusCode,
+		}
+	}
+
+	return &Error{
+		Type:       ErrorType(env.ErrorType),
+		Msg:        env.Error,
+		StatusCode: statusCode,
+		Warnings:   env.Warnings,
+	}
+}
+
+func statusErrorType(statusCode int) ErrorType {
+	switch {
+	case statusCode >= 500:
+		return ErrServer
+	case statusCode >= 400:
+		return ErrClient
+	default:
+		return ErrBadResponse
+	}
+}
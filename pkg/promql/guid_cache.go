@@ -0,0 +1,211 @@
+package promql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GuidCache sits in front of a GuidFetcher. Successful lookups are cached
+// for the positive TTL and apps that are not found for the negative TTL.
+// Other failures (e.g., CAPI timing out) are not cached, and a GUID that was
+// already cached is used until a lookup succeeds again. Entries that are in
+// use are refreshed in the background (see Refresh) so readers rarely wait
+// on CAPI.
+type GuidCache struct {
+	f           GuidFetcher
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*guidEntry
+
+	hits          uint64
+	misses        uint64
+	refreshes     uint64
+	invalidations uint64
+}
+
+// GuidCacheStats are the counters reported by GuidCache.
+type GuidCacheStats struct {
+	// Hits is the number of lookups answered from the cache.
+	Hits uint64
+
+	// Misses is the number of lookups that went to the GuidFetcher.
+	Misses uint64
+
+	// Refreshes is the number of lookups made by Refresh.
+	Refreshes uint64
+
+	// Invalidations is the number of cached GUIDs that were dropped because
+	// the app could no longer be found.
+	Invalidations uint64
+
+	// Size is the number of cached entries.
+	Size int
+}
+
+type guidEntry struct {
+	guid    string
+	err     error
+	expires time.Time
+	used    bool
+}
+
+func NewGuidCache(f GuidFetcher, positiveTTL, negativeTTL time.Duration) *GuidCache {
+	return &GuidCache{
+		f:           f,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		entries:     make(map[string]*guidEntry),
+	}
+}
+
+func (c *GuidCache) GetAppGuid(ctx context.Context, appName string) (string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[appName]
+	if ok && c.now().Before(e.expires) {
+		e.used = true
+		c.mu.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return e.guid, e.err
+	}
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.misses, 1)
+	guid, err := c.lookup(ctx, appName)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil && !IsNotFound(err) {
+		if old, ok := c.entries[appName]; ok && old.err == nil {
+			old.used = true
+			return old.guid, nil
+		}
+
+		return "", err
+	}
+
+	c.entries[appName] = c.newEntry(guid, err)
+	c.entries[appName].used = true
+
+	return guid, err
+}
+
+// Refresh looks up the GUIDs that have been used since the last Refresh
+// again. Each lookup has its own timeout. Entries that were not used are
+// dropped once they expire. A cached GUID is invalidated if its app can no
+// longer be found, but kept if the lookup fails for any other reason.
+func (c *GuidCache) Refresh(ctx context.Context, timeout time.Duration) {
+	now := c.now()
+
+	var names []string
+	c.mu.Lock()
+	for name, e := range c.entries {
+		if !e.used {
+			if !now.Before(e.expires) {
+				delete(c.entries, name)
+			}
+			continue
+		}
+
+		e.used = false
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+
+	for _, name := range names {
+		atomic.AddUint64(&c.refreshes, 1)
+
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		guid, err := c.lookup(lookupCtx, name)
+		cancel()
+
+		if err != nil && !IsNotFound(err) {
+			continue
+		}
+
+		c.mu.Lock()
+		if old, ok := c.entries[name]; ok && old.err == nil && err != nil {
+			atomic.AddUint64(&c.invalidations, 1)
+		}
+		c.entries[name] = c.newEntry(guid, err)
+		c.mu.Unlock()
+	}
+}
+
+// RefreshEvery calls Refresh on every interval. It does not return.
+func (c *GuidCache) RefreshEvery(interval, timeout time.Duration) {
+	for range time.Tick(interval) {
+		c.Refresh(context.Background(), timeout)
+	}
+}
+
+// Stats returns the cache counters.
+func (c *GuidCache) Stats() GuidCacheStats {
+	c.mu.Lock()
+	size := len(c.entries)
+	c.mu.Unlock()
+
+	return GuidCacheStats{
+		Hits:          atomic.LoadUint64(&c.hits),
+		Misses:        atomic.LoadUint64(&c.misses),
+		Refreshes:     atomic.LoadUint64(&c.refreshes),
+		Invalidations: atomic.LoadUint64(&c.invalidations),
+		Size:          size,
+	}
+}
+
+// lookup treats an empty GUID as not found.
+func (c *GuidCache) lookup(ctx context.Context, appName string) (string, error) {
+	guid, err := c.f.GetAppGuid(ctx, appName)
+	if err == nil && guid == "" {
+		err = &notFoundError{appName: appName}
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return guid, nil
+}
+
+// IsNotFound reports whether the error means that the app does not exist
+// (e.g., capi.NotFoundError) rather than that the lookup failed.
+func IsNotFound(err error) bool {
+	nf, ok := err.(interface {
+		NotFound() bool
+	})
+
+	return ok && nf.NotFound()
+}
+
+type notFoundError struct {
+	appName string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("app %s not found", e.appName)
+}
+
+func (e *notFoundError) NotFound() bool {
+	return true
+}
+
+func (c *GuidCache) newEntry(guid string, err error) *guidEntry {
+	ttl := c.positiveTTL
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+
+	return &guidEntry{
+		guid:    guid,
+		err:     err,
+		expires: c.now().Add(ttl),
+	}
+}
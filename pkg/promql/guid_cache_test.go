@@ -0,0 +1,163 @@
+package promql_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache/pkg/promql"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TG struct {
+	*testing.T
+	c              *promql.GuidCache
+	spyGuidFetcher *spyGuidFetcher
+}
+
+func TestGuidCache(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TG {
+		spyGuidFetcher := newSpyGuidFetcher()
+		spyGuidFetcher.guids = map[string]string{
+			"some-app": "some-guid",
+		}
+
+		return TG{
+			T:              t,
+			c:              promql.NewGuidCache(spyGuidFetcher, time.Hour, time.Hour),
+			spyGuidFetcher: spyGuidFetcher,
+		}
+	})
+
+	o.Spec("it caches found GUIDs", func(t TG) {
+		guid, err := t.c.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("some-guid"))
+
+		guid, err = t.c.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("some-guid"))
+
+		Expect(t, t.spyGuidFetcher.appNames).To(Equal([]string{"some-app"}))
+		Expect(t, t.c.Stats()).To(Equal(promql.GuidCacheStats{Hits: 1, Misses: 1, Size: 1}))
+	})
+
+	o.Spec("it caches apps that are not found", func(t TG) {
+		_, err := t.c.GetAppGuid(context.Background(), "unknown-app")
+		Expect(t, err).To(Not(BeNil()))
+		_, err = t.c.GetAppGuid(context.Background(), "unknown-app")
+		Expect(t, err).To(Not(BeNil()))
+
+		Expect(t, t.spyGuidFetcher.appNames).To(Equal([]string{"unknown-app"}))
+	})
+
+	o.Spec("it looks up the GUID again after the TTL", func(t TG) {
+		t.c = promql.NewGuidCache(t.spyGuidFetcher, 0, 0)
+		t.c.GetAppGuid(context.Background(), "some-app")
+		t.c.GetAppGuid(context.Background(), "some-app")
+
+		Expect(t, t.spyGuidFetcher.appNames).To(HaveLen(2))
+	})
+
+	o.Spec("it refreshes the GUIDs that are in use", func(t TG) {
+		t.c.GetAppGuid(context.Background(), "some-app")
+		t.spyGuidFetcher.guids["some-app"] = "new-guid"
+
+		t.c.Refresh(context.Background(), time.Second)
+		Expect(t, t.spyGuidFetcher.appNames).To(HaveLen(2))
+
+		guid, _ := t.c.GetAppGuid(context.Background(), "some-app")
+		Expect(t, guid).To(Equal("new-guid"))
+		Expect(t, t.c.Stats().Refreshes).To(Equal(uint64(1)))
+	})
+
+	o.Spec("it does not refresh GUIDs that are not in use", func(t TG) {
+		t.c.GetAppGuid(context.Background(), "some-app")
+		t.c.Refresh(context.Background(), time.Second)
+		t.c.Refresh(context.Background(), time.Second)
+
+		Expect(t, t.spyGuidFetcher.appNames).To(HaveLen(2))
+	})
+
+	o.Spec("it drops expired entries that are not in use", func(t TG) {
+		t.c = promql.NewGuidCache(t.spyGuidFetcher, 0, 0)
+		t.c.GetAppGuid(context.Background(), "some-app")
+		t.c.Refresh(context.Background(), time.Second)
+		t.c.Refresh(context.Background(), time.Second)
+
+		Expect(t, t.c.Stats().Size).To(Equal(0))
+	})
+
+	o.Spec("it invalidates a GUID when the app is no longer found", func(t TG) {
+		t.c.GetAppGuid(context.Background(), "some-app")
+		delete(t.spyGuidFetcher.guids, "some-app")
+
+		t.c.Refresh(context.Background(), time.Second)
+
+		_, err := t.c.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.c.Stats().Invalidations).To(Equal(uint64(1)))
+	})
+
+	o.Spec("it returns the fetcher's error", func(t TG) {
+		t.spyGuidFetcher.err = errors.New("some-error")
+		_, err := t.c.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(Equal(t.spyGuidFetcher.err))
+	})
+
+	o.Spec("it does not cache errors other than not found", func(t TG) {
+		t.spyGuidFetcher.err = errors.New("some-error")
+		t.c.GetAppGuid(context.Background(), "some-app")
+
+		t.spyGuidFetcher.err = nil
+		guid, err := t.c.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("some-guid"))
+		Expect(t, t.c.Stats().Size).To(Equal(1))
+	})
+
+	o.Spec("it keeps an expired GUID if the lookup fails", func(t TG) {
+		t.c = promql.NewGuidCache(t.spyGuidFetcher, 0, time.Hour)
+		t.c.GetAppGuid(context.Background(), "some-app")
+
+		t.spyGuidFetcher.err = errors.New("some-error")
+		guid, err := t.c.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("some-guid"))
+	})
+
+	o.Spec("it keeps a GUID if a refresh fails", func(t TG) {
+		t.c.GetAppGuid(context.Background(), "some-app")
+		t.spyGuidFetcher.err = errors.New("some-error")
+
+		t.c.Refresh(context.Background(), time.Second)
+
+		t.spyGuidFetcher.err = nil
+		guid, err := t.c.GetAppGuid(context.Background(), "some-app")
+		Expect(t, err).To(BeNil())
+		Expect(t, guid).To(Equal("some-guid"))
+		Expect(t, t.c.Stats().Invalidations).To(Equal(uint64(0)))
+	})
+
+	o.Spec("it gives each refresh its own timeout", func(t TG) {
+		t.c.GetAppGuid(context.Background(), "some-app")
+		t.c.Refresh(context.Background(), time.Hour)
+
+		deadline, ok := t.spyGuidFetcher.ctx.Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, deadline.After(time.Now().Add(time.Minute))).To(BeTrue())
+	})
+
+	o.Spec("it recognizes errors for apps that are not found", func(t TG) {
+		_, err := t.c.GetAppGuid(context.Background(), "unknown-app")
+		Expect(t, promql.IsNotFound(err)).To(BeTrue())
+		Expect(t, promql.IsNotFound(errors.New("some-error"))).To(BeFalse())
+	})
+}
@@ -0,0 +1,375 @@
+package promql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// LocalClient evaluates PromQL queries itself instead of relying on Log
+// Cache's PromQL endpoint. It reads the envelopes for each selector and
+// runs the query with the Prometheus engine.
+type LocalClient struct {
+	r        DataReader
+	sources  SourceLister
+	s        AppNameSanitizer
+	timeout  time.Duration
+	limit    int64
+	maxPages int
+	buckets  []float64
+	patterns []*regexp.Regexp
+	engine   *promql.Engine
+}
+
+// LocalClientOption configures a LocalClient.
+type LocalClientOption func(*LocalClient)
+
+// WithLocalTimeout sets how long a query (including sanitizing it and
+// reading from Log Cache) may take. Defaults to 5 seconds.
+func WithLocalTimeout(d time.Duration) LocalClientOption {
+	return func(c *LocalClient) {
+		c.timeout = d
+	}
+}
+
+// WithEnvelopeLimit sets how many envelopes are requested from Log Cache at
+// a time. Defaults to 1000, the most Log Cache returns.
+func WithEnvelopeLimit(limit int) LocalClientOption {
+	return func(c *LocalClient) {
+		c.limit = int64(limit)
+	}
+}
+
+// WithMaxPages sets how many pages of envelopes are read for each selector.
+// A result that needed more is returned with a warning. Defaults to 10.
+func WithMaxPages(n int) LocalClientOption {
+	return func(c *LocalClient) {
+		c.maxPages = n
+	}
+}
+
+// WithTimerBuckets sets the upper bounds (in seconds) of the histograms
+// built from timers. A +Inf bucket is always included. Defaults to
+// DefaultTimerBuckets. The _bucket and _sum series are in seconds, whereas
+// the series named after the timer itself is its duration in nanoseconds.
+func WithTimerBuckets(buckets []float64) LocalClientOption {
+	return func(c *LocalClient) {
+		if len(buckets) == 0 {
+			return
+		}
+
+		c.buckets = nil
+		for _, b := range buckets {
+			if !math.IsInf(b, 1) {
+				c.buckets = append(c.buckets, b)
+			}
+		}
+		sort.Float64s(c.buckets)
+	}
+}
+
+// WithLogPatterns sets the patterns that derive labels from the payloads of
+// logs. The named groups of each pattern that matches become labels of the
+// log_lines_total series, e.g., (?P<status>\d{3}) allows
+// log_lines_total{source_id="...",status=~"5.."}.
+// log_lines_total and events_total are only evaluated by a LocalClient, not
+// by Log Cache's PromQL endpoint (see Client).
+func WithLogPatterns(patterns ...*regexp.Regexp) LocalClientOption {
+	return func(c *LocalClient) {
+		c.patterns = patterns
+	}
+}
+
+// NewLocalClient returns a LocalClient. If r is also a SourceLister (e.g.,
+// LogCacheReader), source_id can be matched with regexes and negative
+// matchers. Otherwise only source_id="..." is supported.
+func NewLocalClient(r DataReader, s AppNameSanitizer, opts ...LocalClientOption) *LocalClient {
+	c := &LocalClient{
+		r:        r,
+		s:        s,
+		timeout:  5 * time.Second,
+		limit:    1000,
+		maxPages: 10,
+	}
+
+	if sources, ok := r.(SourceLister); ok {
+		c.sources = sources
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	// The context given to each query sets the real deadline.
+	c.engine = promql.NewEngine(nil, nil, 10, c.timeout)
+
+	return c
+}
+
+func (c *LocalClient) PromQL(ctx context.Context, query string) (*faaspromql.QueryResult, error) {
+	return c.PromQLAt(ctx, query, time.Now())
+}
+
+// PromQLAt evaluates an instant query at the given time.
+func (c *LocalClient) PromQLAt(ctx context.Context, query string, t time.Time) (*faaspromql.QueryResult, error) {
+	return c.eval(ctx, query, func(q storage.Queryable, query string) (promql.Query, error) {
+		return c.engine.NewInstantQuery(q, query, t)
+	})
+}
+
+func (c *LocalClient) PromQLRange(
+	ctx context.Context,
+	query string,
+	start time.Time,
+	end time.Time,
+	step time.Duration,
+) (*faaspromql.QueryResult, error) {
+	return c.eval(ctx, query, func(q storage.Queryable, query string) (promql.Query, error) {
+		return c.engine.NewRangeQuery(q, query, start, end, step)
+	})
+}
+
+func (c *LocalClient) eval(
+	ctx context.Context,
+	query string,
+	newQuery func(storage.Queryable, string) (promql.Query, error),
+) (*faaspromql.QueryResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	query, err := c.s.Sanitize(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		readErr  error
+		warnings []string
+	)
+	queryable := &logCacheQueryable{
+		log:         log.New(ioutil.Discard, "", 0),
+		interval:    time.Second,
+		dataReader:  c.r,
+		sources:     c.sources,
+		limit:       c.limit,
+		maxPages:    c.maxPages,
+		buckets:     c.buckets,
+		logPatterns: c.patterns,
+		warnf: func(w string) {
+			warnings = append(warnings, w)
+		},
+
+		// Prometheus does not hand us back the error the way you might
+		// expect. Therefore, we have to propagate the error back up
+		// manually.
+		errf: func(e error) {
+			if readErr == nil {
+				readErr = e
+			}
+		},
+	}
+
+	q, err := newQuery(queryable, query)
+	if err != nil {
+		return nil, &Error{
+			Type: ErrBadData,
+			Msg:  fmt.Sprintf("invalid PromQL query %s: %s", query, err),
+		}
+	}
+	defer q.Close()
+
+	res := q.Exec(ctx)
+	if readErr != nil {
+		return nil, convertReadError(ctx, readErr)
+	}
+
+	if res.Err != nil {
+		return nil, convertEngineError(ctx, res.Err)
+	}
+
+	result, err := convertValue(res.Value)
+	if err != nil {
+		return nil, err
+	}
+	result.Warnings = append(warnings, result.Warnings...)
+
+	return result, nil
+}
+
+// LabelNames returns the label names of the given source IDs' envelopes
+// between start and end, along with any warnings (e.g., truncation). If no
+// source IDs are given, every source ID is read.
+func (c *LocalClient) LabelNames(
+	ctx context.Context,
+	sourceIDs []string,
+	start time.Time,
+	end time.Time,
+) ([]string, []string, error) {
+	return c.labels(ctx, sourceIDs, start, end, func(q *LogCacheQuerier) ([]string, error) {
+		return q.LabelNames()
+	})
+}
+
+// LabelValues returns the values of the label in the given source IDs'
+// envelopes between start and end, along with any warnings. If no source IDs
+// are given, every source ID is read.
+func (c *LocalClient) LabelValues(
+	ctx context.Context,
+	name string,
+	sourceIDs []string,
+	start time.Time,
+	end time.Time,
+) ([]string, []string, error) {
+	return c.labels(ctx, sourceIDs, start, end, func(q *LogCacheQuerier) ([]string, error) {
+		return q.LabelValues(name)
+	})
+}
+
+func (c *LocalClient) labels(
+	ctx context.Context,
+	sourceIDs []string,
+	start time.Time,
+	end time.Time,
+	f func(*LogCacheQuerier) ([]string, error),
+) ([]string, []string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var warnings []string
+	q := &LogCacheQuerier{
+		log:         log.New(ioutil.Discard, "", 0),
+		ctx:         ctx,
+		start:       start,
+		end:         end,
+		interval:    time.Second,
+		dataReader:  c.r,
+		sources:     c.sources,
+		errf:        func(error) {},
+		limit:       c.limit,
+		maxPages:    c.maxPages,
+		buckets:     c.buckets,
+		logPatterns: c.patterns,
+		warnf: func(w string) {
+			warnings = append(warnings, w)
+		},
+		scope: sourceIDs,
+	}
+
+	values, err := f(q)
+	if err != nil {
+		return nil, nil, convertReadError(ctx, err)
+	}
+
+	return values, warnings, nil
+}
+
+func convertReadError(ctx context.Context, err error) error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return &Error{Type: ErrTimeout, Msg: err.Error()}
+	}
+
+	return &Error{Type: ErrServer, Msg: err.Error()}
+}
+
+func convertEngineError(ctx context.Context, err error) error {
+	switch err.(type) {
+	case promql.ErrQueryTimeout:
+		return &Error{Type: ErrTimeout, Msg: err.Error()}
+	case promql.ErrQueryCanceled:
+		if ctx.Err() == context.DeadlineExceeded {
+			return &Error{Type: ErrTimeout, Msg: err.Error()}
+		}
+		return &Error{Type: ErrCanceled, Msg: err.Error()}
+	case promql.ErrStorage:
+		return &Error{Type: ErrServer, Msg: err.Error()}
+	default:
+		return &Error{Type: ErrExec, Msg: err.Error()}
+	}
+}
+
+// convertValue converts the engine's result to the same format Log Cache's
+// PromQL endpoint returns. Like the Prometheus API, values that are NaN or
+// infinite are formatted as "NaN", "+Inf" and "-Inf".
+func convertValue(v promql.Value) (*faaspromql.QueryResult, error) {
+	result := &faaspromql.QueryResult{
+		Status: "success",
+		Data: faaspromql.RawResult{
+			ResultType: string(v.Type()),
+		},
+	}
+
+	switch v := v.(type) {
+	case promql.Vector:
+		for _, s := range v {
+			result.Data.Result = append(result.Data.Result, &faaspromql.Sample{
+				Metric: s.Metric.Map(),
+				Value:  []json.Number{formatTimestamp(s.T), formatValue(s.V)},
+			})
+		}
+	case promql.Matrix:
+		for _, s := range v {
+			var values [][]json.Number
+			for _, p := range s.Points {
+				values = append(values, []json.Number{formatTimestamp(p.T), formatValue(p.V)})
+			}
+
+			result.Data.Result = append(result.Data.Result, &faaspromql.Series{
+				Metric: s.Metric.Map(),
+				Values: values,
+			})
+		}
+	case promql.Scalar:
+		result.Data.Result = append(result.Data.Result, &faaspromql.Scalar{
+			Timestamp: formatTimestamp(v.T),
+			Value:     formatValue(v.V),
+		})
+	case promql.String:
+		result.Data.Result = append(result.Data.Result, &faaspromql.String{
+			Timestamp: formatTimestamp(v.T),
+			Value:     v.V,
+		})
+	default:
+		return nil, &Error{
+			Type: ErrBadData,
+			Msg:  fmt.Sprintf("unsupported result type %s", v.Type()),
+		}
+	}
+
+	return result, nil
+}
+
+// formatTimestamp formats the engine's millisecond timestamp in seconds, as
+// the Prometheus API does.
+func formatTimestamp(t int64) json.Number {
+	return json.Number(strconv.FormatFloat(float64(t)/1e3, 'f', -1, 64))
+}
+
+// formatValue formats the value as the Prometheus API does. NaN and
+// infinite values are not JSON numbers (see faaspromql.Sample).
+func formatValue(v float64) json.Number {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return json.Number(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+}
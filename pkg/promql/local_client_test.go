@@ -0,0 +1,678 @@
+package promql_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/go-log-cache/rpc/logcache_v1"
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/poy/cf-faas-log-cache"
+	"github.com/poy/cf-faas-log-cache/pkg/promql"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TL struct {
+	*testing.T
+	c                   *promql.LocalClient
+	spyDataReader       *spyDataReader
+	spyAppNameSanitizer *spyAppNameSanitizer
+}
+
+func TestLocalClient(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TL {
+		spyDataReader := newSpyDataReader()
+		spyAppNameSanitizer := newSpyAppNameSanitizer()
+		spyAppNameSanitizer.result = `cpu{source_id="some-id"}`
+
+		return TL{
+			T:                   t,
+			c:                   promql.NewLocalClient(spyDataReader, spyAppNameSanitizer),
+			spyDataReader:       spyDataReader,
+			spyAppNameSanitizer: spyAppNameSanitizer,
+		}
+	})
+
+	o.Spec("it evaluates an instant query", func(t TL) {
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			gaugeEnvelope(98, "cpu", 1, map[string]string{"a": "b"}),
+			gaugeEnvelope(99, "cpu", 2, map[string]string{"a": "b"}),
+			gaugeEnvelope(99, "other", 3, map[string]string{"a": "b"}),
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyAppNameSanitizer.query).To(Equal("some-query"))
+		Expect(t, result.Status).To(Equal("success"))
+		Expect(t, result.Data.ResultType).To(Equal("vector"))
+		Expect(t, result.Data.Result).To(Equal([]interface{}{
+			&faaspromql.Sample{
+				Metric: map[string]string{"a": "b", "source_id": "some-id"},
+				Value:  []json.Number{"100", "2"},
+			},
+		}))
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(1))
+		Expect(t, t.spyDataReader.reqs[0].GetSourceId()).To(Equal("some-id"))
+		Expect(t, t.spyDataReader.reqs[0].GetEndTime()).To(Equal(time.Unix(100, 0).UnixNano()))
+		Expect(t, t.spyDataReader.reqs[0].GetStartTime() < time.Unix(99, 0).UnixNano()).To(BeTrue())
+	})
+
+	o.Spec("it evaluates a range query", func(t TL) {
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			gaugeEnvelope(100, "cpu", 1, nil),
+			gaugeEnvelope(101, "cpu", 2, nil),
+		}
+
+		result, err := t.c.PromQLRange(context.Background(), "some-query", time.Unix(100, 0), time.Unix(101, 0), time.Second)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, result.Data.ResultType).To(Equal("matrix"))
+		Expect(t, result.Data.Result).To(Equal([]interface{}{
+			&faaspromql.Series{
+				Metric: map[string]string{"source_id": "some-id"},
+				Values: [][]json.Number{
+					{"100", "1"},
+					{"101", "2"},
+				},
+			},
+		}))
+	})
+
+	o.Spec("it evaluates functions", func(t TL) {
+		t.spyAppNameSanitizer.result = `sum(cpu{source_id="some-id"})`
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			gaugeEnvelope(99, "cpu", 1, map[string]string{"instance_id": "0"}),
+			gaugeEnvelope(99, "cpu", 2, map[string]string{"instance_id": "1"}),
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Data.Result).To(Equal([]interface{}{
+			&faaspromql.Sample{
+				Metric: map[string]string{},
+				Value:  []json.Number{"100", "3"},
+			},
+		}))
+	})
+
+	o.Spec("it evaluates scalar queries", func(t TL) {
+		t.spyAppNameSanitizer.result = `time()`
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Data.ResultType).To(Equal("scalar"))
+		Expect(t, result.Data.Result).To(Equal([]interface{}{
+			&faaspromql.Scalar{Timestamp: "100", Value: "100"},
+		}))
+	})
+
+	o.Spec("it returns NaN scalars", func(t TL) {
+		t.spyAppNameSanitizer.result = `scalar(cpu{source_id="some-id"})`
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Data.ResultType).To(Equal("scalar"))
+		Expect(t, result.Data.Result).To(Equal([]interface{}{
+			&faaspromql.Scalar{Timestamp: "100", Value: "NaN"},
+		}))
+		Expect(t, result.Warnings).To(HaveLen(0))
+	})
+
+	o.Spec("it builds histograms from timers", func(t TL) {
+		t.c = promql.NewLocalClient(t.spyDataReader, t.spyAppNameSanitizer, promql.WithTimerBuckets([]float64{2, 1}))
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			timerEnvelope(96, "http", 500*time.Millisecond, nil),
+			timerEnvelope(97, "http", 500*time.Millisecond, nil),
+			timerEnvelope(98, "http", 1500*time.Millisecond, nil),
+			timerEnvelope(99, "http", 1500*time.Millisecond, nil),
+		}
+
+		for query, expected := range map[string]string{
+			`histogram_quantile(0.5, http_bucket{source_id="some-id"})`:  "1",
+			`histogram_quantile(0.75, http_bucket{source_id="some-id"})`: "1.5",
+			`http_bucket{source_id="some-id",le="1"}`:                    "2",
+			`http_bucket{source_id="some-id",le="+Inf"}`:                 "4",
+			`http_count{source_id="some-id"}`:                            "4",
+			`http_sum{source_id="some-id"}`:                              "4",
+			`http{source_id="some-id"}`:                                  "1500000000",
+		} {
+			t.spyAppNameSanitizer.result = query
+			result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+			Expect(t, err).To(BeNil())
+			Expect(t, result.Data.Result).To(HaveLen(1))
+			Expect(t, result.Data.Result[0].(*faaspromql.Sample).Value[1]).To(Equal(json.Number(expected)))
+		}
+	})
+
+	o.Spec("it accumulates counters that only report deltas", func(t TL) {
+		t.spyAppNameSanitizer.result = `requests{source_id="some-id"}`
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			counterEnvelope(97, "requests", 0, 1),
+			counterEnvelope(98, "requests", 0, 2),
+			counterEnvelope(99, "requests", 0, 3),
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Data.Result[0].(*faaspromql.Sample).Value[1]).To(Equal(json.Number("6")))
+	})
+
+	o.Spec("it handles counter resets", func(t TL) {
+		t.spyAppNameSanitizer.result = `resets(requests{source_id="some-id"}[5s])`
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			counterEnvelope(97, "requests", 10, 0),
+			counterEnvelope(98, "requests", 20, 0),
+			counterEnvelope(99, "requests", 5, 0),
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Data.Result[0].(*faaspromql.Sample).Value[1]).To(Equal(json.Number("1")))
+	})
+
+	o.Spec("it keeps the last sample for duplicate timestamps", func(t TL) {
+		first := counterEnvelope(99, "requests", 20, 0)
+		second := counterEnvelope(99, "requests", 10, 0)
+		first.Timestamp += int64(500 * time.Millisecond)
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{second, first}
+
+		for query, expected := range map[string]string{
+			`requests{source_id="some-id"}`:                      "20",
+			`count_over_time(requests{source_id="some-id"}[5s])`: "1",
+			`resets(requests{source_id="some-id"}[5s])`:          "0",
+		} {
+			t.spyAppNameSanitizer.result = query
+			result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+			Expect(t, err).To(BeNil())
+			Expect(t, result.Data.Result).To(HaveLen(1))
+			Expect(t, result.Data.Result[0].(*faaspromql.Sample).Value[1]).To(Equal(json.Number(expected)))
+		}
+	})
+
+	o.Spec("it counts log lines", func(t TL) {
+		t.c = promql.NewLocalClient(t.spyDataReader, t.spyAppNameSanitizer, promql.WithLogPatterns(
+			regexp.MustCompile(`" (?P<status>\d{3}) `),
+		))
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			logEnvelope(96, `"GET / HTTP/1.1" 200 12`, loggregator_v2.Log_OUT),
+			logEnvelope(97, `"GET / HTTP/1.1" 502 12`, loggregator_v2.Log_OUT),
+			logEnvelope(98, `"GET / HTTP/1.1" 503 12`, loggregator_v2.Log_OUT),
+			logEnvelope(99, `some-error`, loggregator_v2.Log_ERR),
+			gaugeEnvelope(99, "cpu", 1, nil),
+		}
+
+		for query, expected := range map[string]string{
+			`sum(log_lines_total{source_id="some-id"})`:                     "4",
+			`sum(log_lines_total{source_id="some-id",status=~"5.."})`:       "2",
+			`log_lines_total{source_id="some-id",log_type="ERR"}`:           "1",
+			`log_lines_total{source_id="some-id",status="",log_type="OUT"}`: "0",
+		} {
+			t.spyAppNameSanitizer.result = query
+			result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+			Expect(t, err).To(BeNil())
+
+			if expected == "0" {
+				Expect(t, result.Data.Result).To(HaveLen(0))
+				continue
+			}
+			Expect(t, result.Data.Result).To(HaveLen(1))
+			Expect(t, result.Data.Result[0].(*faaspromql.Sample).Value[1]).To(Equal(json.Number(expected)))
+		}
+
+		values, _, err := t.c.LabelValues(context.Background(), "status", []string{"some-id"}, time.Unix(0, 0), time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, values).To(Equal([]string{"200", "502", "503"}))
+	})
+
+	o.Spec("it counts events", func(t TL) {
+		t.spyAppNameSanitizer.result = `events_total{source_id="some-id",title="app crash"}`
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			eventEnvelope(97, "app crash"),
+			eventEnvelope(98, "app start"),
+			eventEnvelope(99, "app crash"),
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Data.Result).To(Equal([]interface{}{
+			&faaspromql.Sample{
+				Metric: map[string]string{"source_id": "some-id", "title": "app crash"},
+				Value:  []json.Number{"100", "2"},
+			},
+		}))
+
+		values, _, err := t.c.LabelValues(context.Background(), "__name__", []string{"some-id"}, time.Unix(0, 0), time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, values).To(Equal([]string{"events_total"}))
+	})
+
+	o.Spec("it pages through the window", func(t TL) {
+		t.c = promql.NewLocalClient(t.spyDataReader, t.spyAppNameSanitizer, promql.WithEnvelopeLimit(2))
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{
+			{gaugeEnvelope(97, "cpu", 1, nil), gaugeEnvelope(98, "cpu", 2, nil)},
+			{gaugeEnvelope(99, "cpu", 3, nil)},
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Warnings).To(HaveLen(0))
+		Expect(t, result.Data.Result[0].(*faaspromql.Sample).Value[1]).To(Equal(json.Number("3")))
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(2))
+		Expect(t, t.spyDataReader.reqs[0].GetLimit()).To(Equal(int64(2)))
+		Expect(t, t.spyDataReader.reqs[1].GetStartTime()).To(Equal(time.Unix(98, 0).UnixNano()))
+		Expect(t, t.spyDataReader.reqs[1].GetEndTime()).To(Equal(t.spyDataReader.reqs[0].GetEndTime()))
+	})
+
+	o.Spec("it reads the envelopes that share the last timestamp of a page", func(t TL) {
+		t.c = promql.NewLocalClient(t.spyDataReader, t.spyAppNameSanitizer, promql.WithEnvelopeLimit(2))
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{
+			{gaugeEnvelope(98, "cpu", 1, map[string]string{"instance_id": "0"}), gaugeEnvelope(99, "cpu", 2, map[string]string{"instance_id": "0"})},
+			{gaugeEnvelope(99, "cpu", 2, map[string]string{"instance_id": "0"}), gaugeEnvelope(99, "cpu", 3, map[string]string{"instance_id": "1"})},
+			{gaugeEnvelope(99, "cpu", 3, map[string]string{"instance_id": "1"})},
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Data.Result).To(HaveLen(2))
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(3))
+		Expect(t, t.spyDataReader.reqs[1].GetStartTime()).To(Equal(time.Unix(99, 0).UnixNano()))
+		Expect(t, t.spyDataReader.reqs[2].GetStartTime()).To(Equal(time.Unix(99, 0).UnixNano()))
+	})
+
+	o.Spec("it moves past a full page of envelopes that were already read", func(t TL) {
+		t.c = promql.NewLocalClient(t.spyDataReader, t.spyAppNameSanitizer, promql.WithEnvelopeLimit(1))
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{
+			{gaugeEnvelope(99, "cpu", 1, nil)},
+			{gaugeEnvelope(99, "cpu", 1, nil)},
+			{},
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Warnings).To(HaveLen(1))
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(3))
+		Expect(t, t.spyDataReader.reqs[2].GetStartTime()).To(Equal(time.Unix(99, 0).UnixNano() + 1))
+	})
+
+	o.Spec("it warns when the results are truncated", func(t TL) {
+		t.c = promql.NewLocalClient(
+			t.spyDataReader,
+			t.spyAppNameSanitizer,
+			promql.WithEnvelopeLimit(1),
+			promql.WithMaxPages(2),
+		)
+		t.spyDataReader.pages = [][]*loggregator_v2.Envelope{
+			{gaugeEnvelope(97, "cpu", 1, nil)},
+			{gaugeEnvelope(98, "cpu", 2, nil)},
+			{gaugeEnvelope(99, "cpu", 3, nil)},
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(2))
+		Expect(t, result.Warnings).To(HaveLen(1))
+		Expect(t, result.Warnings[0]).To(ContainSubstring("truncated"))
+	})
+
+	o.Spec("it reads every source ID a regex matches", func(t TL) {
+		spyDataReader := &spyListingDataReader{
+			spyDataReader: t.spyDataReader,
+			meta: map[string]*logcache_v1.MetaInfo{
+				"some-id":    {},
+				"some-other": {},
+				"other":      {},
+			},
+		}
+		t.c = promql.NewLocalClient(spyDataReader, t.spyAppNameSanitizer)
+		t.spyAppNameSanitizer.result = `sum(cpu{source_id=~"some-.*"})`
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			gaugeEnvelope(99, "cpu", 2, nil),
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Data.Result[0].(*faaspromql.Sample).Value[1]).To(Equal(json.Number("4")))
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(2))
+		Expect(t, t.spyDataReader.reqs[0].GetSourceId()).To(Equal("some-id"))
+		Expect(t, t.spyDataReader.reqs[1].GetSourceId()).To(Equal("some-other"))
+	})
+
+	o.Spec("it only reads the source IDs every source_id matcher selects", func(t TL) {
+		spyDataReader := &spyListingDataReader{
+			spyDataReader: t.spyDataReader,
+			meta: map[string]*logcache_v1.MetaInfo{
+				"some-id":    {},
+				"some-other": {},
+				"other":      {},
+			},
+		}
+		t.c = promql.NewLocalClient(spyDataReader, t.spyAppNameSanitizer)
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			gaugeEnvelope(99, "cpu", 2, nil),
+		}
+
+		t.spyAppNameSanitizer.result = `sum(cpu{source_id="some-id", source_id=~".+"})`
+		_, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(1))
+		Expect(t, t.spyDataReader.reqs[0].GetSourceId()).To(Equal("some-id"))
+
+		t.spyAppNameSanitizer.result = `sum(cpu{source_id=~"some-.*", source_id!="some-id"})`
+		_, err = t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(2))
+		Expect(t, t.spyDataReader.reqs[1].GetSourceId()).To(Equal("some-other"))
+
+		t.spyAppNameSanitizer.result = `sum(cpu{source_id="some-id", source_id="other"})`
+		_, err = t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(2))
+	})
+
+	o.Spec("it reads every other source ID for a negative matcher", func(t TL) {
+		spyDataReader := &spyListingDataReader{
+			spyDataReader: t.spyDataReader,
+			meta: map[string]*logcache_v1.MetaInfo{
+				"some-id": {},
+				"other":   {},
+			},
+		}
+		t.c = promql.NewLocalClient(spyDataReader, t.spyAppNameSanitizer)
+		t.spyAppNameSanitizer.result = `cpu{source_id!="some-id"}`
+
+		_, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(1))
+		Expect(t, t.spyDataReader.reqs[0].GetSourceId()).To(Equal("other"))
+	})
+
+	o.Spec("it returns a bad_data error for a regex source_id without a SourceLister", func(t TL) {
+		t.spyAppNameSanitizer.result = `cpu{source_id=~"some-.*"}`
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.(*promql.Error).Type).To(Equal(promql.ErrBadData))
+	})
+
+	o.Spec("it honors every tag matcher type", func(t TL) {
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			gaugeEnvelope(99, "cpu", 1, map[string]string{"a": "b"}),
+			gaugeEnvelope(99, "cpu", 10, map[string]string{"a": "c"}),
+			gaugeEnvelope(99, "cpu", 100, map[string]string{"a": "d"}),
+			gaugeEnvelope(99, "cpu", 1000, nil),
+		}
+
+		for query, expected := range map[string]string{
+			`sum(cpu{source_id="some-id",a="b"})`:    "1",
+			`sum(cpu{source_id="some-id",a!="b"})`:   "1110",
+			`sum(cpu{source_id="some-id",a=~"b|c"})`: "11",
+			`sum(cpu{source_id="some-id",a!~"b|c"})`: "1100",
+			`sum(cpu{source_id="some-id",a=""})`:     "1000",
+		} {
+			t.spyAppNameSanitizer.result = query
+			result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+			Expect(t, err).To(BeNil())
+			Expect(t, result.Data.Result).To(HaveLen(1))
+			Expect(t, result.Data.Result[0].(*faaspromql.Sample).Value[1]).To(Equal(json.Number(expected)))
+		}
+	})
+
+	o.Spec("it discovers label names", func(t TL) {
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			gaugeEnvelope(99, "cpu", 1, map[string]string{"a": "b"}),
+			gaugeEnvelope(99, "cpu", 1, map[string]string{"c": "d"}),
+		}
+
+		names, warnings, err := t.c.LabelNames(context.Background(), []string{"some-id"}, time.Unix(0, 0), time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, warnings).To(HaveLen(0))
+		Expect(t, names).To(Equal([]string{"__name__", "a", "c", "source_id"}))
+
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(1))
+		Expect(t, t.spyDataReader.reqs[0].GetSourceId()).To(Equal("some-id"))
+		Expect(t, t.spyDataReader.reqs[0].GetEndTime()).To(Equal(time.Unix(100, 0).UnixNano()))
+	})
+
+	o.Spec("it discovers label values", func(t TL) {
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			gaugeEnvelope(99, "cpu", 1, map[string]string{"a": "c"}),
+			gaugeEnvelope(99, "mem.used", 1, map[string]string{"a": "b"}),
+			gaugeEnvelope(99, "cpu", 1, map[string]string{"a": "b"}),
+			gaugeEnvelope(99, "cpu", 1, nil),
+		}
+
+		values, _, err := t.c.LabelValues(context.Background(), "a", []string{"some-id"}, time.Unix(0, 0), time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, values).To(Equal([]string{"b", "c"}))
+
+		values, _, err = t.c.LabelValues(context.Background(), "__name__", []string{"some-id"}, time.Unix(0, 0), time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, values).To(Equal([]string{"cpu", "mem_used"}))
+
+		values, _, err = t.c.LabelValues(context.Background(), "source_id", []string{"some-id", "other-id"}, time.Unix(0, 0), time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, values).To(Equal([]string{"other-id", "some-id"}))
+	})
+
+	o.Spec("it discovers label values for every source ID", func(t TL) {
+		spyDataReader := &spyListingDataReader{
+			spyDataReader: t.spyDataReader,
+			meta: map[string]*logcache_v1.MetaInfo{
+				"some-id": {},
+				"other":   {},
+			},
+		}
+		t.c = promql.NewLocalClient(spyDataReader, t.spyAppNameSanitizer)
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			gaugeEnvelope(99, "cpu", 1, nil),
+		}
+
+		values, _, err := t.c.LabelValues(context.Background(), "source_id", nil, time.Unix(0, 0), time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, values).To(Equal([]string{"other", "some-id"}))
+	})
+
+	o.Spec("it requires a source ID without a SourceLister", func(t TL) {
+		_, _, err := t.c.LabelNames(context.Background(), nil, time.Unix(0, 0), time.Unix(100, 0))
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.(*promql.Error).Type).To(Equal(promql.ErrBadData))
+	})
+
+	o.Spec("it returns a read error when discovering labels", func(t TL) {
+		t.spyDataReader.err = errors.New("some-error")
+
+		_, _, err := t.c.LabelValues(context.Background(), "a", []string{"some-id"}, time.Unix(0, 0), time.Unix(100, 0))
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns NaN and infinite samples as the Prometheus API does", func(t TL) {
+		t.spyDataReader.envelopes = []*loggregator_v2.Envelope{
+			gaugeEnvelope(99, "cpu", math.NaN(), map[string]string{"a": "nan"}),
+			gaugeEnvelope(99, "cpu", math.Inf(1), map[string]string{"a": "pos"}),
+			gaugeEnvelope(99, "cpu", math.Inf(-1), map[string]string{"a": "neg"}),
+		}
+
+		result, err := t.c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0))
+		Expect(t, err).To(BeNil())
+		Expect(t, result.Warnings).To(HaveLen(0))
+
+		values := map[string]json.Number{}
+		for _, r := range result.Data.Result {
+			s := r.(*faaspromql.Sample)
+			values[s.Metric["a"]] = s.Value[1]
+		}
+		Expect(t, values).To(Equal(map[string]json.Number{
+			"nan": "NaN",
+			"pos": "+Inf",
+			"neg": "-Inf",
+		}))
+	})
+
+	o.Spec("it returns the reader's error", func(t TL) {
+		t.spyDataReader.err = &promql.Error{Type: promql.ErrServer, Msg: "some-error"}
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(Equal(t.spyDataReader.err))
+	})
+
+	o.Spec("it returns a temporary error if the read fails", func(t TL) {
+		t.spyDataReader.err = errors.New("some-error")
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.(*promql.Error).Temporary()).To(BeTrue())
+	})
+
+	o.Spec("it returns a bad_data error for an invalid query", func(t TL) {
+		t.spyAppNameSanitizer.result = `}{`
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.(*promql.Error).Type).To(Equal(promql.ErrBadData))
+	})
+
+	o.Spec("it returns a bad_data error for a selector without a source_id", func(t TL) {
+		t.spyAppNameSanitizer.result = `cpu`
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.(*promql.Error).Type).To(Equal(promql.ErrBadData))
+	})
+
+	o.Spec("it returns the sanitizer's error", func(t TL) {
+		t.spyAppNameSanitizer.err = errors.New("some-error")
+
+		_, err := t.c.PromQL(context.Background(), "some-query")
+		Expect(t, err).To(Equal(t.spyAppNameSanitizer.err))
+		Expect(t, t.spyDataReader.reqs).To(HaveLen(0))
+	})
+}
+
+func gaugeEnvelope(seconds int64, name string, value float64, tags map[string]string) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: time.Unix(seconds, 0).UnixNano(),
+		SourceId:  "some-id",
+		Tags:      tags,
+		Message: &loggregator_v2.Envelope_Gauge{
+			Gauge: &loggregator_v2.Gauge{
+				Metrics: map[string]*loggregator_v2.GaugeValue{
+					name: {Value: value},
+				},
+			},
+		},
+	}
+}
+
+func timerEnvelope(seconds int64, name string, d time.Duration, tags map[string]string) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: time.Unix(seconds, 0).UnixNano(),
+		SourceId:  "some-id",
+		Tags:      tags,
+		Message: &loggregator_v2.Envelope_Timer{
+			Timer: &loggregator_v2.Timer{
+				Name:  name,
+				Start: time.Unix(seconds, 0).Add(-d).UnixNano(),
+				Stop:  time.Unix(seconds, 0).UnixNano(),
+			},
+		},
+	}
+}
+
+func counterEnvelope(seconds int64, name string, total, delta uint64) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: time.Unix(seconds, 0).UnixNano(),
+		SourceId:  "some-id",
+		Message: &loggregator_v2.Envelope_Counter{
+			Counter: &loggregator_v2.Counter{
+				Name:  name,
+				Total: total,
+				Delta: delta,
+			},
+		},
+	}
+}
+
+func logEnvelope(seconds int64, payload string, logType loggregator_v2.Log_Type) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: time.Unix(seconds, 0).UnixNano(),
+		SourceId:  "some-id",
+		Message: &loggregator_v2.Envelope_Log{
+			Log: &loggregator_v2.Log{
+				Payload: []byte(payload),
+				Type:    logType,
+			},
+		},
+	}
+}
+
+func eventEnvelope(seconds int64, title string) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Timestamp: time.Unix(seconds, 0).UnixNano(),
+		SourceId:  "some-id",
+		Message: &loggregator_v2.Envelope_Event{
+			Event: &loggregator_v2.Event{
+				Title: title,
+				Body:  "some-body",
+			},
+		},
+	}
+}
+
+type spyListingDataReader struct {
+	*spyDataReader
+	meta map[string]*logcache_v1.MetaInfo
+}
+
+func (s *spyListingDataReader) Meta(ctx context.Context) (map[string]*logcache_v1.MetaInfo, error) {
+	return s.meta, nil
+}
+
+type spyDataReader struct {
+	reqs      []*logcache_v1.ReadRequest
+	envelopes []*loggregator_v2.Envelope
+	err       error
+
+	// pages, if set, are returned one per Read.
+	pages [][]*loggregator_v2.Envelope
+}
+
+func newSpyDataReader() *spyDataReader {
+	return &spyDataReader{}
+}
+
+func (s *spyDataReader) Read(ctx context.Context, in *logcache_v1.ReadRequest) (*logcache_v1.ReadResponse, error) {
+	s.reqs = append(s.reqs, in)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	envelopes := s.envelopes
+	if s.pages != nil {
+		envelopes = nil
+		if len(s.reqs) <= len(s.pages) {
+			envelopes = s.pages[len(s.reqs)-1]
+		}
+	}
+
+	return &logcache_v1.ReadResponse{
+		Envelopes: &loggregator_v2.EnvelopeBatch{
+			Batch: envelopes,
+		},
+	}, nil
+}
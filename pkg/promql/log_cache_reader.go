@@ -0,0 +1,138 @@
+package promql
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"code.cloudfoundry.org/go-log-cache/rpc/logcache_v1"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+// LogCacheReader reads envelopes from Log Cache's /api/v1/read endpoint and
+// lists its source IDs from /api/v1/meta.
+type LogCacheReader struct {
+	addr string
+	d    Doer
+}
+
+func NewLogCacheReader(addr string, d Doer) *LogCacheReader {
+	return &LogCacheReader{
+		addr: strings.TrimSuffix(addr, "/"),
+		d:    d,
+	}
+}
+
+// Read returns the envelopes for the request's source ID. Failed requests
+// return an *Error.
+func (r *LogCacheReader) Read(ctx context.Context, in *logcache_v1.ReadRequest) (*logcache_v1.ReadResponse, error) {
+	v := url.Values{}
+	v.Set("start_time", fmt.Sprint(in.GetStartTime()))
+	if in.GetEndTime() != 0 {
+		v.Set("end_time", fmt.Sprint(in.GetEndTime()))
+	}
+	if in.GetLimit() != 0 {
+		v.Set("limit", fmt.Sprint(in.GetLimit()))
+	}
+	for _, t := range in.GetEnvelopeTypes() {
+		v.Add("envelope_types", t.String())
+	}
+	if in.GetDescending() {
+		v.Set("descending", "true")
+	}
+
+	addr := r.addr + "/api/v1/read/" + url.PathEscape(in.GetSourceId()) + "?" + v.Encode()
+	req, err := http.NewRequest(http.MethodGet, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := r.d.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &Error{
+				Type: ErrTimeout,
+				Msg:  fmt.Sprintf("Log Cache read timed out: %s", err),
+			}
+		}
+		return nil, fmt.Errorf("failed to read from Log Cache: %s", err)
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, &Error{
+			Type:       statusErrorType(resp.StatusCode),
+			Msg:        fmt.Sprintf("failed to read %s from Log Cache: %s", in.GetSourceId(), body),
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	var result logcache_v1.ReadResponse
+	u := jsonpb.Unmarshaler{AllowUnknownFields: true}
+	if err := u.Unmarshal(resp.Body, &result); err != nil {
+		return nil, &Error{
+			Type:       ErrBadResponse,
+			Msg:        fmt.Sprintf("failed to parse envelopes: %s", err),
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	return &result, nil
+}
+
+// Meta returns the source IDs Log Cache has data for. Failed requests
+// return an *Error.
+func (r *LogCacheReader) Meta(ctx context.Context) (map[string]*logcache_v1.MetaInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, r.addr+"/api/v1/meta", nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := r.d.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &Error{
+				Type: ErrTimeout,
+				Msg:  fmt.Sprintf("Log Cache meta request timed out: %s", err),
+			}
+		}
+		return nil, fmt.Errorf("failed to read meta from Log Cache: %s", err)
+	}
+
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, &Error{
+			Type:       statusErrorType(resp.StatusCode),
+			Msg:        fmt.Sprintf("failed to read meta from Log Cache: %s", body),
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	var result logcache_v1.MetaResponse
+	u := jsonpb.Unmarshaler{AllowUnknownFields: true}
+	if err := u.Unmarshal(resp.Body, &result); err != nil {
+		return nil, &Error{
+			Type:       ErrBadResponse,
+			Msg:        fmt.Sprintf("failed to parse meta: %s", err),
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	return result.GetMeta(), nil
+}
@@ -0,0 +1,146 @@
+package promql_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/go-log-cache/rpc/logcache_v1"
+	"github.com/poy/cf-faas-log-cache/pkg/promql"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TLR struct {
+	*testing.T
+	r       *promql.LogCacheReader
+	spyDoer *spyDoer
+}
+
+func TestLogCacheReader(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TLR {
+		spyDoer := newSpyDoer()
+		return TLR{
+			T:       t,
+			r:       promql.NewLogCacheReader("https://some.url/", spyDoer),
+			spyDoer: spyDoer,
+		}
+	})
+
+	o.Spec("it reads the envelopes", func(t TLR) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: http.StatusOK,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+			  "envelopes": {
+			    "batch": [
+			      {
+			        "timestamp": "99000000000",
+			        "sourceId": "some-id",
+			        "tags": {"a": "b"},
+			        "gauge": {"metrics": {"cpu": {"unit": "percent", "value": 2}}}
+			      },
+			      {
+			        "timestamp": "100000000000",
+			        "sourceId": "some-id",
+			        "counter": {"name": "requests", "total": "7"}
+			      }
+			    ]
+			  }
+			}`)),
+		}
+
+		resp, err := t.r.Read(context.Background(), &logcache_v1.ReadRequest{
+			SourceId:      "some/id",
+			StartTime:     1,
+			EndTime:       2,
+			Limit:         3,
+			EnvelopeTypes: []logcache_v1.EnvelopeType{logcache_v1.EnvelopeType_GAUGE, logcache_v1.EnvelopeType_COUNTER},
+		})
+		Expect(t, err).To(BeNil())
+
+		batch := resp.GetEnvelopes().GetBatch()
+		Expect(t, batch).To(HaveLen(2))
+		Expect(t, batch[0].GetTimestamp()).To(Equal(int64(99000000000)))
+		Expect(t, batch[0].GetTags()).To(Equal(map[string]string{"a": "b"}))
+		Expect(t, batch[0].GetGauge().GetMetrics()["cpu"].GetValue()).To(Equal(2.0))
+		Expect(t, batch[1].GetCounter().GetTotal()).To(Equal(uint64(7)))
+
+		req := t.spyDoer.req
+		Expect(t, req.Method).To(Equal(http.MethodGet))
+		Expect(t, req.URL.Host).To(Equal("some.url"))
+		Expect(t, req.URL.EscapedPath()).To(Equal("/api/v1/read/some%2Fid"))
+		Expect(t, req.URL.Query().Get("start_time")).To(Equal("1"))
+		Expect(t, req.URL.Query().Get("end_time")).To(Equal("2"))
+		Expect(t, req.URL.Query().Get("limit")).To(Equal("3"))
+		Expect(t, req.URL.Query()["envelope_types"]).To(Equal([]string{"GAUGE", "COUNTER"}))
+	})
+
+	o.Spec("it reads the meta", func(t TLR) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: http.StatusOK,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+			  "meta": {
+			    "some-id": {"count": "5", "newestTimestamp": "99"},
+			    "other-id": {}
+			  }
+			}`)),
+		}
+
+		meta, err := t.r.Meta(context.Background())
+		Expect(t, err).To(BeNil())
+		Expect(t, meta).To(HaveLen(2))
+		Expect(t, meta["some-id"].GetCount()).To(Equal(int64(5)))
+		Expect(t, meta["some-id"].GetNewestTimestamp()).To(Equal(int64(99)))
+
+		Expect(t, t.spyDoer.req.URL.Path).To(Equal("/api/v1/meta"))
+	})
+
+	o.Spec("it returns a typed error for a non-200 meta", func(t TLR) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       ioutil.NopCloser(strings.NewReader("some-error")),
+		}
+
+		_, err := t.r.Meta(context.Background())
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.(*promql.Error).Type).To(Equal(promql.ErrServer))
+	})
+
+	o.Spec("it returns a typed error for a non-200", func(t TLR) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: http.StatusNotFound,
+			Body:       ioutil.NopCloser(strings.NewReader("some-error")),
+		}
+
+		_, err := t.r.Read(context.Background(), &logcache_v1.ReadRequest{SourceId: "some-id"})
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.(*promql.Error).Type).To(Equal(promql.ErrClient))
+		Expect(t, err.(*promql.Error).StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	o.Spec("it returns a typed error for an invalid body", func(t TLR) {
+		t.spyDoer.resp = &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("invalid")),
+		}
+
+		_, err := t.r.Read(context.Background(), &logcache_v1.ReadRequest{SourceId: "some-id"})
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.(*promql.Error).Type).To(Equal(promql.ErrBadResponse))
+	})
+
+	o.Spec("it returns an error if the request fails", func(t TLR) {
+		t.spyDoer.err = errors.New("some-error")
+
+		_, err := t.r.Read(context.Background(), &logcache_v1.ReadRequest{SourceId: "some-id"})
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
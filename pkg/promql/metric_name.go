@@ -0,0 +1,100 @@
+package promql
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// SanitizeMetricName converts a name to a valid Prometheus metric name
+// ([a-zA-Z_:][a-zA-Z0-9_:]*). Each invalid character (including an
+// invalid first character, e.g., a digit) is replaced with an underscore.
+func SanitizeMetricName(name string) string {
+	if validMetricName(name) {
+		return name
+	}
+
+	var b strings.Builder
+	b.Grow(len(name))
+	for i, r := range name {
+		if validMetricNameRune(r, i == 0) {
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteByte('_')
+	}
+
+	return b.String()
+}
+
+func validMetricName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if !validMetricNameRune(rune(name[i]), i == 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validMetricNameRune reports whether r may appear in a metric name. Runes
+// beyond ASCII (and the bytes that encode them) never may.
+func validMetricNameRune(r rune, first bool) bool {
+	switch {
+	case r >= utf8.RuneSelf:
+		return false
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+		return true
+	case r >= '0' && r <= '9':
+		return !first
+	default:
+		return false
+	}
+}
+
+// maxCachedMetricNames bounds the metricNameCache. Envelopes carry few
+// distinct names, so it is only reached if something emits unbounded
+// names.
+const maxCachedMetricNames = 10000
+
+// sanitizedNames memoizes SanitizeMetricName for the names in envelopes
+// (e.g., the keys of every gauge), which are sanitized for each envelope
+// that is read.
+var sanitizedNames = newMetricNameCache(maxCachedMetricNames)
+
+type metricNameCache struct {
+	max int
+
+	mu    sync.RWMutex
+	names map[string]string
+}
+
+func newMetricNameCache(max int) *metricNameCache {
+	return &metricNameCache{
+		max:   max,
+		names: make(map[string]string),
+	}
+}
+
+// sanitize returns SanitizeMetricName(name). The cache starts over once it
+// is full.
+func (c *metricNameCache) sanitize(name string) string {
+	c.mu.RLock()
+	sanitized, ok := c.names[name]
+	c.mu.RUnlock()
+
+	if ok {
+		return sanitized
+	}
+
+	sanitized = SanitizeMetricName(name)
+
+	c.mu.Lock()
+	if len(c.names) >= c.max {
+		c.names = make(map[string]string)
+	}
+	c.names[name] = sanitized
+	c.mu.Unlock()
+
+	return sanitized
+}
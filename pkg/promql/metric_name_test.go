@@ -0,0 +1,102 @@
+package promql_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/go-log-cache/rpc/logcache_v1"
+	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
+	"github.com/poy/cf-faas-log-cache/pkg/promql"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+func TestSanitizeMetricName(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Spec("it leaves valid names alone", func(t *testing.T) {
+		for _, name := range []string{"cpu", "_cpu", "Cpu_2", "http:requests:rate5m"} {
+			Expect(t, promql.SanitizeMetricName(name)).To(Equal(name))
+		}
+	})
+
+	o.Spec("it replaces invalid characters", func(t *testing.T) {
+		for name, expected := range map[string]string{
+			"cpu.percentage": "cpu_percentage",
+			"mem-used bytes": "mem_used_bytes",
+			"2xx":            "_xx",
+			"a[b]":           "a_b_",
+			`a\b^c`:          "a_b_c",
+			"a`b":            "a_b",
+			"[a":             "_a",
+			"héllo":          "h_llo",
+			"":               "",
+		} {
+			Expect(t, promql.SanitizeMetricName(name)).To(Equal(expected))
+		}
+	})
+}
+
+func BenchmarkSanitizeMetricName(b *testing.B) {
+	for _, name := range []string{"cpu_percentage", "cpu.percentage"} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				promql.SanitizeMetricName(name)
+			}
+		})
+	}
+}
+
+// BenchmarkLocalClientGauges shows the cost of each envelope a selector
+// reads. Each gauge has several metrics whose names have to be sanitized.
+func BenchmarkLocalClientGauges(b *testing.B) {
+	var envelopes []*loggregator_v2.Envelope
+	for i := 0; i < 1000; i++ {
+		envelopes = append(envelopes, &loggregator_v2.Envelope{
+			Timestamp:  time.Unix(99, 0).Add(-time.Duration(i) * time.Millisecond).UnixNano(),
+			SourceId:   "some-id",
+			InstanceId: fmt.Sprint(i % 4),
+			Message: &loggregator_v2.Envelope_Gauge{
+				Gauge: &loggregator_v2.Gauge{
+					Metrics: map[string]*loggregator_v2.GaugeValue{
+						"cpu":          {Value: 1},
+						"memory.used":  {Value: 2},
+						"memory.quota": {Value: 3},
+						"disk.used":    {Value: 4},
+						"disk.quota":   {Value: 5},
+					},
+				},
+			},
+		})
+	}
+
+	s := newSpyAppNameSanitizer()
+	s.result = `memory_used{source_id="some-id"}`
+	c := promql.NewLocalClient(staticDataReader(envelopes), s)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.PromQLAt(context.Background(), "some-query", time.Unix(100, 0)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*len(envelopes)), "ns/envelope")
+}
+
+type staticDataReader []*loggregator_v2.Envelope
+
+func (r staticDataReader) Read(ctx context.Context, in *logcache_v1.ReadRequest) (*logcache_v1.ReadResponse, error) {
+	return &logcache_v1.ReadResponse{
+		Envelopes: &loggregator_v2.EnvelopeBatch{
+			Batch: r,
+		},
+	}, nil
+}
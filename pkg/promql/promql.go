@@ -3,7 +3,6 @@ package promql
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"regexp"
 	"sort"
@@ -12,85 +11,99 @@ import (
 	"code.cloudfoundry.org/go-log-cache/rpc/logcache_v1"
 	"code.cloudfoundry.org/go-loggregator/rpc/loggregator_v2"
 	"github.com/prometheus/prometheus/pkg/labels"
-	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
 )
 
+// Parse returns the source ID of each selector in the query. It returns an
+// error if the query is invalid or a selector does not have a source_id.
+// See Analyze for more details about a query.
 func Parse(query string) ([]string, error) {
-	sit := &sourceIDTracker{}
-	var closureErr error
-	lcq := &logCacheQueryable{
-		log:        log.New(ioutil.Discard, "", 0),
-		interval:   time.Second,
-		dataReader: sit,
-
-		// Prometheus does not hand us back the error the way you might
-		// expect.  Therefore, we have to propagate the error back up
-		// manually.
-		errf: func(e error) { closureErr = e },
-	}
-	queryable := promql.NewEngine(nil, nil, 10, 10*time.Second)
-
-	qq, err := queryable.NewInstantQuery(lcq, query, time.Time{})
+	a, err := Analyze(query)
 	if err != nil {
 		return nil, err
 	}
 
-	qq.Exec(context.Background())
-	if closureErr != nil {
-		return nil, closureErr
-	}
-
-	return sit.sourceIDs, nil
+	return a.SourceIDs()
 }
 
-type dataReader interface {
+// DataReader reads envelopes from Log Cache (e.g., LogCacheReader).
+type DataReader interface {
 	Read(ctx context.Context, in *logcache_v1.ReadRequest) (*logcache_v1.ReadResponse, error)
 }
 
-type sourceIDTracker struct {
-	sourceIDs []string
-}
-
-func (t *sourceIDTracker) Read(ctx context.Context, in *logcache_v1.ReadRequest) (*logcache_v1.ReadResponse, error) {
-	t.sourceIDs = append(t.sourceIDs, in.GetSourceId())
-	return &logcache_v1.ReadResponse{}, nil
+// SourceLister lists the source IDs Log Cache has data for (e.g.,
+// LogCacheReader).
+type SourceLister interface {
+	Meta(ctx context.Context) (map[string]*logcache_v1.MetaInfo, error)
 }
 
 type logCacheQueryable struct {
 	log        *log.Logger
 	interval   time.Duration
-	dataReader dataReader
+	dataReader DataReader
+	sources    SourceLister
 	errf       func(error)
+
+	// limit is the number of envelopes to request per page and maxPages
+	// how many pages to read per selector. When a selector is cut short,
+	// warnf is called.
+	limit    int64
+	maxPages int
+	warnf    func(string)
+
+	// buckets are the upper bounds (in seconds) of the histograms built
+	// from timers.
+	buckets []float64
+
+	// logPatterns derive labels from the payloads of logs.
+	logPatterns []*regexp.Regexp
 }
 
 func (l *logCacheQueryable) Querier(ctx context.Context, mint int64, maxt int64) (storage.Querier, error) {
 	return &LogCacheQuerier{
-		log:        l.log,
-		ctx:        ctx,
-		start:      time.Unix(0, mint*int64(time.Millisecond)),
-		end:        time.Unix(0, maxt*int64(time.Millisecond)),
-		interval:   l.interval,
-		dataReader: l.dataReader,
-		errf:       l.errf,
+		log:         l.log,
+		ctx:         ctx,
+		start:       time.Unix(0, mint*int64(time.Millisecond)),
+		end:         time.Unix(0, maxt*int64(time.Millisecond)),
+		interval:    l.interval,
+		dataReader:  l.dataReader,
+		sources:     l.sources,
+		errf:        l.errf,
+		limit:       l.limit,
+		maxPages:    l.maxPages,
+		warnf:       l.warnf,
+		buckets:     l.buckets,
+		logPatterns: l.logPatterns,
 	}, nil
 }
 
 type LogCacheQuerier struct {
-	log        *log.Logger
-	ctx        context.Context
-	start      time.Time
-	end        time.Time
-	interval   time.Duration
-	dataReader dataReader
-	errf       func(error)
+	log         *log.Logger
+	ctx         context.Context
+	start       time.Time
+	end         time.Time
+	interval    time.Duration
+	dataReader  DataReader
+	sources     SourceLister
+	errf        func(error)
+	limit       int64
+	maxPages    int
+	warnf       func(string)
+	buckets     []float64
+	logPatterns []*regexp.Regexp
+
+	// scope limits LabelValues and LabelNames to the given source IDs.
+	scope []string
+
+	// knownSourceIDs are read from the SourceLister once per query.
+	knownSourceIDs []string
 }
 
 func (l *LogCacheQuerier) Select(params *storage.SelectParams, ll ...*labels.Matcher) (storage.SeriesSet, error) {
 	var (
-		sourceID string
-		metric   string
-		ls       []labels.Label
+		sourceIDMatchers []*labels.Matcher
+		metric           string
+		ms               []*labels.Matcher
 	)
 	for _, l := range ll {
 		if l.Name == "__name__" {
@@ -98,93 +111,244 @@ func (l *LogCacheQuerier) Select(params *storage.SelectParams, ll ...*labels.Mat
 			continue
 		}
 		if l.Name == "source_id" {
-			sourceID = l.Value
+			sourceIDMatchers = append(sourceIDMatchers, l)
 			continue
 		}
-		ls = append(ls, labels.Label{
-			Name:  l.Name,
-			Value: l.Value,
-		})
+		ms = append(ms, l)
 	}
 
-	if sourceID == "" {
-		err := fmt.Errorf("Metric '%s' does not have a 'source_id' label.", metric)
+	if !hasSourceID(sourceIDMatchers) {
+		err := &Error{
+			Type: ErrBadData,
+			Msg:  fmt.Sprintf("Metric '%s' does not have a 'source_id' label.", metric),
+		}
 		l.errf(err)
 		return nil, err
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	envelopeBatch, err := l.dataReader.Read(ctx, &logcache_v1.ReadRequest{
-		SourceId:  sourceID,
-		StartTime: l.start.Add(-time.Second).UnixNano(),
-		EndTime:   l.end.UnixNano(),
-	})
+	sourceIDs, err := l.sourceIDs(sourceIDMatchers)
 	if err != nil {
 		l.errf(err)
 		return nil, err
 	}
 
 	builder := newSeriesBuilder()
-	for _, e := range envelopeBatch.GetEnvelopes().GetBatch() {
-		if !l.hasLabels(e.GetTags(), ls) {
-			continue
+	for _, sourceID := range sourceIDs {
+		envelopes, err := l.read(sourceID)
+		if err != nil {
+			l.errf(err)
+			return nil, err
 		}
 
-		var f float64
-		switch e.Message.(type) {
-		case *loggregator_v2.Envelope_Counter:
-			if SanitizeMetricName(e.GetCounter().GetName()) != metric {
+		l.addEnvelopes(builder, sourceID, metric, ms, envelopes)
+	}
+
+	return builder.buildSeriesSet(), nil
+}
+
+func (l *LogCacheQuerier) addEnvelopes(
+	builder *seriesSetBuilder,
+	sourceID string,
+	metric string,
+	ms []*labels.Matcher,
+	envelopes []*loggregator_v2.Envelope,
+) {
+	c := newEnvelopeConverter(metric, l.buckets, l.logPatterns)
+	for _, e := range envelopes {
+		// Like Log Cache's PromQL endpoint, every series has a source_id
+		// label.
+		tags := c.labels(e)
+		tags["source_id"] = sourceID
+
+		t := time.Unix(0, e.GetTimestamp()).Truncate(l.interval).UnixNano() / int64(time.Millisecond)
+		for _, p := range c.convert(e, tags) {
+			if !l.hasLabels(p.tags, ms) {
 				continue
 			}
 
-			f = float64(e.GetCounter().GetTotal())
-		case *loggregator_v2.Envelope_Gauge:
-			value := checkMapForSanitizedMetricName(e.GetGauge(), metric)
+			builder.add(p.tags, sample{
+				t: t,
+				v: p.v,
+			})
+		}
+	}
+}
 
-			if value == nil {
-				continue
+// hasSourceID reports whether the matchers select by source_id. A
+// source_id="" matcher selects the series without one, which Log Cache does
+// not have.
+func hasSourceID(ms []*labels.Matcher) bool {
+	for _, m := range ms {
+		if m.Type == labels.MatchEqual && m.Value == "" {
+			return false
+		}
+	}
+
+	return len(ms) > 0
+}
+
+// sourceIDs returns the source IDs that every matcher selects. With an
+// equality matcher, that is at most its value. Otherwise the matchers are
+// checked against every source ID Log Cache knows about, which requires a
+// SourceLister.
+func (l *LogCacheQuerier) sourceIDs(ms []*labels.Matcher) ([]string, error) {
+	var candidates []string
+	for _, m := range ms {
+		if m.Type == labels.MatchEqual {
+			candidates = []string{m.Value}
+			break
+		}
+	}
+
+	if candidates == nil {
+		if l.sources == nil {
+			return nil, &Error{
+				Type: ErrBadData,
+				Msg:  fmt.Sprintf("source_id matcher %s is not supported: only source_id=\"...\" is", ms[0]),
 			}
+		}
+
+		known, err := l.allSourceIDs()
+		if err != nil {
+			return nil, err
+		}
+		candidates = known
+	}
+
+	var sourceIDs []string
+	for _, sourceID := range candidates {
+		if matchesAll(ms, sourceID) {
+			sourceIDs = append(sourceIDs, sourceID)
+		}
+	}
+
+	return sourceIDs, nil
+}
+
+func matchesAll(ms []*labels.Matcher, value string) bool {
+	for _, m := range ms {
+		if !m.Matches(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// allSourceIDs returns every source ID Log Cache knows about.
+func (l *LogCacheQuerier) allSourceIDs() ([]string, error) {
+	if l.knownSourceIDs != nil {
+		return l.knownSourceIDs, nil
+	}
+
+	meta, err := l.sources.Meta(l.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l.knownSourceIDs = []string{}
+	for sourceID := range meta {
+		l.knownSourceIDs = append(l.knownSourceIDs, sourceID)
+	}
+	sort.Strings(l.knownSourceIDs)
+
+	return l.knownSourceIDs, nil
+}
+
+// read pages through the querier's window. Log Cache caps the number of
+// envelopes it returns per request, so each page starts at the timestamp
+// of the last envelope of the previous one. Several envelopes can share
+// that timestamp, so the ones that were already read are skipped. If there
+// are more pages than maxPages, the envelopes read so far are returned and
+// warnf is called.
+func (l *LogCacheQuerier) read(sourceID string) ([]*loggregator_v2.Envelope, error) {
+	var (
+		envelopes []*loggregator_v2.Envelope
+		start     = l.start.Add(-time.Second).UnixNano()
+		end       = l.end.UnixNano()
+
+		// seen has the envelopes at start that were already read.
+		seen map[string]bool
+	)
+
+	for page := 0; l.maxPages <= 0 || page < l.maxPages; page++ {
+		resp, err := l.dataReader.Read(l.ctx, &logcache_v1.ReadRequest{
+			SourceId:  sourceID,
+			StartTime: start,
+			EndTime:   end,
+			Limit:     l.limit,
+		})
+		if err != nil {
+			return nil, err
+		}
 
-			f = value.GetValue()
-		case *loggregator_v2.Envelope_Timer:
-			if SanitizeMetricName(e.GetTimer().GetName()) != metric {
+		batch := resp.GetEnvelopes().GetBatch()
+		n := len(envelopes)
+		for _, e := range batch {
+			if e.GetTimestamp() == start && seen[envelopeKey(e)] {
 				continue
 			}
+			envelopes = append(envelopes, e)
+		}
 
-			timer := e.GetTimer()
-			f = float64(timer.GetStop() - timer.GetStart())
+		if len(batch) == 0 || l.limit <= 0 || int64(len(batch)) < l.limit {
+			return envelopes, nil
 		}
 
-		e.Timestamp = time.Unix(0, e.GetTimestamp()).Truncate(l.interval).UnixNano()
+		if len(envelopes) == n {
+			// A full page of envelopes that were already read. They all
+			// share start, so reading from it again returns the same
+			// page.
+			if l.warnf != nil {
+				l.warnf(fmt.Sprintf(
+					"results for source_id %s are incomplete: more than %d envelopes at %d",
+					sourceID, l.limit, start,
+				))
+			}
+			start, seen = start+1, nil
+			continue
+		}
 
-		builder.add(e.Tags, sample{
-			t: e.GetTimestamp() / int64(time.Millisecond),
-			v: f,
-		})
+		last := batch[len(batch)-1].GetTimestamp()
+		if last != start {
+			seen = nil
+		}
+		if seen == nil {
+			seen = make(map[string]bool)
+		}
+		for _, e := range batch {
+			if e.GetTimestamp() == last {
+				seen[envelopeKey(e)] = true
+			}
+		}
+		start = last
 	}
 
-	return builder.buildSeriesSet(), nil
+	if l.warnf != nil {
+		l.warnf(fmt.Sprintf(
+			"results for source_id %s are truncated: read %d pages of %d envelopes",
+			sourceID, l.maxPages, l.limit,
+		))
+	}
+
+	return envelopes, nil
+}
+
+// envelopeKey identifies an envelope among those that share its timestamp.
+func envelopeKey(e *loggregator_v2.Envelope) string {
+	return e.String()
 }
 
 func checkMapForSanitizedMetricName(gauge *loggregator_v2.Gauge, metric string) *loggregator_v2.GaugeValue {
 	metricsMap := gauge.GetMetrics()
 	for k, v := range metricsMap {
-		if SanitizeMetricName(k) == metric {
+		if sanitizedNames.sanitize(k) == metric {
 			return v
 		}
 	}
 	return nil
 }
 
-func SanitizeMetricName(name string) string {
-	// Forcefully convert all invalid separators to underscores
-	// First character: Match the if it's NOT A-z or underscore ^[^A-z_]
-	// All others: Match if they're NOT alphanumeric or understore [\W_]+?
-
-	var re = regexp.MustCompile(`^[^A-z_]|[\W_]+?`)
-	return re.ReplaceAllString(name, "_")
-}
-
 func convertToLabels(tags map[string]string) []labels.Label {
 	ls := make([]labels.Label, 0, len(tags))
 	for n, v := range tags {
@@ -196,9 +360,11 @@ func convertToLabels(tags map[string]string) []labels.Label {
 	return ls
 }
 
-func (l *LogCacheQuerier) hasLabels(tags map[string]string, ls []labels.Label) bool {
-	for _, l := range ls {
-		if v, ok := tags[l.Name]; !ok || v != l.Value {
+// hasLabels reports whether the tags satisfy every matcher. As in
+// Prometheus, a missing tag matches like an empty one.
+func (l *LogCacheQuerier) hasLabels(tags map[string]string, ms []*labels.Matcher) bool {
+	for _, m := range ms {
+		if !m.Matches(tags[m.Name]) {
 			return false
 		}
 	}
@@ -206,8 +372,118 @@ func (l *LogCacheQuerier) hasLabels(tags map[string]string, ls []labels.Label) b
 	return true
 }
 
+// LabelValues returns the distinct values of the tag in the querier's
+// window. The values of source_id are the source IDs that have envelopes
+// and those of __name__ are the metric names.
 func (l *LogCacheQuerier) LabelValues(name string) ([]string, error) {
-	panic("not implemented")
+	c := newEnvelopeConverter("", l.buckets, l.logPatterns)
+	values := map[string]bool{}
+	err := l.eachEnvelope(func(sourceID string, e *loggregator_v2.Envelope) {
+		switch name {
+		case "source_id":
+			values[sourceID] = true
+		case "__name__":
+			for _, n := range metricNames(e) {
+				values[n] = true
+			}
+		default:
+			if v := c.labels(e)[name]; v != "" {
+				values[v] = true
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sortedKeys(values), nil
+}
+
+// LabelNames returns the distinct tag names in the querier's window, along
+// with source_id and __name__.
+func (l *LogCacheQuerier) LabelNames() ([]string, error) {
+	c := newEnvelopeConverter("", l.buckets, l.logPatterns)
+	names := map[string]bool{}
+	err := l.eachEnvelope(func(sourceID string, e *loggregator_v2.Envelope) {
+		names["source_id"] = true
+		if len(metricNames(e)) > 0 {
+			names["__name__"] = true
+		}
+
+		for k := range c.labels(e) {
+			names[k] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sortedKeys(names), nil
+}
+
+// eachEnvelope reads the envelopes of the querier's source IDs (or of every
+// source ID if it has none).
+func (l *LogCacheQuerier) eachEnvelope(f func(sourceID string, e *loggregator_v2.Envelope)) error {
+	sourceIDs := l.scope
+	if len(sourceIDs) == 0 {
+		if l.sources == nil {
+			return &Error{
+				Type: ErrBadData,
+				Msg:  "at least one source_id is required",
+			}
+		}
+
+		var err error
+		sourceIDs, err = l.allSourceIDs()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sourceID := range sourceIDs {
+		envelopes, err := l.read(sourceID)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range envelopes {
+			f(sourceID, e)
+		}
+	}
+
+	return nil
+}
+
+func metricNames(e *loggregator_v2.Envelope) []string {
+	switch e.Message.(type) {
+	case *loggregator_v2.Envelope_Counter:
+		return []string{sanitizedNames.sanitize(e.GetCounter().GetName())}
+	case *loggregator_v2.Envelope_Gauge:
+		var names []string
+		for k := range e.GetGauge().GetMetrics() {
+			names = append(names, sanitizedNames.sanitize(k))
+		}
+		return names
+	case *loggregator_v2.Envelope_Timer:
+		name := sanitizedNames.sanitize(e.GetTimer().GetName())
+		return []string{name, name + "_bucket", name + "_count", name + "_sum"}
+	case *loggregator_v2.Envelope_Log:
+		return []string{LogLinesMetric}
+	case *loggregator_v2.Envelope_Event:
+		return []string{EventsMetric}
+	default:
+		return nil
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
 }
 
 func (l *LogCacheQuerier) Close() error {
@@ -307,7 +583,7 @@ type seriesSetBuilder struct {
 }
 
 func (b *seriesSetBuilder) add(tags map[string]string, s sample) {
-	seriesID := b.getSeriesID(tags)
+	seriesID := getSeriesID(tags)
 	d, ok := b.data[seriesID]
 
 	if !ok {
@@ -323,7 +599,7 @@ func (b *seriesSetBuilder) add(tags map[string]string, s sample) {
 	b.data[seriesID] = d
 }
 
-func (b *seriesSetBuilder) getSeriesID(tags map[string]string) string {
+func getSeriesID(tags map[string]string) string {
 	keys := make([]string, 0, len(tags))
 	for k := range tags {
 		keys = append(keys, k)
@@ -347,9 +623,30 @@ func (b *seriesSetBuilder) buildSeriesSet() storage.SeriesSet {
 	for _, v := range b.data {
 		set.series = append(set.series, &concreteSeries{
 			labels:  convertToLabels(v.tags),
-			samples: v.samples,
+			samples: dedupeSamples(v.samples),
 		})
 	}
 
 	return set
 }
+
+// dedupeSamples sorts the samples by timestamp and keeps only the last
+// sample for each timestamp. Several envelopes can be truncated to the same
+// timestamp, but Prometheus expects strictly increasing timestamps (e.g., a
+// lower counter total at the same timestamp would look like a reset).
+func dedupeSamples(samples []sample) []sample {
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].t < samples[j].t
+	})
+
+	deduped := samples[:0]
+	for _, s := range samples {
+		if n := len(deduped); n > 0 && deduped[n-1].t == s.t {
+			deduped[n-1] = s
+			continue
+		}
+		deduped = append(deduped, s)
+	}
+
+	return deduped
+}
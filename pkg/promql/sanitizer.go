@@ -3,46 +3,215 @@ package promql
 import (
 	"context"
 	"fmt"
-	"log"
 	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql"
 )
 
 type Sanitizer struct {
-	f GuidFetcher
+	f         GuidFetcher
+	sourceIDs map[string]bool
 }
 
 type GuidFetcher interface {
 	GetAppGuid(ctx context.Context, appName string) (string, error)
 }
 
-func NewSanitizer(f GuidFetcher) *Sanitizer {
-	return &Sanitizer{
-		f: f,
+// SanitizerOption configures a Sanitizer.
+type SanitizerOption func(*Sanitizer)
+
+// WithSourceIDs sets the names that are source IDs as they are (e.g.,
+// platform components such as doppler or gorouter).
+func WithSourceIDs(sourceIDs ...string) SanitizerOption {
+	return func(s *Sanitizer) {
+		for _, sourceID := range sourceIDs {
+			s.sourceIDs[sourceID] = true
+		}
+	}
+}
+
+func NewSanitizer(f GuidFetcher, opts ...SanitizerOption) *Sanitizer {
+	s := &Sanitizer{
+		f:         f,
+		sourceIDs: make(map[string]bool),
 	}
+
+	for _, o := range opts {
+		o(s)
+	}
+
+	return s
 }
 
+// Sanitize replaces the app names in the source_id matchers of the query
+// with their GUIDs. Every matcher type is handled. For regex matchers, each
+// literal alternative (e.g., "a" and "b" in "a|b") is resolved. The query is
+// printed back out in its canonical form.
+//
+// Values that are already GUIDs are left as they are, and so are the names
+// given with WithSourceIDs. It returns an error if any other name can not
+// be resolved (e.g., it is unknown or ambiguous, or CAPI fails) rather than
+// querying Log Cache for a source that does not exist. The error for an
+// unknown name has a NotFound method that returns true.
 func (s *Sanitizer) Sanitize(ctx context.Context, query string) (string, error) {
-	names, err := Parse(query)
+	expr, err := promql.ParseExpr(query)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse PromQL query %s: %s", query, err)
+		return "", &Error{
+			Type: ErrBadData,
+			Msg:  fmt.Sprintf("failed to parse PromQL query %s: %s", query, err),
+		}
 	}
-	m := map[string]string{}
-	for _, name := range names {
+
+	// Resolve each name only once per query.
+	guids := map[string]string{}
+	resolve := func(name string) (string, error) {
+		if IsGuid(name) || s.sourceIDs[name] {
+			return name, nil
+		}
+
+		if guid, ok := guids[name]; ok {
+			return guid, nil
+		}
+
 		guid, err := s.f.GetAppGuid(ctx, name)
+		if err == nil && guid == "" {
+			err = &notFoundError{appName: name}
+		}
+
+		if IsNotFound(err) {
+			return "", err
+		}
+
 		if err != nil {
-			log.Printf("failed to resolve %s to guid... just using %s: %s", name, name, err)
-			guid = name
+			return "", fmt.Errorf("failed to resolve source_id %q: %s", name, err)
+		}
+		guids[name] = guid
+		return guid, nil
+	}
+
+	var closureErr error
+	promql.Inspect(expr, func(node promql.Node, _ []promql.Node) error {
+		var matchers []*labels.Matcher
+		switch n := node.(type) {
+		case *promql.VectorSelector:
+			matchers = n.LabelMatchers
+		case *promql.MatrixSelector:
+			matchers = n.LabelMatchers
+		default:
+			return nil
+		}
+
+		for i, m := range matchers {
+			if m.Name != "source_id" {
+				continue
+			}
+
+			nm, err := s.sanitizeMatcher(m, resolve)
+			if err != nil {
+				closureErr = err
+				return err
+			}
+			matchers[i] = nm
 		}
-		m[name] = guid
+
+		return nil
+	})
+
+	if closureErr != nil {
+		return "", closureErr
 	}
 
-	for k, v := range m {
-		sanitizeRE, err := regexp.Compile(`source_id\s*\=\s*["']` + k + `["']`)
+	return expr.String(), nil
+}
+
+// IsGuid reports whether the source ID is already a GUID. Such source IDs
+// are not resolved.
+func IsGuid(sourceID string) bool {
+	return guidRe.MatchString(sourceID)
+}
+
+var guidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func (s *Sanitizer) sanitizeMatcher(m *labels.Matcher, resolve func(string) (string, error)) (*labels.Matcher, error) {
+	var value string
+	switch m.Type {
+	case labels.MatchEqual, labels.MatchNotEqual:
+		guid, err := resolve(m.Value)
 		if err != nil {
-			return "", fmt.Errorf("failed to create regex: %s", err)
+			return nil, err
 		}
-		query = sanitizeRE.ReplaceAllString(query, `source_id="`+v+`"`)
+		value = guid
+	case labels.MatchRegexp, labels.MatchNotRegexp:
+		alts := splitAlternatives(m.Value)
+		for i, alt := range alts {
+			name, ok := regexLiteral(alt)
+			if !ok {
+				// Patterns (e.g., "my-app-.*") can't be resolved. Leave
+				// them as they are.
+				continue
+			}
+			guid, err := resolve(name)
+			if err != nil {
+				return nil, err
+			}
+			alts[i] = regexp.QuoteMeta(guid)
+		}
+		value = strings.Join(alts, "|")
+	default:
+		return m, nil
+	}
+
+	nm, err := labels.NewMatcher(m.Type, m.Name, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrite matcher %s: %s", m, err)
+	}
+
+	return nm, nil
+}
+
+// splitAlternatives splits a regex on the "|" that are not escaped or
+// nested in a group or character class.
+func splitAlternatives(re string) []string {
+	var (
+		alts    []string
+		depth   int
+		inClass bool
+		start   int
+	)
+
+	for i := 0; i < len(re); i++ {
+		switch c := re[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == '|' && depth == 0:
+			alts = append(alts, re[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(alts, re[start:])
+}
+
+// regexLiteral reports whether the regex only matches a single string and
+// returns that string.
+func regexLiteral(re string) (string, bool) {
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil || parsed.Op != syntax.OpLiteral || parsed.Flags&syntax.FoldCase != 0 {
+		return "", false
 	}
 
-	return query, nil
+	return string(parsed.Rune), true
 }
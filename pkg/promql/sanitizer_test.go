@@ -44,19 +44,120 @@ func TestSanitizer(t *testing.T) {
 		Expect(t, t.spyGuidFetcher.appNames).To(Equal([]string{"s", "m"}))
 	})
 
+	o.Spec("it resolves every matcher type", func(t TS) {
+		t.spyGuidFetcher.guids = map[string]string{
+			"a": "guid-a",
+			"b": "guid-b",
+			"c": "guid-c",
+			"d": "guid-d",
+		}
+		result, err := t.s.Sanitize(context.Background(), `metric{source_id="a"} + metric{source_id!="b"} + metric{source_id=~"c"} + metric{source_id!~"d"}`)
+		Expect(t, err).To(BeNil())
+		Expect(t, result).To(Equal(`metric{source_id="guid-a"} + metric{source_id!="guid-b"} + metric{source_id=~"guid-c"} + metric{source_id!~"guid-d"}`))
+	})
+
+	o.Spec("it resolves each alternative of a regex", func(t TS) {
+		t.spyGuidFetcher.guids = map[string]string{
+			"a": "guid-a",
+			"b": "guid-b",
+		}
+		result, err := t.s.Sanitize(context.Background(), `metric{source_id=~"a|b|other-.*"}`)
+		Expect(t, err).To(BeNil())
+		Expect(t, result).To(Equal(`metric{source_id=~"guid-a|guid-b|other-.*"}`))
+	})
+
+	o.Spec("it handles names with regex metacharacters", func(t TS) {
+		t.spyGuidFetcher.guids = map[string]string{
+			"my.app": "guid.1",
+			"a+b":    "guid-2",
+		}
+		result, err := t.s.Sanitize(context.Background(), `metric{source_id="my.app"} / metric{source_id=~"a\\+b"}`)
+		Expect(t, err).To(BeNil())
+		Expect(t, result).To(Equal(`metric{source_id="guid.1"} / metric{source_id=~"guid-2"}`))
+		Expect(t, t.spyGuidFetcher.appNames).To(Equal([]string{"my.app", "a+b"}))
+	})
+
+	o.Spec("it resolves range selectors", func(t TS) {
+		t.spyGuidFetcher.guids = map[string]string{
+			"a": "guid-a",
+		}
+		result, err := t.s.Sanitize(context.Background(), `rate(metric{source_id="a"}[1m])`)
+		Expect(t, err).To(BeNil())
+		Expect(t, result).To(Equal(`rate(metric{source_id="guid-a"}[1m])`))
+	})
+
+	o.Spec("it resolves each name once", func(t TS) {
+		t.spyGuidFetcher.guids = map[string]string{
+			"a": "guid-a",
+		}
+		_, err := t.s.Sanitize(context.Background(), `metric{source_id="a"} / other{source_id="a"}`)
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyGuidFetcher.appNames).To(Equal([]string{"a"}))
+	})
+
+	o.Spec("it does not touch other labels", func(t TS) {
+		t.spyGuidFetcher.guids = map[string]string{
+			"a": "guid-a",
+		}
+		result, err := t.s.Sanitize(context.Background(), `metric{source_id="a",other="a"}`)
+		Expect(t, err).To(BeNil())
+		Expect(t, result).To(Equal(`metric{other="a",source_id="guid-a"}`))
+	})
+
 	o.Spec("it returns an error for an invalid query", func(t TS) {
 		_, err := t.s.Sanitize(context.Background(), `}{`)
 		Expect(t, err).To(Not(BeNil()))
+		Expect(t, err.(*promql.Error).BadQuery()).To(BeTrue())
+	})
+
+	o.Spec("it leaves GUIDs as they are", func(t TS) {
+		query := `metric{source_id="8f6a4c2e-1b3d-4e5f-a6b7-c8d9e0f1a2b3"}`
+		result, err := t.s.Sanitize(context.Background(), query)
+		Expect(t, err).To(BeNil())
+		Expect(t, result).To(Equal(query))
+		Expect(t, t.spyGuidFetcher.appNames).To(HaveLen(0))
 	})
 
-	o.Spec("it returns the query as is if the fetcher fails", func(t TS) {
+	o.Spec("it returns an error if the fetcher fails", func(t TS) {
 		t.spyGuidFetcher.err = errors.New("some-error")
-		result, err := t.s.Sanitize(context.Background(), `metric{source_id="s"} / metric{source_id="m"}`)
+		_, err := t.s.Sanitize(context.Background(), `metric{source_id="s"} / metric{source_id="m"}`)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for an unknown name", func(t TS) {
+		_, err := t.s.Sanitize(context.Background(), `metric{source_id=~"s|m"}`)
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, promql.IsNotFound(err)).To(BeTrue())
+	})
+
+	o.Spec("it leaves the given source IDs as they are", func(t TS) {
+		t.s = promql.NewSanitizer(t.spyGuidFetcher, promql.WithSourceIDs("doppler", "gorouter"))
+		t.spyGuidFetcher.guids = map[string]string{
+			"some-app": "guid-a",
+		}
+		result, err := t.s.Sanitize(context.Background(), `metric{source_id="doppler"} + metric{source_id=~"gorouter|some-app"}`)
 		Expect(t, err).To(BeNil())
-		Expect(t, result).To(Equal(`metric{source_id="s"} / metric{source_id="m"}`))
+		Expect(t, result).To(Equal(`metric{source_id="doppler"} + metric{source_id=~"gorouter|guid-a"}`))
+		Expect(t, t.spyGuidFetcher.appNames).To(Equal([]string{"some-app"}))
+	})
+
+	o.Spec("it returns the error for names that the fetcher does not find", func(t TS) {
+		t.spyGuidFetcher.err = notFoundError{}
+		_, err := t.s.Sanitize(context.Background(), `metric{source_id="log-cache"}`)
+		Expect(t, err).To(Equal(notFoundError{}))
 	})
 }
 
+type notFoundError struct{}
+
+func (notFoundError) Error() string {
+	return "not found"
+}
+
+func (notFoundError) NotFound() bool {
+	return true
+}
+
 type spyGuidFetcher struct {
 	ctx      context.Context
 	appNames []string
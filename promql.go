@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"regexp"
+	"strconv"
 
 	faas "github.com/poy/cf-faas"
 )
@@ -37,15 +40,23 @@ func Start(h Handler) {
 }
 
 type QueryResult struct {
-	Status  string    `json:"status"`
-	Data    RawResult `json:"data"`
-	Context string    `json:"context"`
+	Status    string    `json:"status"`
+	Data      RawResult `json:"data"`
+	ErrorType string    `json:"errorType,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Warnings  []string  `json:"warnings,omitempty"`
+	Context   string    `json:"context"`
+
+	// Backfilled is set when the result is for a tick that was missed (e.g.,
+	// while the service was restarting) and evaluated later.
+	Backfilled bool `json:"backfilled,omitempty"`
 }
 
 type RawResult struct {
 	ResultType string `json:"resultType"`
 
-	// Result will be *Sample or *Series
+	// Result will be *Sample or *Series. A scalar or string result has a
+	// single *Scalar or *String.
 	Result []interface{} `json:"-"`
 
 	// RawData is for unmarshal only. Don't use.
@@ -57,11 +68,202 @@ type Sample struct {
 	Value  []json.Number     `json:"value"`
 }
 
+func (s Sample) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Metric map[string]string `json:"metric"`
+		Value  []interface{}     `json:"value"`
+	}{
+		Metric: s.Metric,
+		Value:  encodeNumbers(s.Value),
+	})
+}
+
+func (s *Sample) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Metric map[string]string `json:"metric"`
+		Value  []json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	value, err := decodeNumbers(v.Value)
+	if err != nil {
+		return err
+	}
+
+	s.Metric, s.Value = v.Metric, value
+
+	return nil
+}
+
 type Series struct {
 	Metric map[string]string `json:"metric"`
 	Values [][]json.Number   `json:"values"`
 }
 
+func (s Series) MarshalJSON() ([]byte, error) {
+	values := make([][]interface{}, 0, len(s.Values))
+	for _, v := range s.Values {
+		values = append(values, encodeNumbers(v))
+	}
+
+	return json.Marshal(struct {
+		Metric map[string]string `json:"metric"`
+		Values [][]interface{}   `json:"values"`
+	}{
+		Metric: s.Metric,
+		Values: values,
+	})
+}
+
+func (s *Series) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Metric map[string]string   `json:"metric"`
+		Values [][]json.RawMessage `json:"values"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	var values [][]json.Number
+	for _, raw := range v.Values {
+		value, err := decodeNumbers(raw)
+		if err != nil {
+			return err
+		}
+		values = append(values, value)
+	}
+
+	s.Metric, s.Values = v.Metric, values
+
+	return nil
+}
+
+// decodeNumbers decodes numbers that are either JSON numbers or strings.
+// Prometheus encodes values as strings, which is the only way to encode NaN
+// and infinite values (e.g., "NaN" or "+Inf").
+func decodeNumbers(raw []json.RawMessage) ([]json.Number, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	numbers := make([]json.Number, 0, len(raw))
+	for _, r := range raw {
+		var n json.Number
+		if len(r) > 0 && r[0] == '"' {
+			var s string
+			if err := json.Unmarshal(r, &s); err != nil {
+				return nil, err
+			}
+
+			if !isNumber(s) {
+				return nil, fmt.Errorf("invalid number %q", s)
+			}
+			n = json.Number(s)
+		} else if err := json.Unmarshal(r, &n); err != nil {
+			return nil, err
+		}
+
+		numbers = append(numbers, n)
+	}
+
+	return numbers, nil
+}
+
+// encodeNumbers is the inverse of decodeNumbers. Anything that is not a
+// valid JSON number (e.g., NaN and infinite values) is encoded as a string.
+func encodeNumbers(numbers []json.Number) []interface{} {
+	if numbers == nil {
+		return nil
+	}
+
+	values := make([]interface{}, 0, len(numbers))
+	for _, n := range numbers {
+		if !jsonNumberRe.MatchString(string(n)) {
+			values = append(values, string(n))
+			continue
+		}
+
+		values = append(values, n)
+	}
+
+	return values
+}
+
+// isNumber reports whether the string is a JSON number or NaN or an
+// infinite value. strconv.ParseFloat alone also accepts Go's syntax (e.g.,
+// "0x1p-2" or "1_0"), which is neither.
+func isNumber(s string) bool {
+	if jsonNumberRe.MatchString(s) {
+		return true
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	return err == nil && (math.IsNaN(f) || math.IsInf(f, 0))
+}
+
+var jsonNumberRe = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// Scalar is the result of a query that evaluates to a number (e.g.,
+// time()). It is encoded as [timestamp, value].
+type Scalar struct {
+	Timestamp json.Number
+	Value     json.Number
+}
+
+func (s Scalar) MarshalJSON() ([]byte, error) {
+	return json.Marshal(encodeNumbers([]json.Number{s.Timestamp, s.Value}))
+}
+
+func (s *Scalar) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	if len(raw) != 2 {
+		return fmt.Errorf("scalar has %d elements instead of [timestamp, value]", len(raw))
+	}
+
+	v, err := decodeNumbers(raw)
+	if err != nil {
+		return err
+	}
+
+	s.Timestamp, s.Value = v[0], v[1]
+
+	return nil
+}
+
+// String is the result of a query that evaluates to a string literal. It is
+// encoded as [timestamp, value].
+type String struct {
+	Timestamp json.Number
+	Value     string
+}
+
+func (s String) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{s.Timestamp, s.Value})
+}
+
+func (s *String) UnmarshalJSON(data []byte) error {
+	var v []json.RawMessage
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	if len(v) != 2 {
+		return fmt.Errorf("string has %d elements instead of [timestamp, value]", len(v))
+	}
+
+	if err := json.Unmarshal(v[0], &s.Timestamp); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(v[1], &s.Value)
+}
+
 func UnmarshalJSON(data []byte, r *QueryResult) error {
 	dec := json.NewDecoder(bytes.NewReader(data))
 	dec.UseNumber()
@@ -70,25 +272,107 @@ func UnmarshalJSON(data []byte, r *QueryResult) error {
 		return err
 	}
 
+	results, err := unmarshalResult(r.Data)
+	if err != nil {
+		return err
+	}
+	r.Data.RawResult = nil
+	r.Data.Result = results
+
+	return nil
+}
+
+func unmarshalResult(d RawResult) ([]interface{}, error) {
+	switch d.ResultType {
+	case "scalar", "string":
+		// A scalar or string result is a single [timestamp, value] rather
+		// than a list, so RawResult holds its two elements.
+		if len(d.RawResult) == 0 {
+			return nil, nil
+		}
+
+		data, err := json.Marshal(d.RawResult)
+		if err != nil {
+			return nil, err
+		}
+
+		var dst interface{} = &Scalar{}
+		if d.ResultType == "string" {
+			dst = &String{}
+		}
+
+		if err := json.Unmarshal(data, dst); err != nil {
+			return nil, err
+		}
+
+		return []interface{}{dst}, nil
+	}
+
 	var results []interface{}
-	for _, s := range r.Data.RawResult {
+	for _, s := range d.RawResult {
 		var dst interface{}
-		switch r.Data.ResultType {
+		switch d.ResultType {
 		case "vector":
 			dst = &Sample{}
 		case "matrix":
 			dst = &Series{}
 		default:
-			return fmt.Errorf("unknown ResultType: %s", r.Data.ResultType)
+			return nil, fmt.Errorf("unknown ResultType: %s", d.ResultType)
 		}
 
 		if err := json.Unmarshal(s, dst); err != nil {
-			return err
+			return nil, err
 		}
 		results = append(results, dst)
 	}
-	r.Data.RawResult = nil
-	r.Data.Result = results
 
-	return nil
+	return results, nil
+}
+
+// MarshalJSON is the inverse of UnmarshalJSON. It sets RawResult from Result
+// and then marshals the QueryResult.
+func MarshalJSON(r *QueryResult) ([]byte, error) {
+	raw, err := marshalResult(r.Data)
+	if err != nil {
+		return nil, err
+	}
+	r.Data.RawResult = raw
+
+	return json.Marshal(r)
+}
+
+func marshalResult(d RawResult) ([]json.RawMessage, error) {
+	switch d.ResultType {
+	case "scalar", "string":
+		if len(d.Result) == 0 {
+			return nil, nil
+		}
+
+		if len(d.Result) > 1 {
+			return nil, fmt.Errorf("%s result has %d values instead of 1", d.ResultType, len(d.Result))
+		}
+
+		data, err := json.Marshal(d.Result[0])
+		if err != nil {
+			return nil, err
+		}
+
+		var raw []json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+
+		return raw, nil
+	}
+
+	var raw []json.RawMessage
+	for _, rr := range d.Result {
+		data, err := json.Marshal(rr)
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, json.RawMessage(data))
+	}
+
+	return raw, nil
 }
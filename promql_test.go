@@ -1,6 +1,7 @@
 package faaspromql_test
 
 import (
+	"encoding/json"
 	"testing"
 
 	faaspromql "github.com/poy/cf-faas-log-cache"
@@ -140,6 +141,52 @@ func TestPromQLUnmarshal(t *testing.T) {
 		Expect(t, err).To(Not(BeNil()))
 	})
 
+	o.Spec("scalar", func(t *testing.T) {
+		var r faaspromql.QueryResult
+		err := faaspromql.UnmarshalJSON([]byte(`{
+          "status": "success",
+          "data": {
+            "resultType": "scalar",
+            "result": [1536028324.5, "71876608"]
+          }
+        }`), &r)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, r.Data.ResultType).To(Equal("scalar"))
+		Expect(t, r.Data.Result).To(Equal([]interface{}{
+			&faaspromql.Scalar{Timestamp: "1536028324.5", Value: "71876608"},
+		}))
+	})
+
+	o.Spec("string", func(t *testing.T) {
+		var r faaspromql.QueryResult
+		err := faaspromql.UnmarshalJSON([]byte(`{
+          "status": "success",
+          "data": {
+            "resultType": "string",
+            "result": [1536028324.5, "some-string"]
+          }
+        }`), &r)
+		Expect(t, err).To(BeNil())
+
+		Expect(t, r.Data.ResultType).To(Equal("string"))
+		Expect(t, r.Data.Result).To(Equal([]interface{}{
+			&faaspromql.String{Timestamp: "1536028324.5", Value: "some-string"},
+		}))
+	})
+
+	o.Spec("invalid scalar", func(t *testing.T) {
+		var r faaspromql.QueryResult
+		err := faaspromql.UnmarshalJSON([]byte(`{
+          "status": "success",
+          "data": {
+            "resultType": "scalar",
+            "result": [1536028324.5]
+          }
+        }`), &r)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
 	o.Spec("invalid type", func(t *testing.T) {
 		var r faaspromql.QueryResult
 		err := faaspromql.UnmarshalJSON([]byte(`{
@@ -163,3 +210,89 @@ func TestPromQLUnmarshal(t *testing.T) {
 		Expect(t, err).To(Not(BeNil()))
 	})
 }
+
+func TestPromQLMarshal(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	for _, result := range []faaspromql.QueryResult{
+		{
+			Status: "success",
+			Data: faaspromql.RawResult{
+				ResultType: "vector",
+				Result: []interface{}{
+					&faaspromql.Sample{
+						Metric: map[string]string{"a": "b"},
+						Value:  []json.Number{"100", "1"},
+					},
+				},
+			},
+		},
+		{
+			Status: "success",
+			Data: faaspromql.RawResult{
+				ResultType: "matrix",
+				Result: []interface{}{
+					&faaspromql.Series{
+						Metric: map[string]string{"a": "b"},
+						Values: [][]json.Number{{"100", "1"}, {"101", "2"}},
+					},
+				},
+			},
+		},
+		{
+			Status: "success",
+			Data: faaspromql.RawResult{
+				ResultType: "scalar",
+				Result:     []interface{}{&faaspromql.Scalar{Timestamp: "100", Value: "1.5"}},
+			},
+		},
+		{
+			Status: "success",
+			Data: faaspromql.RawResult{
+				ResultType: "string",
+				Result:     []interface{}{&faaspromql.String{Timestamp: "100", Value: "some-string"}},
+			},
+		},
+	} {
+		result := result
+		o.Spec("it round trips a "+result.Data.ResultType, func(t *testing.T) {
+			data, err := faaspromql.MarshalJSON(&result)
+			Expect(t, err).To(BeNil())
+
+			var r faaspromql.QueryResult
+			Expect(t, faaspromql.UnmarshalJSON(data, &r)).To(BeNil())
+			Expect(t, r.Data.Result).To(Equal(result.Data.Result))
+		})
+	}
+
+	o.Spec("it encodes a scalar as [timestamp, value]", func(t *testing.T) {
+		data, err := faaspromql.MarshalJSON(&faaspromql.QueryResult{
+			Status: "success",
+			Data: faaspromql.RawResult{
+				ResultType: "scalar",
+				Result:     []interface{}{&faaspromql.Scalar{Timestamp: "100", Value: "1.5"}},
+			},
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, data).To(MatchJSON(`{
+          "status": "success",
+          "context": "",
+          "data": {"resultType": "scalar", "result": [100, 1.5]}
+        }`))
+	})
+
+	o.Spec("it returns an error for a scalar result with several values", func(t *testing.T) {
+		_, err := faaspromql.MarshalJSON(&faaspromql.QueryResult{
+			Data: faaspromql.RawResult{
+				ResultType: "scalar",
+				Result: []interface{}{
+					&faaspromql.Scalar{Timestamp: "100", Value: "1"},
+					&faaspromql.Scalar{Timestamp: "100", Value: "2"},
+				},
+			},
+		})
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
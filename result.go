@@ -0,0 +1,194 @@
+package faaspromql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Vector is the result of an instant query.
+type Vector []*Sample
+
+// Matrix is the result of a range query.
+type Matrix []*Series
+
+// Vector returns the samples of a vector result. It returns an error for
+// any other ResultType.
+func (r RawResult) Vector() (Vector, error) {
+	if r.ResultType != "vector" {
+		return nil, fmt.Errorf("result is a %s, not a vector", r.ResultType)
+	}
+
+	v := make(Vector, 0, len(r.Result))
+	for _, rr := range r.Result {
+		s, ok := rr.(*Sample)
+		if !ok {
+			return nil, fmt.Errorf("vector has a %T instead of a *Sample", rr)
+		}
+		v = append(v, s)
+	}
+
+	return v, nil
+}
+
+// Matrix returns the series of a matrix result. It returns an error for
+// any other ResultType.
+func (r RawResult) Matrix() (Matrix, error) {
+	if r.ResultType != "matrix" {
+		return nil, fmt.Errorf("result is a %s, not a matrix", r.ResultType)
+	}
+
+	m := make(Matrix, 0, len(r.Result))
+	for _, rr := range r.Result {
+		s, ok := rr.(*Series)
+		if !ok {
+			return nil, fmt.Errorf("matrix has a %T instead of a *Series", rr)
+		}
+		m = append(m, s)
+	}
+
+	return m, nil
+}
+
+// Match returns the samples that have each of the labels.
+func (v Vector) Match(labels map[string]string) Vector {
+	var matched Vector
+	for _, s := range v {
+		if hasLabels(s.Metric, labels) {
+			matched = append(matched, s)
+		}
+	}
+
+	return matched
+}
+
+// Match returns the series that have each of the labels.
+func (m Matrix) Match(labels map[string]string) Matrix {
+	var matched Matrix
+	for _, s := range m {
+		if hasLabels(s.Metric, labels) {
+			matched = append(matched, s)
+		}
+	}
+
+	return matched
+}
+
+func hasLabels(metric, labels map[string]string) bool {
+	for k, v := range labels {
+		if metric[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Label returns the value of the label or an empty string if the sample
+// does not have it.
+func (s *Sample) Label(name string) string {
+	return s.Metric[name]
+}
+
+// Timestamp returns the time of the sample. It returns the zero time if the
+// sample does not have a valid timestamp.
+func (s *Sample) Timestamp() time.Time {
+	if len(s.Value) != 2 {
+		return time.Time{}
+	}
+
+	t, err := ParseTimestamp(s.Value[0])
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
+
+// Float returns the value of the sample, which may be NaN or infinite. It
+// returns NaN if the sample does not have a valid value.
+func (s *Sample) Float() float64 {
+	if len(s.Value) != 2 {
+		return math.NaN()
+	}
+
+	return parseFloat(s.Value[1])
+}
+
+// Point is a value of a series.
+type Point struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// Label returns the value of the label or an empty string if the series
+// does not have it.
+func (s *Series) Label(name string) string {
+	return s.Metric[name]
+}
+
+// Points returns the values of the series. Values without a valid
+// timestamp are skipped. Values that are not valid numbers are NaN.
+func (s *Series) Points() []Point {
+	points := make([]Point, 0, len(s.Values))
+	for _, v := range s.Values {
+		if len(v) != 2 {
+			continue
+		}
+
+		t, err := ParseTimestamp(v[0])
+		if err != nil {
+			continue
+		}
+
+		points = append(points, Point{
+			Timestamp: t,
+			Value:     parseFloat(v[1]),
+		})
+	}
+
+	return points
+}
+
+func parseFloat(n json.Number) float64 {
+	f, err := n.Float64()
+	if err != nil {
+		return math.NaN()
+	}
+
+	return f
+}
+
+// ParseTimestamp parses a timestamp in seconds (e.g., 1536028324.5 from
+// Log Cache's PromQL endpoint), milliseconds, microseconds or nanoseconds
+// (e.g., 1536028324000000000). The unit is inferred from the magnitude, so
+// timestamps are assumed to be after 1973 and before 5138.
+func ParseTimestamp(n json.Number) (time.Time, error) {
+	if i, err := n.Int64(); err == nil {
+		perSecond := unitsPerSecond(math.Abs(float64(i)))
+		return time.Unix(i/perSecond, (i%perSecond)*(int64(time.Second)/perSecond)), nil
+	}
+
+	f, err := n.Float64()
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", n)
+	}
+
+	sec, frac := math.Modf(f / float64(unitsPerSecond(math.Abs(f))))
+	return time.Unix(int64(sec), int64(math.Round(frac*float64(time.Second)))), nil
+}
+
+// unitsPerSecond infers the unit of a timestamp from its magnitude.
+func unitsPerSecond(t float64) int64 {
+	switch {
+	case t >= 1e17:
+		return int64(time.Second / time.Nanosecond)
+	case t >= 1e14:
+		return int64(time.Second / time.Microsecond)
+	case t >= 1e11:
+		return int64(time.Second / time.Millisecond)
+	default:
+		return 1
+	}
+}
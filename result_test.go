@@ -0,0 +1,212 @@
+package faaspromql_test
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	faaspromql "github.com/poy/cf-faas-log-cache"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+func TestResult(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Spec("it returns the samples of a vector", func(t *testing.T) {
+		var r faaspromql.QueryResult
+		err := faaspromql.UnmarshalJSON([]byte(`{
+          "status": "success",
+          "data": {
+            "resultType": "vector",
+            "result": [
+              {"metric": {"source_id": "a"}, "value": [1536028324.5, "1.5"]},
+              {"metric": {"source_id": "b"}, "value": [1536028324.5, "NaN"]}
+            ]
+          }
+        }`), &r)
+		Expect(t, err).To(BeNil())
+
+		v, err := r.Data.Vector()
+		Expect(t, err).To(BeNil())
+		Expect(t, v).To(HaveLen(2))
+
+		Expect(t, v[0].Label("source_id")).To(Equal("a"))
+		Expect(t, v[0].Label("other")).To(Equal(""))
+		Expect(t, v[0].Timestamp()).To(Equal(time.Unix(1536028324, int64(500*time.Millisecond))))
+		Expect(t, v[0].Float()).To(Equal(1.5))
+		Expect(t, math.IsNaN(v[1].Float())).To(BeTrue())
+
+		_, err = r.Data.Matrix()
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns the series of a matrix", func(t *testing.T) {
+		var r faaspromql.QueryResult
+		err := faaspromql.UnmarshalJSON([]byte(`{
+          "status": "success",
+          "data": {
+            "resultType": "matrix",
+            "result": [
+              {
+                "metric": {"source_id": "a"},
+                "values": [[1536032345000000000, 1], [1536032346000000000, "+Inf"]]
+              }
+            ]
+          }
+        }`), &r)
+		Expect(t, err).To(BeNil())
+
+		m, err := r.Data.Matrix()
+		Expect(t, err).To(BeNil())
+		Expect(t, m).To(HaveLen(1))
+		Expect(t, m[0].Label("source_id")).To(Equal("a"))
+		Expect(t, m[0].Points()).To(Equal([]faaspromql.Point{
+			{Timestamp: time.Unix(1536032345, 0), Value: 1},
+			{Timestamp: time.Unix(1536032346, 0), Value: math.Inf(1)},
+		}))
+
+		_, err = r.Data.Vector()
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for unexpected values", func(t *testing.T) {
+		_, err := faaspromql.RawResult{
+			ResultType: "vector",
+			Result:     []interface{}{&faaspromql.Series{}},
+		}.Vector()
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it filters by labels", func(t *testing.T) {
+		a := &faaspromql.Sample{Metric: map[string]string{"source_id": "a", "instance_id": "0"}}
+		b := &faaspromql.Sample{Metric: map[string]string{"source_id": "b", "instance_id": "0"}}
+		v := faaspromql.Vector{a, b}
+
+		Expect(t, v.Match(map[string]string{"instance_id": "0"})).To(Equal(faaspromql.Vector{a, b}))
+		Expect(t, v.Match(map[string]string{"source_id": "b"})).To(Equal(faaspromql.Vector{b}))
+		Expect(t, v.Match(map[string]string{"source_id": "c"})).To(HaveLen(0))
+
+		m := faaspromql.Matrix{{Metric: map[string]string{"source_id": "a"}}}
+		Expect(t, m.Match(map[string]string{"source_id": "a"})).To(HaveLen(1))
+		Expect(t, m.Match(map[string]string{"source_id": "b"})).To(HaveLen(0))
+	})
+
+	o.Spec("it handles samples without a valid value", func(t *testing.T) {
+		s := &faaspromql.Sample{}
+		Expect(t, s.Timestamp().IsZero()).To(BeTrue())
+		Expect(t, math.IsNaN(s.Float())).To(BeTrue())
+
+		s = &faaspromql.Sample{Value: []json.Number{"invalid", "invalid"}}
+		Expect(t, s.Timestamp().IsZero()).To(BeTrue())
+		Expect(t, math.IsNaN(s.Float())).To(BeTrue())
+	})
+
+	o.Spec("it round trips NaN and infinite values", func(t *testing.T) {
+		result := faaspromql.QueryResult{
+			Status: "success",
+			Data: faaspromql.RawResult{
+				ResultType: "vector",
+				Result: []interface{}{
+					&faaspromql.Sample{Value: []json.Number{"100", "NaN"}},
+					&faaspromql.Sample{Value: []json.Number{"100", "-Inf"}},
+				},
+			},
+		}
+
+		data, err := faaspromql.MarshalJSON(&result)
+		Expect(t, err).To(BeNil())
+
+		var r faaspromql.QueryResult
+		Expect(t, faaspromql.UnmarshalJSON(data, &r)).To(BeNil())
+		Expect(t, r.Data.Result).To(Equal(result.Data.Result))
+	})
+
+	o.Spec("it returns an error for invalid values", func(t *testing.T) {
+		for _, value := range []string{`"invalid"`, `"0x1p-2"`, `"1_0"`, `"+1"`, `".5"`} {
+			var r faaspromql.QueryResult
+			err := faaspromql.UnmarshalJSON([]byte(`{
+              "status": "success",
+              "data": {
+                "resultType": "vector",
+                "result": [{"metric": {}, "value": [1536028324.5, `+value+`]}]
+              }
+            }`), &r)
+			Expect(t, err).To(Not(BeNil()))
+		}
+	})
+
+	o.Spec("it accepts numbers encoded as strings", func(t *testing.T) {
+		var r faaspromql.QueryResult
+		err := faaspromql.UnmarshalJSON([]byte(`{
+          "status": "success",
+          "data": {
+            "resultType": "vector",
+            "result": [{"metric": {}, "value": [1536028324.5, "-1.5e3"]}]
+          }
+        }`), &r)
+		Expect(t, err).To(BeNil())
+
+		v, err := r.Data.Vector()
+		Expect(t, err).To(BeNil())
+		Expect(t, v[0].Float()).To(Equal(-1500.0))
+	})
+
+	o.Spec("it encodes values that are not JSON numbers as strings", func(t *testing.T) {
+		data, err := faaspromql.MarshalJSON(&faaspromql.QueryResult{
+			Status: "success",
+			Data: faaspromql.RawResult{
+				ResultType: "vector",
+				Result: []interface{}{
+					&faaspromql.Sample{Value: []json.Number{"100", "0x1p-2"}},
+				},
+			},
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, string(data)).To(ContainSubstring(`[100,"0x1p-2"]`))
+	})
+}
+
+func TestParseTimestamp(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Spec("it infers the unit", func(t *testing.T) {
+		expected := time.Unix(1536028324, int64(500*time.Millisecond))
+		for _, n := range []json.Number{
+			"1536028324.5",
+			"1536028324500",
+			"1536028324500000",
+			"1536028324500000000",
+			"1536028324500.0",
+		} {
+			ts, err := faaspromql.ParseTimestamp(n)
+			Expect(t, err).To(BeNil())
+			Expect(t, ts.Equal(expected)).To(BeTrue())
+		}
+	})
+
+	o.Spec("it keeps nanosecond precision", func(t *testing.T) {
+		ts, err := faaspromql.ParseTimestamp("1536028324000000001")
+		Expect(t, err).To(BeNil())
+		Expect(t, ts).To(Equal(time.Unix(1536028324, 1)))
+	})
+
+	o.Spec("it parses small timestamps as seconds", func(t *testing.T) {
+		ts, err := faaspromql.ParseTimestamp("100")
+		Expect(t, err).To(BeNil())
+		Expect(t, ts).To(Equal(time.Unix(100, 0)))
+	})
+
+	o.Spec("it returns an error for invalid timestamps", func(t *testing.T) {
+		for _, n := range []json.Number{"invalid", "NaN", "+Inf"} {
+			_, err := faaspromql.ParseTimestamp(n)
+			Expect(t, err).To(Not(BeNil()))
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package faaspromql
+
+import (
+	"encoding/json"
+	"net/http"
+
+	faas "github.com/poy/cf-faas"
+)
+
+// SourceHandler handles the changes POSTed for a sources event.
+type SourceHandler interface {
+	HandleSources(SourceChanges) error
+}
+
+type SourceHandlerFunc func(SourceChanges) error
+
+func (f SourceHandlerFunc) HandleSources(c SourceChanges) error {
+	return f(c)
+}
+
+// StartSources is like Start, but for functions that have a sources event.
+func StartSources(h SourceHandler) {
+	faas.Start(faas.HandlerFunc(func(req faas.Request) (faas.Response, error) {
+		var c SourceChanges
+		if err := json.Unmarshal(req.Body, &c); err != nil {
+			return faas.Response{}, err
+		}
+
+		if err := h.HandleSources(c); err != nil {
+			return faas.Response{}, err
+		}
+
+		return faas.Response{
+			StatusCode: http.StatusOK,
+		}, nil
+	}))
+}
+
+// SourceChanges is POSTed for a sources event when sources start emitting
+// to Log Cache (Appeared) or stop (Stale).
+type SourceChanges struct {
+	Context  string   `json:"context"`
+	Appeared []Source `json:"appeared,omitempty"`
+	Stale    []Source `json:"stale,omitempty"`
+}
+
+// Source is a Log Cache source. AppName or ServiceInstanceName is set if
+// the source ID is the GUID of an app or a service instance.
+type Source struct {
+	SourceID            string `json:"source_id"`
+	AppName             string `json:"app_name,omitempty"`
+	ServiceInstanceName string `json:"service_instance_name,omitempty"`
+	SpaceName           string `json:"space_name,omitempty"`
+	OrgName             string `json:"org_name,omitempty"`
+}